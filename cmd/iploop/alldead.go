@@ -0,0 +1,56 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/ogpourya/iploop/pkg/config"
+	"github.com/ogpourya/iploop/pkg/metrics"
+	"github.com/ogpourya/iploop/pkg/proxy"
+	"github.com/ogpourya/iploop/pkg/server"
+)
+
+// allDeadPoll is how often the pool is checked for a total outage, and how
+// often dead proxies are probed while one lasts.
+const allDeadPoll = 2 * time.Second
+
+// watchAllDead applies -on-all-dead once every proxy in the pool is dead:
+// it exits, or refuses clients until a proxy recovers, or keeps serving.
+// Unless exiting, it probes the pool every allDeadPoll instead of waiting
+// for the regular health check interval. health and display may be nil.
+func watchAllDead(cfg *config.Config, rotator *proxy.Rotator, srv *server.Server, health *proxy.HealthChecker, display *metrics.Display) {
+	ticker := time.NewTicker(allDeadPoll)
+	defer ticker.Stop()
+
+	down := false
+	for range ticker.C {
+		dead := rotator.Count() > 0 && rotator.AliveCount() == 0
+		switch {
+		case dead && !down:
+			down = true
+			switch cfg.OnAllDead {
+			case config.OnAllDeadExit:
+				if display != nil {
+					display.Stop()
+				}
+				fmt.Fprintf(os.Stderr, "\nAll proxies are dead, exiting\n")
+				srv.Close()
+				saveStats(cfg, rotator)
+				os.Exit(1)
+			case config.OnAllDeadWait:
+				srv.SetPaused(true)
+				fmt.Fprintf(os.Stderr, "\nAll proxies are dead, refusing clients until one recovers\n")
+			}
+		case !dead && down:
+			down = false
+			if cfg.OnAllDead == config.OnAllDeadWait {
+				srv.SetPaused(false)
+				fmt.Fprintf(os.Stderr, "\nA proxy recovered, accepting clients again\n")
+			}
+		}
+		if down && health != nil {
+			health.CheckNow()
+		}
+	}
+}
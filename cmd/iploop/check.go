@@ -0,0 +1,143 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/ogpourya/iploop/pkg/config"
+	"github.com/ogpourya/iploop/pkg/proxy"
+	"github.com/ogpourya/iploop/pkg/server"
+)
+
+// runCheck implements the check command: it probes every proxy, prints a
+// report and exits non-zero when none work.
+func runCheck(cfg *config.Config) {
+	rotator := loadProxies(cfg)
+	dialer, probe := newDialer(cfg, cfg.NewLogger(os.Stderr))
+	lookup := newExitIPLookup(cfg, dialer)
+
+	results := checkProxies(rotator.GetProxies(), probe, lookup, probeTimeout(cfg), cfg.CheckWorkers)
+	alive := printCheckResults(os.Stdout, results, lookup != nil)
+	if cfg.OutputAlive != "" {
+		if err := writeAlive(cfg.OutputAlive, results); err != nil {
+			fmt.Fprintf(os.Stderr, "Error writing alive proxies: %v\n", err)
+			os.Exit(1)
+		}
+	}
+	if alive == 0 {
+		os.Exit(1)
+	}
+}
+
+// probeTimeout bounds one probe of a proxy, by the check command or the
+// health checker: the TCP connect plus the tunnel setup after it.
+func probeTimeout(cfg *config.Config) time.Duration {
+	return time.Duration(cfg.DialTimeout+cfg.HandshakeTimeout) * time.Second
+}
+
+// checkResult is the outcome of probing one proxy in -check mode.
+type checkResult struct {
+	proxy   *proxy.Proxy
+	latency time.Duration
+	err     error
+	exitIP  string
+	exitErr error
+}
+
+// checkProxies probes every proxy, at most workers at a time, and returns
+// the results in the order given. If lookup is not nil, the exit IP of each
+// proxy that passes is looked up too.
+func checkProxies(proxies []*proxy.Proxy, probe proxy.ProbeFunc, lookup *server.ExitIPLookup, timeout time.Duration, workers int) []checkResult {
+	if workers < 1 {
+		workers = 1
+	}
+	results := make([]checkResult, len(proxies))
+	sem := make(chan struct{}, workers)
+	var wg sync.WaitGroup
+	for i, p := range proxies {
+		sem <- struct{}{}
+		wg.Add(1)
+		go func() {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			ctx, cancel := context.WithTimeout(context.Background(), timeout)
+			start := time.Now()
+			err := probe(ctx, p)
+			cancel()
+			results[i] = checkResult{proxy: p, latency: time.Since(start), err: err}
+			if err == nil && lookup != nil {
+				ctx, cancel := context.WithTimeout(context.Background(), timeout)
+				results[i].exitIP, results[i].exitErr = lookup.Lookup(ctx, p)
+				cancel()
+			}
+		}()
+	}
+	wg.Wait()
+	return results
+}
+
+// writeAlive writes the proxies that passed to path, one URL per line with
+// credentials, in the order checked so repeated runs diff cleanly.
+func writeAlive(path string, results []checkResult) error {
+	var b strings.Builder
+	for _, r := range results {
+		if r.err == nil {
+			b.WriteString(r.proxy.URL())
+			b.WriteByte('\n')
+		}
+	}
+	return os.WriteFile(path, []byte(b.String()), 0o600)
+}
+
+// printCheckResults writes a table of results to w, with an exit IP column
+// if withExit is set, and returns how many proxies passed. Exit IPs shared
+// by several proxies are listed after the table.
+func printCheckResults(w io.Writer, results []checkResult, withExit bool) int {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	if withExit {
+		fmt.Fprintln(tw, "STATUS\tLATENCY\tPROXY\tEXIT IP\tERROR")
+	} else {
+		fmt.Fprintln(tw, "STATUS\tLATENCY\tPROXY\tERROR")
+	}
+	alive := 0
+	shared := make(map[string]int)
+	var exits []string
+	for _, r := range results {
+		status, errStr := "ok", ""
+		if r.err != nil {
+			status, errStr = "dead", r.err.Error()
+		} else {
+			alive++
+		}
+		if !withExit {
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", status, r.latency.Round(time.Millisecond), r.proxy, errStr)
+			continue
+		}
+		exit := r.exitIP
+		switch {
+		case r.exitErr != nil:
+			exit, errStr = "?", "exit IP: "+r.exitErr.Error()
+		case exit == "":
+			exit = "-"
+		default:
+			if shared[exit]++; shared[exit] == 2 {
+				exits = append(exits, exit)
+			}
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\n", status, r.latency.Round(time.Millisecond), r.proxy, exit, errStr)
+	}
+	tw.Flush()
+	fmt.Fprintf(w, "%d/%d proxies alive\n", alive, len(results))
+	for _, ip := range exits {
+		fmt.Fprintf(w, "exit IP %s is shared by %d proxies\n", ip, shared[ip])
+	}
+	return alive
+}
@@ -2,9 +2,15 @@ package main
 
 import (
 	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/netip"
 	"os"
 	"os/signal"
+	"strings"
 	"syscall"
+	"time"
 
 	"github.com/ogpourya/iploop/pkg/config"
 	"github.com/ogpourya/iploop/pkg/metrics"
@@ -14,46 +20,252 @@ import (
 
 func main() {
 	cfg := config.Parse()
+	if err := cfg.Validate(); err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid configuration:\n%v\n", err)
+		os.Exit(2)
+	}
+	switch {
+	case cfg.Command == config.CmdVersion:
+		fmt.Println(versionString())
+	case cfg.Check:
+		runCheck(cfg)
+	default:
+		serve(cfg)
+	}
+}
 
+// loadProxies builds the rotator and fills it from every configured source,
+// exiting if none yields a proxy.
+func loadProxies(cfg *config.Config) *proxy.Rotator {
+	proxy.DefaultScheme = cfg.DefaultScheme
 	rotator := proxy.NewRotator(cfg.Strategy, cfg.SkipDead, cfg.RequestsPer)
+	rotator.SetMaxPerProxy(cfg.MaxPerProxy)
+	rotator.SetRotateInterval(cfg.RotateInterval)
+	rotator.SetSessionTTL(cfg.SessionTTL)
+	rotator.SetCloseOnDead(cfg.CloseOnDead)
 
 	if cfg.ProxyFile != "" {
-		if err := rotator.LoadFromFile(cfg.ProxyFile); err != nil {
+		added, err := rotator.AddFromFile(cfg.ProxyFile)
+		if err := reportSkipped("proxy file", added, err); err != nil {
 			fmt.Fprintf(os.Stderr, "Error loading proxy file: %v\n", err)
 			os.Exit(1)
 		}
 	}
+	if cfg.ProxyURL != "" {
+		added, err := rotator.AddFromURL(cfg.ProxyURL)
+		if err := reportSkipped("proxy URL", added, err); err != nil {
+			fmt.Fprintf(os.Stderr, "Error loading proxy URL: %v\n", err)
+			os.Exit(1)
+		}
+	}
 	if len(cfg.ProxyList) > 0 {
-		rotator.LoadFromStrings(cfg.ProxyList)
+		added, err := rotator.AddFromStrings(cfg.ProxyList)
+		reportSkipped("-proxies", added, err)
 	}
 
 	if rotator.Count() == 0 {
-		fmt.Fprintln(os.Stderr, "No proxies configured. Use -proxies or -proxy-file")
+		fmt.Fprintln(os.Stderr, "No proxies configured. Use -proxies, -proxy-file or -proxy-url")
 		os.Exit(1)
 	}
+	return rotator
+}
+
+// reportSkipped prints the entries a proxy source skipped, with a warning
+// when they outnumber the proxies it added, and returns the error that
+// kept the rest of the source from loading, if any.
+func reportSkipped(source string, added int, err error) error {
+	skipped, rest := proxy.SkippedLines(err)
+	for _, le := range skipped {
+		fmt.Fprintf(os.Stderr, "Invalid proxy in %s: %v\n", source, le)
+	}
+	if len(skipped) > 0 && len(skipped) >= added {
+		fmt.Fprintf(os.Stderr, "Warning: skipped %d invalid entries in %s but added only %d proxies from it\n", len(skipped), source, added)
+	}
+	return rest
+}
+
+// newDialer builds the upstream dialer and the probe used to test proxies
+// through it.
+func newDialer(cfg *config.Config, logger *slog.Logger) (*server.Dialer, proxy.ProbeFunc) {
+	tlsConfig, err := server.TLSOptions{
+		TrustProxy: cfg.TrustProxy,
+		CertFile:   cfg.TLSCert,
+		KeyFile:    cfg.TLSKey,
+		CAFile:     cfg.TLSCA,
+		MinVersion: cfg.TLSMinVersion,
+		Ciphers:    cfg.TLSCiphers,
+	}.Config()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error loading TLS settings: %v\n", err)
+		os.Exit(1)
+	}
+
+	dialer := server.NewDialer(cfg.TrustProxy, time.Duration(cfg.DialTimeout)*time.Second, logger)
+	dialer.SetResolveMode(cfg.Resolve)
+	if cfg.Resolver != "" {
+		resolver, err := server.NewResolver(cfg.Resolver)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error configuring resolver: %v\n", err)
+			os.Exit(1)
+		}
+		dialer.SetResolver(resolver)
+	}
+	if cfg.DNSCacheSize > 0 && cfg.DNSCacheTTL > 0 {
+		dialer.SetDNSCache(server.NewDNSCache(dialer.Resolver(), cfg.DNSCacheSize, cfg.DNSCacheTTL))
+	}
+	dialer.SetTLSConfig(tlsConfig)
+	dialer.SetKeepAlive(cfg.KeepAlive)
+	dialer.SetFallbackDelay(cfg.FallbackDelay)
+	bindAddr, _ := netip.ParseAddr(cfg.BindAddr) // Checked by Validate; zero if unset
+	dialer.SetBindAddr(bindAddr)
+	dialer.SetHandshakeTimeout(time.Duration(cfg.HandshakeTimeout) * time.Second)
+	dialer.SetForwardClientIP(cfg.ForwardClientIP)
+
+	probe := server.NewTCPProbe(dialer)
+	if cfg.HealthProbe != "" {
+		probe, err = server.NewProbe(dialer, cfg.HealthProbe, cfg.HealthStatus...)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error configuring health probe: %v\n", err)
+			os.Exit(1)
+		}
+	}
+	return dialer, probe
+}
+
+// newExitIPLookup returns the exit IP lookup configured by -exit-ip-url,
+// or nil if there is none.
+func newExitIPLookup(cfg *config.Config, dialer *server.Dialer) *server.ExitIPLookup {
+	if cfg.ExitIPURL == "" {
+		return nil
+	}
+	lookup, err := server.NewExitIPLookup(dialer, cfg.ExitIPURL, cfg.ExitIPTTL)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error configuring exit IP lookup: %v\n", err)
+		os.Exit(1)
+	}
+	return lookup
+}
+
+func serve(cfg *config.Config) {
+	logger := cfg.NewLogger(os.Stderr)
+	rotator := loadProxies(cfg)
+
+	if cfg.StatsFile != "" {
+		if _, err := rotator.LoadStats(cfg.StatsFile); err != nil {
+			fmt.Fprintf(os.Stderr, "Error loading stats file: %v\n", err)
+		}
+	}
 
-	srv := server.NewServer(rotator, cfg.TrustProxy, cfg.RetryDelay, cfg.DialTimeout, cfg.Verbose)
-	if err := srv.Listen(cfg.ListenAddr); err != nil {
+	dialer, probe := newDialer(cfg, logger)
+
+	opts := []server.Option{
+		server.WithLogger(logger),
+		server.WithRetryDelay(time.Duration(cfg.RetryDelay) * time.Millisecond),
+		server.WithRetryPolicy(cfg.MaxRetries, cfg.RetrySeq),
+		server.WithConnectTimeout(time.Duration(cfg.ConnectTimeout) * time.Second),
+		server.WithHandshakeDeadline(time.Duration(cfg.ClientHandshake) * time.Second),
+		server.WithIdleTimeout(time.Duration(cfg.IdleTimeout) * time.Second),
+		server.WithMaxSession(cfg.MaxSession),
+		server.WithKeepAlive(cfg.KeepAlive),
+		server.WithMaxConns(cfg.MaxConns, cfg.RejectWhenFull),
+		server.WithAcceptRate(cfg.AcceptRate),
+		server.WithMaxConnsPerIP(cfg.MaxConnsPerIP),
+		server.WithTransparent(cfg.Transparent),
+		server.WithProxyProtocol(cfg.ProxyProtocol),
+		server.WithHideBindAddr(cfg.HideBindAddr),
+		server.WithStickyTargets(cfg.StickyTargets),
+		server.WithForceRotateOnFail(cfg.RotateOnFail),
+		server.WithSessions(cfg.SessionTTL > 0),
+	}
+	if cfg.InboundUser != "" {
+		opts = append(opts, server.WithCredentials(cfg.InboundUser, cfg.InboundPass))
+	}
+	if len(cfg.Deny) > 0 || len(cfg.Allow) > 0 || cfg.BlockPrivate {
+		filter, err := server.NewTargetFilter(cfg.Deny, cfg.Allow, cfg.BlockPrivate)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error in target filter: %v\n", err)
+			os.Exit(1)
+		}
+		filter.Resolve = cfg.Resolve == server.ResolveLocal
+		filter.Resolver = dialer.Resolver()
+		filter.DNSCache = dialer.DNSCache()
+		opts = append(opts, server.WithTargetFilter(filter))
+	}
+	srv := server.New(rotator, dialer, opts...)
+	if err := srv.Listen(cfg.ListenAddrs...); err != nil {
 		fmt.Fprintf(os.Stderr, "Error starting server: %v\n", err)
 		os.Exit(1)
 	}
 	go srv.Serve()
 
+	fmt.Println(versionString())
 	fmt.Printf("iploop listening on %s with %d proxies (%s rotation)\n",
-		srv.Addr(), rotator.Count(), cfg.Strategy)
+		strings.Join(srv.Addrs(), ", "), rotator.Count(), cfg.Strategy)
+
+	var adminSrv *http.Server
+	if cfg.AdminAddr != "" {
+		ln, err := net.Listen("tcp", cfg.AdminAddr)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error starting admin server: %v\n", err)
+			os.Exit(1)
+		}
+		adminSrv = &http.Server{Handler: metrics.NewAdminHandler(rotator, srv, newExitIPLookup(cfg, dialer), cfg.AdminUser, cfg.AdminPass)}
+		go adminSrv.Serve(ln)
+	}
+
+	var health *proxy.HealthChecker
+	if cfg.HealthInterval > 0 {
+		health = proxy.NewHealthChecker(rotator, time.Duration(cfg.HealthInterval)*time.Second,
+			probeTimeout(cfg), probe)
+		health.Start()
+	}
 
 	var display *metrics.Display
 	if cfg.MetricsEnabled {
-		onAllDead := func() {
-			if cfg.SkipDead {
-				fmt.Print("\033[?25h")
-				fmt.Fprintf(os.Stderr, "\nAll proxies are dead, exiting\n")
-				srv.Close()
-				os.Exit(1)
+		display = metrics.NewDisplay(rotator, srv.Stats(), nil)
+		display.SetDetail(cfg.MetricsDetail)
+		display.Start()
+	}
+	go watchAllDead(cfg, rotator, srv, health, display)
+
+	logReload := func(source string) func(added, removed int, err error) {
+		return func(added, removed int, err error) {
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error reloading %s: %v\n", source, err)
+				return
 			}
+			// Reloads only drop what source itself stopped listing; proxies
+			// from other sources stay whatever it says.
+			fmt.Fprintf(os.Stderr, "Reloaded %s: %d added, %d of its proxies removed, %d total across all sources\n",
+				source, added, removed, rotator.Count())
 		}
-		display = metrics.NewDisplay(rotator, srv.Stats(), onAllDead)
-		display.Start()
+	}
+
+	var watcher *proxy.FileWatcher
+	if cfg.ProxyFile != "" {
+		logFileReload := logReload(cfg.ProxyFile)
+		hupCh := make(chan os.Signal, 1)
+		signal.Notify(hupCh, syscall.SIGHUP)
+		go func() {
+			for range hupCh {
+				logFileReload(rotator.ReloadFromFile(cfg.ProxyFile))
+			}
+		}()
+
+		if cfg.Watch {
+			watcher = proxy.NewFileWatcher(rotator, cfg.ProxyFile, time.Second, logFileReload)
+			watcher.Start()
+		}
+	}
+
+	if cfg.ProxyURL != "" && cfg.ProxyURLInterval > 0 {
+		logURLReload := logReload(cfg.ProxyURL)
+		go func() {
+			ticker := time.NewTicker(time.Duration(cfg.ProxyURLInterval) * time.Second)
+			for range ticker.C {
+				logURLReload(rotator.ReloadFromURL(cfg.ProxyURL))
+			}
+		}()
 	}
 
 	sigCh := make(chan os.Signal, 1)
@@ -63,5 +275,25 @@ func main() {
 	if display != nil {
 		display.Stop()
 	}
+	if health != nil {
+		health.Stop()
+	}
+	if watcher != nil {
+		watcher.Stop()
+	}
+	if adminSrv != nil {
+		adminSrv.Close()
+	}
 	srv.Close()
+	saveStats(cfg, rotator)
+}
+
+// saveStats writes the pool's stats to -stats-file, if set.
+func saveStats(cfg *config.Config, rotator *proxy.Rotator) {
+	if cfg.StatsFile == "" {
+		return
+	}
+	if err := rotator.SaveStats(cfg.StatsFile); err != nil {
+		fmt.Fprintf(os.Stderr, "Error saving stats file: %v\n", err)
+	}
 }
@@ -0,0 +1,20 @@
+package main
+
+import (
+	"fmt"
+	"runtime"
+)
+
+// Build metadata, set with -ldflags, e.g.
+//
+//	go build -ldflags "-X main.version=v1.2.0 -X main.commit=$(git rev-parse --short HEAD) -X main.date=$(date -u +%Y-%m-%d)"
+var (
+	version = "dev"
+	commit  = "none"
+	date    = "unknown"
+)
+
+// versionString describes this build for -version and the startup banner.
+func versionString() string {
+	return fmt.Sprintf("iploop %s (commit %s, built %s, %s)", version, commit, date, runtime.Version())
+}
@@ -3,64 +3,394 @@ package config
 import (
 	"flag"
 	"fmt"
+	"io"
+	"log/slog"
 	"os"
+	"slices"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/ogpourya/iploop/pkg/proxy"
+	"github.com/ogpourya/iploop/pkg/server"
 )
 
 type Config struct {
-	ListenAddr     string
-	ProxyFile      string
-	ProxyList      []string
-	Strategy       proxy.RotationStrategy
-	SkipDead       bool
-	RequestsPer    int // 0 means rotate every request, -1 means 'auto' (don't rotate if alive)
-	TrustProxy     bool
-	RetryDelay     int // Milliseconds to wait between retries
-	DialTimeout    int // Seconds for proxy dial timeout
-	MetricsEnabled bool
-	Verbose        bool
+	Command          string // Subcommand: CmdServe, CmdCheck or CmdVersion
+	ListenAddrs      []string
+	ProxyFile        string
+	Watch            bool // Reload ProxyFile automatically when it changes
+	ProxyURL         string
+	ProxyURLInterval int    // Seconds between refreshes of ProxyURL, 0 disables
+	DefaultScheme    string // Scheme for proxy entries written without one
+	ProxyList        []string
+	Strategy         proxy.RotationStrategy
+	SkipDead         bool
+	OnAllDead        string        // OnAllDeadExit, OnAllDeadWait or OnAllDeadServe
+	StickyTargets    bool          // Send each target host through the same proxy while it is alive
+	RotateOnFail     bool          // Move off the proxies a failed request tried
+	RotateInterval   time.Duration // Stay on each proxy this long instead of counting requests, 0 disables
+	CloseOnDead      bool          // Close a proxy's relayed connections when it is marked dead
+	RequestsPer      int           // 0 means rotate every request, -1 means 'auto' (don't rotate if alive)
+	TrustProxy       bool
+	TLSCert          string // Client certificate for HTTPS proxies requiring mutual TLS
+	TLSKey           string
+	TLSCA            string // CA bundle for verifying HTTPS proxies; implies verification
+	TLSMinVersion    string
+	TLSCiphers       []string
+	RetryDelay       int           // Milliseconds between retries: stagger in race mode, pause in sequential mode
+	MaxRetries       int           // Proxies tried per request
+	RetrySeq         bool          // Try proxies one at a time instead of racing them
+	DialTimeout      int           // Seconds for the TCP connect to a proxy
+	HandshakeTimeout int           // Seconds for a proxy's TLS, auth and tunnel setup after connecting
+	FallbackDelay    time.Duration // Head start for a dual-stack proxy's first address family, negative disables
+	BindAddr         string        // Local IP to dial proxies from, empty lets the system choose
+	ConnectTimeout   int           // Seconds a request may spend reaching its target across all retries
+	ClientHandshake  int           // Seconds a client may take to finish its handshake and send a request
+	IdleTimeout      int           // Seconds without traffic before a relayed connection is closed, 0 disables
+	MaxSession       time.Duration // How long a relayed connection may last, 0 means unlimited
+	KeepAlive        time.Duration // TCP keepalive period for client and proxy connections, negative disables
+	MaxConns         int           // Concurrent connection limit, 0 means unlimited
+	MaxPerProxy      int           // Concurrent connections per proxy, 0 means unlimited
+	RejectWhenFull   bool          // Reject instead of queueing connections over MaxConns
+	AcceptRate       int           // Connections accepted per second, 0 means unlimited
+	MaxConnsPerIP    int           // Concurrent connections per client IP, 0 means unlimited
+	MetricsEnabled   bool
+	MetricsDetail    bool // Show a line per proxy under the status line
+	Verbose          bool
+	Transparent      bool   // Relay iptables-redirected connections to their original destination instead of speaking SOCKS/HTTP
+	ProxyProtocol    bool   // Expect a PROXY protocol header from a load balancer on every connection
+	HideBindAddr     bool   // Reply to SOCKS5 CONNECT with 0.0.0.0:0 instead of our local address
+	InboundUser      string // Require SOCKS5 username/password auth from clients when set
+	InboundPass      string
+	SessionTTL       time.Duration // How long an unused client session keeps its proxy, 0 disables sessions
+	Resolve          server.ResolveMode
+	Resolver         string        // DNS server for local lookups, empty for the system resolver
+	DNSCacheSize     int           // Names kept in the DNS cache, 0 disables it
+	DNSCacheTTL      time.Duration // How long a cached lookup is used
+	Deny             []string      // Target CIDRs, IPs and domains clients may not reach
+	Allow            []string      // If set, the only targets clients may reach
+	BlockPrivate     bool          // Deny loopback, private and link-local targets
+	ForwardClientIP  bool          // Send the client IP to HTTP proxies as X-Forwarded-For
+	HealthInterval   int           // Seconds between health checks of dead proxies, 0 disables
+	HealthProbe      string        // URL to fetch through each proxy when probing; empty means plain TCP connect
+	HealthStatus     []int         // Statuses HealthProbe must return; empty means any 2xx
+	ExitIPURL        string        // IP echo service for looking up proxies' exit IPs, empty disables
+	ExitIPTTL        time.Duration // How long a looked-up exit IP is reused
+	Check            bool          // Probe every proxy once, print a report and exit
+	CheckWorkers     int           // Concurrent probes in Check mode
+	OutputAlive      string        // File Check mode writes working proxies to; implies Check
+	StatsFile        string        // JSON file proxy stats are restored from at startup and saved to on exit
+	AdminAddr        string        // Address for the admin HTTP API (/metrics, /stats), empty disables it
+	AdminUser        string        // Require HTTP basic auth for the admin API's changing routes when set
+	AdminPass        string
+	LogLevel         slog.Level
+	LogJSON          bool
+
+	invalid []error // flag values apply could not convert, reported by Validate
 }
 
+// Subcommands. Running iploop without one means CmdServe.
+const (
+	CmdServe   = "serve"
+	CmdCheck   = "check"
+	CmdVersion = "version"
+)
+
+// Reactions to every proxy being dead, for OnAllDead.
+const (
+	OnAllDeadExit  = "exit"  // Exit with status 1
+	OnAllDeadWait  = "wait"  // Refuse clients until a proxy recovers
+	OnAllDeadServe = "serve" // Keep serving and let requests fail
+)
+
+// flagVars holds flag values that are converted into Config fields after
+// parsing.
+type flagVars struct {
+	listen       string
+	proxyList    string
+	strategy     string
+	requestsPer  string
+	tlsCiphers   string
+	retryMode    string
+	maxConnsMode string
+	logLevel     string
+	logFormat    string
+	deny         string
+	allow        string
+	resolve      string
+	version      bool
+	healthStatus string
+	configFile   string
+}
+
+// Parse reads the subcommand and its flags from the command line. Flags
+// are exit-on-error, as with the flag package's default set.
 func Parse() *Config {
-	cfg := &Config{}
+	return ParseArgs(os.Args[1:])
+}
 
-	flag.StringVar(&cfg.ListenAddr, "listen", ":33333", "Listen address")
-	flag.StringVar(&cfg.ProxyFile, "proxy-file", "", "Path to proxy list file")
-	var proxyList string
-	flag.StringVar(&proxyList, "proxies", "", "Comma-separated proxy list")
-	var strategy string
-	flag.StringVar(&strategy, "strategy", "sequential", "Rotation strategy: random or sequential")
-	flag.BoolVar(&cfg.SkipDead, "skip-dead", false, "Skip dead proxies (default: keep using them)")
-	var requestsPer string
-	flag.StringVar(&requestsPer, "requests-per-proxy", "1", "Number of requests per proxy before rotation (default: 1, 'auto' to stay on same proxy as long as it is alive)")
-	flag.BoolVar(&cfg.TrustProxy, "trust-proxy", true, "Trust HTTPS proxy certificates (skip TLS verification)")
-	flag.IntVar(&cfg.RetryDelay, "retry-delay", 100, "Delay in milliseconds between retries")
-	flag.IntVar(&cfg.DialTimeout, "dial-timeout", 5, "Timeout in seconds for proxy connections")
-	flag.BoolVar(&cfg.MetricsEnabled, "metrics", true, "Enable terminal metrics")
-	flag.BoolVar(&cfg.Verbose, "v", false, "Verbose logging")
+// ParseArgs is Parse for an explicit argument list, without the program
+// name. A first argument that isn't a flag names the subcommand; otherwise
+// it is serve, so "iploop -proxies ..." keeps working. Each subcommand only
+// accepts the flags that apply to it.
+func ParseArgs(args []string) *Config {
+	cmd := CmdServe
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		cmd, args = args[0], args[1:]
+	}
 
-	flag.Parse()
+	cfg := &Config{Command: cmd}
+	v := &flagVars{}
+	fs := flag.NewFlagSet("iploop "+cmd, flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: iploop %s [flags]\n\nCommands: serve (default), check, version\n", cmd)
+		if cmd != CmdVersion {
+			fmt.Fprintf(fs.Output(), "\nFlags:\n")
+			fs.PrintDefaults()
+		}
+	}
 
-	if proxyList != "" {
-		cfg.ProxyList = strings.Split(proxyList, ",")
+	fs.BoolVar(&v.version, "version", false, "Print version and build information and exit")
+
+	switch cmd {
+	case CmdServe:
+		fs.StringVar(&v.configFile, "config", "", "Read settings from this YAML file; command-line flags take precedence")
+		cfg.addSourceFlags(fs, v)
+		cfg.addUpstreamFlags(fs, v)
+		cfg.addServeFlags(fs, v)
+		cfg.addCheckFlags(fs)
+		cfg.addLogFlags(fs, v)
+	case CmdCheck:
+		cfg.Check = true
+		fs.StringVar(&v.configFile, "config", "", "Read settings from this YAML file; command-line flags take precedence")
+		cfg.addSourceFlags(fs, v)
+		cfg.addUpstreamFlags(fs, v)
+		cfg.addCheckFlags(fs)
+		cfg.addLogFlags(fs, v)
+	case CmdVersion:
+	default:
+		fmt.Fprintf(os.Stderr, "unknown command %q\nCommands: serve (default), check, version\n", cmd)
+		os.Exit(2)
 	}
+	fs.Parse(args)
 
-	cfg.Strategy = proxy.ParseRotationStrategy(strategy)
+	if v.configFile != "" {
+		if err := loadFile(fs, v.configFile); err != nil {
+			fmt.Fprintf(os.Stderr, "Error reading config: %v\n", err)
+			os.Exit(2)
+		}
+	}
 
-	if requestsPer == "auto" {
-		cfg.RequestsPer = -1
-	} else {
-		fmt.Sscanf(requestsPer, "%d", &cfg.RequestsPer)
-		if cfg.RequestsPer < 1 {
-			cfg.RequestsPer = 1
+	cfg.apply(v)
+	return cfg
+}
+
+// addSourceFlags registers where proxies come from.
+func (cfg *Config) addSourceFlags(fs *flag.FlagSet, v *flagVars) {
+	fs.StringVar(&cfg.ProxyFile, "proxy-file", "", "Path to proxy list file")
+	fs.StringVar(&cfg.ProxyURL, "proxy-url", "", "URL to fetch the proxy list from (same format as -proxy-file)")
+	fs.StringVar(&cfg.DefaultScheme, "default-scheme", "http", "Proxy type for list entries without a scheme (host:port or host:port:user:pass)")
+	fs.StringVar(&v.proxyList, "proxies", "", "Comma-separated proxy list")
+}
+
+// addUpstreamFlags registers how proxies are dialed and probed.
+func (cfg *Config) addUpstreamFlags(fs *flag.FlagSet, v *flagVars) {
+	fs.BoolVar(&cfg.TrustProxy, "trust-proxy", true, "Trust HTTPS proxy certificates (skip TLS verification)")
+	fs.StringVar(&cfg.TLSCert, "tls-cert", "", "Client certificate (PEM) for HTTPS proxies")
+	fs.StringVar(&cfg.TLSKey, "tls-key", "", "Private key (PEM) for -tls-cert")
+	fs.StringVar(&cfg.TLSCA, "tls-ca", "", "CA bundle (PEM) to verify HTTPS proxies; enables verification regardless of -trust-proxy")
+	fs.StringVar(&cfg.TLSMinVersion, "tls-min-version", "", "Minimum TLS version for HTTPS proxies: 1.0, 1.1, 1.2 or 1.3 (default: Go default)")
+	fs.StringVar(&v.tlsCiphers, "tls-ciphers", "", "Comma-separated allowlist of TLS 1.0-1.2 cipher suites for HTTPS proxies (e.g. TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256)")
+	fs.IntVar(&cfg.DialTimeout, "dial-timeout", 5, "Timeout in seconds for the TCP connect to a proxy")
+	fs.DurationVar(&cfg.FallbackDelay, "fallback-delay", 250*time.Millisecond, "How long to wait on a dual-stack proxy's IPv6 address before also trying IPv4 (0 disables the fallback race)")
+	fs.StringVar(&cfg.BindAddr, "bind-addr", "", "Local IP address to connect to proxies from, on hosts with several interfaces (override per proxy with ?bind=IP)")
+	fs.IntVar(&cfg.HandshakeTimeout, "handshake-timeout", 10, "Timeout in seconds for a proxy to set up the tunnel once connected")
+	fs.StringVar(&cfg.HealthProbe, "health-probe", "", "URL to fetch through each dead proxy when checking health (default: TCP connect to the proxy)")
+	fs.StringVar(&v.healthStatus, "health-probe-status", "", "Comma-separated HTTP statuses -health-probe must return (default: any 2xx)")
+	fs.StringVar(&cfg.ExitIPURL, "exit-ip-url", "", "IP echo service (e.g. https://api.ipify.org) to look up each proxy's exit IP with in check mode and at the admin /exit-ips endpoint")
+	fs.DurationVar(&cfg.ExitIPTTL, "exit-ip-ttl", 10*time.Minute, "How long a looked-up exit IP is reused")
+	fs.StringVar(&v.resolve, "resolve", "remote", "Where to resolve target hostnames: local or remote (by the proxy)")
+	fs.StringVar(&cfg.Resolver, "resolver", "", "DNS server (host:port, or tls://host:port for DNS-over-TLS) for local lookups of targets and proxy hostnames (default: system resolver)")
+	fs.IntVar(&cfg.DNSCacheSize, "dns-cache-size", 1000, "Number of target hostnames to cache local lookups for (0 disables the cache)")
+	fs.DurationVar(&cfg.DNSCacheTTL, "dns-cache-ttl", time.Minute, "How long a cached lookup is reused; names that do not exist are cached for at most 5s")
+}
+
+// addServeFlags registers everything about running the proxy server.
+func (cfg *Config) addServeFlags(fs *flag.FlagSet, v *flagVars) {
+	fs.StringVar(&v.listen, "listen", ":33333", "Comma-separated listen addresses (host:port, or a Unix socket as unix:///path or a file path), each optionally prefixed with user:pass@ for its own inbound auth")
+	fs.BoolVar(&cfg.Watch, "watch", false, "Reload -proxy-file automatically when it changes")
+	fs.IntVar(&cfg.ProxyURLInterval, "proxy-url-interval", 0, "Seconds between refreshes of -proxy-url (0 fetches it once)")
+	fs.StringVar(&v.strategy, "strategy", "sequential", "Rotation strategy: random, sequential, round-robin, weighted or static-weighted")
+	fs.BoolVar(&cfg.StickyTargets, "sticky-target", false, "Send every request for a target host through the same proxy while it is alive (overrides -strategy)")
+	fs.DurationVar(&cfg.RotateInterval, "rotate-interval", 0, "Stay on each proxy for this long (e.g. 30s) however many requests it serves, instead of -requests-per-proxy (0 disables)")
+	fs.BoolVar(&cfg.RotateOnFail, "force-rotate-on-fail", false, "After a failed request, move on from the proxies it tried even if -requests-per-proxy would stay on them")
+	fs.BoolVar(&cfg.SkipDead, "skip-dead", false, "Skip dead proxies (default: keep using them)")
+	fs.BoolVar(&cfg.CloseOnDead, "close-on-dead", false, "Close the connections relayed through a proxy when it is marked dead, so clients fail fast and retry (default: let them finish)")
+	fs.StringVar(&cfg.OnAllDead, "on-all-dead", "", "When every proxy is dead: exit, wait (refuse clients until one recovers) or serve (default: exit with -skip-dead, serve otherwise)")
+	fs.StringVar(&v.requestsPer, "requests-per-proxy", "1", "Number of requests per proxy before rotation: 0 picks afresh on every request with no stickiness, 'auto' stays on the same proxy as long as it is alive")
+	fs.IntVar(&cfg.RetryDelay, "retry-delay", 100, "Delay in milliseconds between retries (race: stagger between attempts, sequential: pause after a failure)")
+	fs.IntVar(&cfg.MaxRetries, "max-retries", 3, "Number of proxies to try per request")
+	fs.StringVar(&v.retryMode, "retry-mode", "race", "How to try proxies: race (staggered concurrent attempts) or sequential")
+	fs.IntVar(&cfg.ConnectTimeout, "connect-timeout", 10, "Overall timeout in seconds for a request to reach its target, across all proxies tried")
+	fs.IntVar(&cfg.ClientHandshake, "handshake-deadline", 10, "Seconds a client may take to finish the SOCKS/HTTP handshake and send its request")
+	fs.IntVar(&cfg.HealthInterval, "health-interval", 30, "Seconds between health checks that revive dead proxies (0 disables)")
+	fs.IntVar(&cfg.IdleTimeout, "idle-timeout", 0, "Seconds without traffic in either direction before a connection is closed (0 disables)")
+	fs.DurationVar(&cfg.MaxSession, "max-session", 0, "Close relayed connections this long (e.g. 10m) after they were set up, however busy, so long-lived clients reconnect through rotation (0 means unlimited)")
+	fs.DurationVar(&cfg.KeepAlive, "keepalive", 60*time.Second, "TCP keepalive period for client and proxy connections (0 disables)")
+	fs.IntVar(&cfg.MaxConns, "max-conns", 0, "Maximum concurrent connections (0 means unlimited)")
+	fs.IntVar(&cfg.MaxPerProxy, "max-per-proxy", 0, "Maximum concurrent connections through each proxy (0 means unlimited, override per proxy with ?max=N)")
+	fs.IntVar(&cfg.MaxConnsPerIP, "max-conns-per-ip", 0, "Maximum concurrent connections from one client IP (0 means unlimited)")
+	fs.IntVar(&cfg.AcceptRate, "accept-rate", 0, "Maximum new connections accepted per second, with bursts of up to a second's worth (0 means unlimited)")
+	fs.StringVar(&v.maxConnsMode, "max-conns-mode", "queue", "When -max-conns is reached: queue (stop accepting) or reject (reply with failure)")
+	fs.BoolVar(&cfg.MetricsEnabled, "metrics", true, "Enable terminal metrics")
+	fs.BoolVar(&cfg.MetricsDetail, "metrics-detail", false, "Show each proxy's success rate, latency and a sparkline of recent latencies under the metrics line")
+	fs.StringVar(&cfg.StatsFile, "stats-file", "", "Restore per-proxy stats from this JSON file at startup and save them on exit")
+	fs.StringVar(&cfg.AdminAddr, "admin-addr", "", "Serve the admin HTTP API (/metrics, /stats) on this address (e.g. :9090)")
+	fs.StringVar(&cfg.AdminAddr, "metrics-addr", "", "Alias for -admin-addr")
+	fs.StringVar(&cfg.AdminUser, "admin-user", "", "Require this username, with HTTP basic auth, to change the pool or reset stats through the admin API")
+	fs.StringVar(&cfg.AdminPass, "admin-pass", "", "Password for -admin-user")
+	fs.StringVar(&cfg.InboundUser, "inbound-user", "", "Require clients to authenticate with this username")
+	fs.StringVar(&cfg.InboundPass, "inbound-pass", "", "Password for -inbound-user")
+	fs.DurationVar(&cfg.SessionTTL, "session-ttl", 10*time.Minute, "How long a session an authenticated client names in its username (user-session-token) keeps its proxy while unused (0 disables sessions)")
+	fs.BoolVar(&cfg.HideBindAddr, "hide-bind-addr", false, "Reply to SOCKS5 CONNECT with 0.0.0.0:0 instead of the local address of the connection to the proxy")
+	fs.BoolVar(&cfg.Transparent, "transparent", false, "Transparent proxy mode for iptables REDIRECT: relay each connection to its original destination (Linux only)")
+	fs.BoolVar(&cfg.ProxyProtocol, "accept-proxy-protocol", false, "Expect a PROXY protocol v1/v2 header on every connection and use the client address it carries (for load balancers)")
+	fs.StringVar(&v.deny, "deny", "", "Comma-separated target CIDRs, IPs and domains (with subdomains) clients may not reach")
+	fs.StringVar(&v.allow, "allow", "", "Comma-separated target CIDRs, IPs and domains; when set, all other targets are refused")
+	fs.BoolVar(&cfg.BlockPrivate, "block-private", false, "Refuse loopback, private and link-local targets")
+	fs.BoolVar(&cfg.ForwardClientIP, "forward-client-ip", false, "Send each client's IP to HTTP/HTTPS proxies in an X-Forwarded-For header on CONNECT")
+	fs.BoolVar(&cfg.Check, "check", false, "Same as the check command: probe every proxy once, print a status table and exit")
+}
+
+// addCheckFlags registers options of the check command.
+func (cfg *Config) addCheckFlags(fs *flag.FlagSet) {
+	fs.IntVar(&cfg.CheckWorkers, "check-workers", 32, "Proxies probed concurrently by check")
+	fs.StringVar(&cfg.OutputAlive, "output-alive", "", "Write the proxies that pass the check to this file, one URL per line with credentials (implies check)")
+}
+
+func (cfg *Config) addLogFlags(fs *flag.FlagSet, v *flagVars) {
+	fs.BoolVar(&cfg.Verbose, "v", false, "Verbose logging (same as -log-level=debug)")
+	fs.StringVar(&v.logLevel, "log-level", "error", "Log level: debug, info, warn or error")
+	fs.StringVar(&v.logFormat, "log-format", "text", "Log format: text or json")
+}
+
+// apply fills in the Config fields derived from flag values and the
+// environment.
+func (cfg *Config) apply(v *flagVars) {
+	if v.version {
+		cfg.Command = CmdVersion
+	}
+
+	if v.listen != "" {
+		cfg.ListenAddrs = strings.Split(v.listen, ",")
+	}
+
+	if cfg.OutputAlive != "" {
+		cfg.Check = true
+	}
+
+	if v.proxyList != "" {
+		cfg.ProxyList = strings.Split(v.proxyList, ",")
+	}
+
+	if v.deny != "" {
+		cfg.Deny = strings.Split(v.deny, ",")
+	}
+	if v.allow != "" {
+		cfg.Allow = strings.Split(v.allow, ",")
+	}
+
+	for _, code := range strings.Split(v.healthStatus, ",") {
+		if code = strings.TrimSpace(code); code == "" {
+			continue
+		}
+		n, err := strconv.Atoi(code)
+		if err != nil || n < 100 || n > 999 {
+			cfg.invalid = append(cfg.invalid, fmt.Errorf("-health-probe-status: invalid status %q", code))
+			continue
+		}
+		cfg.HealthStatus = append(cfg.HealthStatus, n)
+	}
+
+	if v.tlsCiphers != "" {
+		cfg.TLSCiphers = strings.Split(v.tlsCiphers, ",")
+	}
+
+	cfg.Strategy = proxy.ParseRotationStrategy(v.strategy)
+	cfg.Resolve = server.ParseResolveMode(v.resolve)
+	cfg.RejectWhenFull = v.maxConnsMode == "reject"
+	cfg.RetrySeq = v.retryMode == "sequential"
+	cfg.checkChoice("strategy", v.strategy, "random", "sequential", "seq", "round-robin", "roundrobin", "rr", "weighted", "weight", "static-weighted", "static", "wrr")
+	cfg.checkChoice("resolve", v.resolve, "local", "remote")
+	cfg.checkChoice("max-conns-mode", v.maxConnsMode, "queue", "reject")
+	cfg.checkChoice("retry-mode", v.retryMode, "race", "sequential")
+	cfg.checkChoice("on-all-dead", cfg.OnAllDead, OnAllDeadExit, OnAllDeadWait, OnAllDeadServe)
+	if cfg.OnAllDead == "" {
+		cfg.OnAllDead = OnAllDeadServe
+		if cfg.SkipDead {
+			cfg.OnAllDead = OnAllDeadExit
 		}
 	}
+	cfg.checkChoice("log-format", v.logFormat, "text", "json")
+
+	if err := cfg.LogLevel.UnmarshalText([]byte(v.logLevel)); err != nil {
+		cfg.LogLevel = slog.LevelError
+		cfg.checkChoice("log-level", v.logLevel, "debug", "info", "warn", "error")
+	}
+	if cfg.Verbose {
+		cfg.LogLevel = slog.LevelDebug
+	}
+	cfg.LogJSON = v.logFormat == "json"
+
+	cfg.RequestsPer = 1
+	if v.requestsPer == "auto" {
+		cfg.RequestsPer = -1
+	} else if n, err := strconv.Atoi(v.requestsPer); v.requestsPer != "" && (err != nil || n < 0) {
+		cfg.invalid = append(cfg.invalid, fmt.Errorf("-requests-per-proxy: want a number or auto, got %q", v.requestsPer))
+	} else if v.requestsPer != "" {
+		cfg.RequestsPer = n
+	}
+
+	// net uses 0 for its default period and a negative value to disable.
+	if cfg.KeepAlive <= 0 {
+		cfg.KeepAlive = -1
+	}
+	if cfg.FallbackDelay <= 0 {
+		cfg.FallbackDelay = -1
+	}
 
 	if cfg.ProxyFile == "" {
 		cfg.ProxyFile = os.Getenv("IPLOOP_PROXY_FILE")
 	}
 
-	return cfg
+	if cfg.InboundUser == "" {
+		cfg.InboundUser = os.Getenv("IPLOOP_INBOUND_USER")
+	}
+	if cfg.InboundPass == "" {
+		cfg.InboundPass = os.Getenv("IPLOOP_INBOUND_PASS")
+	}
+	if cfg.AdminUser == "" {
+		cfg.AdminUser = os.Getenv("IPLOOP_ADMIN_USER")
+	}
+	if cfg.AdminPass == "" {
+		cfg.AdminPass = os.Getenv("IPLOOP_ADMIN_PASS")
+	}
+}
+
+// checkChoice records an error if a flag's value is not one of choices.
+// Flags the command doesn't have are left empty and pass.
+func (cfg *Config) checkChoice(flag, value string, choices ...string) {
+	if value != "" && !slices.Contains(choices, value) {
+		cfg.invalid = append(cfg.invalid, fmt.Errorf("-%s: unknown value %q", flag, value))
+	}
+}
+
+// NewLogger builds a logger writing to w with the configured level and format.
+func (c *Config) NewLogger(w io.Writer) *slog.Logger {
+	opts := &slog.HandlerOptions{Level: c.LogLevel}
+	if c.LogJSON {
+		return slog.New(slog.NewJSONHandler(w, opts))
+	}
+	return slog.New(slog.NewTextHandler(w, opts))
 }
@@ -0,0 +1,31 @@
+package config
+
+import "testing"
+
+func TestParseRequestsPerProxy(t *testing.T) {
+	t.Setenv("IPLOOP_PROXY_FILE", "")
+	tests := []struct {
+		arg  string
+		want int
+	}{
+		{"", 1},
+		{"0", 0},
+		{"1", 1},
+		{"5", 5},
+		{"auto", -1},
+	}
+	for _, tt := range tests {
+		args := []string{"-proxies", "http://a:1"}
+		if tt.arg != "" {
+			args = append(args, "-requests-per-proxy", tt.arg)
+		}
+		cfg := ParseArgs(args)
+		if err := cfg.Validate(); err != nil {
+			t.Errorf("-requests-per-proxy %q: %v", tt.arg, err)
+			continue
+		}
+		if cfg.RequestsPer != tt.want {
+			t.Errorf("-requests-per-proxy %q = %d, want %d", tt.arg, cfg.RequestsPer, tt.want)
+		}
+	}
+}
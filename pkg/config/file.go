@@ -0,0 +1,150 @@
+package config
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// fileEntry is one setting from a config file.
+type fileEntry struct {
+	key   string
+	value string
+	line  int
+}
+
+// loadFile applies the settings in the config file at path to fs. Keys are
+// flag names; flags already given on the command line keep their values.
+// Keys for another command's flags are skipped, so one file can serve both
+// serve and check. Unknown keys and bad values are reported with their line
+// number.
+func loadFile(fs *flag.FlagSet, path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	entries, err := parseFile(f)
+	if err != nil {
+		return fmt.Errorf("%s:%w", path, err)
+	}
+
+	given := make(map[string]bool)
+	fs.Visit(func(fl *flag.Flag) { given[fl.Name] = true })
+	all := allFlags()
+	for _, e := range entries {
+		if e.key == "config" || all.Lookup(e.key) == nil {
+			return fmt.Errorf("%s:%d: unknown key %q", path, e.line, e.key)
+		}
+		if given[e.key] || fs.Lookup(e.key) == nil {
+			continue
+		}
+		if err := fs.Set(e.key, e.value); err != nil {
+			return fmt.Errorf("%s:%d: invalid value %q for %s: %v", path, e.line, e.value, e.key, err)
+		}
+	}
+	return nil
+}
+
+// allFlags returns a set with the flags of every command, for telling keys
+// that belong elsewhere from typos.
+func allFlags() *flag.FlagSet {
+	cfg, v := &Config{}, &flagVars{}
+	fs := flag.NewFlagSet("all", flag.ContinueOnError)
+	cfg.addSourceFlags(fs, v)
+	cfg.addUpstreamFlags(fs, v)
+	cfg.addServeFlags(fs, v)
+	cfg.addCheckFlags(fs)
+	cfg.addLogFlags(fs, v)
+	return fs
+}
+
+// parseFile reads the YAML subset iploop accepts: "key: value" lines, and
+// lists written as "key:" followed by "- item" lines, which are joined with
+// commas like their flag. Values may be quoted; "#" starts a comment.
+// Errors start with the line number.
+func parseFile(r io.Reader) ([]fileEntry, error) {
+	var entries []fileEntry
+	seen := make(map[string]int)
+	list := -1 // index in entries of the list being filled, if any
+	sc := bufio.NewScanner(r)
+	for n := 1; sc.Scan(); n++ {
+		line := strings.TrimSpace(stripComment(sc.Text()))
+		if line == "" {
+			continue
+		}
+
+		if item, ok := strings.CutPrefix(line, "-"); ok {
+			if list < 0 {
+				return nil, fmt.Errorf("%d: list item outside a list", n)
+			}
+			v, err := unquote(strings.TrimSpace(item))
+			if err != nil {
+				return nil, fmt.Errorf("%d: %v", n, err)
+			}
+			if entries[list].value != "" {
+				entries[list].value += ","
+			}
+			entries[list].value += v
+			continue
+		}
+
+		key, value, ok := strings.Cut(line, ":")
+		key = strings.TrimSpace(key)
+		if !ok || key == "" || strings.ContainsAny(key, " \t") {
+			return nil, fmt.Errorf("%d: expected \"key: value\", got %q", n, line)
+		}
+		if prev, dup := seen[key]; dup {
+			return nil, fmt.Errorf("%d: %q already set on line %d", n, key, prev)
+		}
+		seen[key] = n
+
+		value, err := unquote(strings.TrimSpace(value))
+		if err != nil {
+			return nil, fmt.Errorf("%d: %v", n, err)
+		}
+		entries = append(entries, fileEntry{key: key, value: value, line: n})
+		list = -1
+		if value == "" {
+			list = len(entries) - 1
+		}
+	}
+	return entries, sc.Err()
+}
+
+// stripComment drops a "#" comment that is outside quotes and starts the
+// line or follows a space, so "#" inside URLs and passwords survives.
+func stripComment(line string) string {
+	var quote byte
+	for i := 0; i < len(line); i++ {
+		switch c := line[i]; {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == '#' && (i == 0 || line[i-1] == ' ' || line[i-1] == '\t'):
+			return line[:i]
+		}
+	}
+	return line
+}
+
+func unquote(s string) (string, error) {
+	if len(s) < 2 {
+		return s, nil
+	}
+	switch {
+	case s[0] == '"' && s[len(s)-1] == '"':
+		return strconv.Unquote(s)
+	case s[0] == '\'' && s[len(s)-1] == '\'':
+		return strings.ReplaceAll(s[1:len(s)-1], "''", "'"), nil
+	}
+	return s, nil
+}
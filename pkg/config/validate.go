@@ -0,0 +1,113 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+
+	"github.com/ogpourya/iploop/pkg/server"
+)
+
+// Validate checks the configuration for mistakes that would otherwise only
+// show up later, or not at all: unknown flag values, malformed listen
+// addresses, negative timeouts and limits, and a missing proxy source. All
+// problems are returned together, joined with errors.Join.
+func (cfg *Config) Validate() error {
+	if cfg.Command == CmdVersion {
+		return nil
+	}
+	errs := append([]error(nil), cfg.invalid...)
+
+	if cfg.ProxyFile == "" && cfg.ProxyURL == "" && len(cfg.ProxyList) == 0 {
+		errs = append(errs, errors.New("no proxy source: use -proxies, -proxy-file or -proxy-url"))
+	}
+
+	if cfg.Command == CmdServe && !cfg.Check {
+		if len(cfg.ListenAddrs) == 0 {
+			errs = append(errs, errors.New("-listen: no address given"))
+		}
+		for _, addr := range cfg.ListenAddrs {
+			if err := server.CheckListenAddr(addr); err != nil {
+				errs = append(errs, fmt.Errorf("-listen: %q: %v", addr, err))
+			}
+		}
+	}
+
+	if cfg.BindAddr != "" {
+		if err := checkLocalAddr(cfg.BindAddr); err != nil {
+			errs = append(errs, fmt.Errorf("-bind-addr: %v", err))
+		}
+	}
+	if cfg.Resolver != "" {
+		if _, err := server.NewResolver(cfg.Resolver); err != nil {
+			errs = append(errs, fmt.Errorf("-resolver: %v", err))
+		}
+	}
+
+	for _, f := range []struct {
+		name  string
+		value int
+	}{
+		{"dial-timeout", cfg.DialTimeout},
+		{"handshake-timeout", cfg.HandshakeTimeout},
+		{"connect-timeout", cfg.ConnectTimeout},
+		{"handshake-deadline", cfg.ClientHandshake},
+		{"idle-timeout", cfg.IdleTimeout},
+		{"health-interval", cfg.HealthInterval},
+		{"proxy-url-interval", cfg.ProxyURLInterval},
+		{"retry-delay", cfg.RetryDelay},
+		{"max-conns", cfg.MaxConns},
+		{"accept-rate", cfg.AcceptRate},
+		{"max-conns-per-ip", cfg.MaxConnsPerIP},
+		{"max-per-proxy", cfg.MaxPerProxy},
+		{"dns-cache-size", cfg.DNSCacheSize},
+	} {
+		if f.value < 0 {
+			errs = append(errs, fmt.Errorf("-%s: must not be negative, got %d", f.name, f.value))
+		}
+	}
+	if cfg.Command == CmdServe && cfg.OnAllDead == OnAllDeadWait && cfg.HealthInterval == 0 {
+		errs = append(errs, errors.New("-on-all-dead wait: needs health checks to notice recovery, but -health-interval is 0"))
+	}
+	if cfg.ExitIPTTL < 0 {
+		errs = append(errs, fmt.Errorf("-exit-ip-ttl: must not be negative, got %s", cfg.ExitIPTTL))
+	}
+	if cfg.RotateInterval < 0 {
+		errs = append(errs, fmt.Errorf("-rotate-interval: must not be negative, got %s", cfg.RotateInterval))
+	}
+	if cfg.MaxSession < 0 {
+		errs = append(errs, fmt.Errorf("-max-session: must not be negative, got %s", cfg.MaxSession))
+	}
+	if cfg.SessionTTL < 0 {
+		errs = append(errs, fmt.Errorf("-session-ttl: must not be negative, got %s", cfg.SessionTTL))
+	}
+	if cfg.DNSCacheTTL < 0 {
+		errs = append(errs, fmt.Errorf("-dns-cache-ttl: must not be negative, got %s", cfg.DNSCacheTTL))
+	}
+	if cfg.Command == CmdServe && cfg.MaxRetries < 1 {
+		errs = append(errs, fmt.Errorf("-max-retries: must be at least 1, got %d", cfg.MaxRetries))
+	}
+	if len(cfg.HealthStatus) > 0 && cfg.HealthProbe == "" {
+		errs = append(errs, errors.New("-health-probe-status: needs -health-probe"))
+	}
+	if cfg.Check && cfg.CheckWorkers < 1 {
+		errs = append(errs, fmt.Errorf("-check-workers: must be at least 1, got %d", cfg.CheckWorkers))
+	}
+
+	return errors.Join(errs...)
+}
+
+// checkLocalAddr checks that s is an IP address this host can send from,
+// by binding a socket to it.
+func checkLocalAddr(s string) error {
+	ip, err := netip.ParseAddr(s)
+	if err != nil {
+		return fmt.Errorf("want an IP address, got %q", s)
+	}
+	l, err := net.ListenTCP("tcp", net.TCPAddrFromAddrPort(netip.AddrPortFrom(ip, 0)))
+	if err != nil {
+		return fmt.Errorf("%s is not an address of this host", ip)
+	}
+	return l.Close()
+}
@@ -0,0 +1,58 @@
+package config
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestValidate(t *testing.T) {
+	t.Setenv("IPLOOP_PROXY_FILE", "")
+	tests := []struct {
+		args []string
+		want []string // Substrings of the error, one per expected problem
+	}{
+		{[]string{"-proxies", "http://a:1"}, nil},
+		{[]string{"check", "-proxies", "http://a:1"}, nil},
+		{[]string{"version"}, nil},
+		{[]string{}, []string{"no proxy source"}},
+		{[]string{"-proxies", "http://a:1", "-listen", "nohost"}, []string{`-listen: "nohost"`}},
+		{[]string{"-proxies", "http://a:1", "-listen", "127.0.0.1:http,127.0.0.1:99999x"}, []string{`-listen: "127.0.0.1:99999x"`}},
+		{[]string{"-proxies", "http://a:1", "-strategy", "fastest"}, []string{`-strategy: unknown value "fastest"`}},
+		{[]string{"-proxies", "http://a:1", "-resolve", "both"}, []string{`-resolve: unknown value "both"`}},
+		{[]string{"-proxies", "http://a:1", "-requests-per-proxy", "lots"}, []string{"-requests-per-proxy: want a number or auto"}},
+		{[]string{"-proxies", "http://a:1", "-requests-per-proxy", "-2"}, []string{"-requests-per-proxy: want a number or auto"}},
+		{[]string{"-proxies", "http://a:1", "-dial-timeout", "-1"}, []string{"-dial-timeout: must not be negative"}},
+		{[]string{"-proxies", "http://a:1", "-max-session", "-1s"}, []string{"-max-session: must not be negative"}},
+		{[]string{"-proxies", "http://a:1", "-max-retries", "0"}, []string{"-max-retries: must be at least 1"}},
+		{[]string{"-proxies", "http://a:1", "-health-probe-status", "200,abc"}, []string{`-health-probe-status: invalid status "abc"`, "needs -health-probe"}},
+		{[]string{"-proxies", "http://a:1", "-bind-addr", "eth0"}, []string{"-bind-addr: want an IP address"}},
+		{[]string{"-proxies", "http://a:1", "-bind-addr", "192.0.2.77"}, []string{"-bind-addr: 192.0.2.77 is not an address of this host"}},
+		{[]string{"-proxies", "http://a:1", "-on-all-dead", "wait", "-health-interval", "0"}, []string{"-on-all-dead wait: needs health checks"}},
+		{
+			[]string{"-listen", "bad", "-strategy", "x", "-idle-timeout", "-5", "-accept-rate", "-1"},
+			[]string{"no proxy source", `-listen: "bad"`, `-strategy: unknown value "x"`, "-idle-timeout: must not be negative", "-accept-rate: must not be negative"},
+		},
+	}
+	for _, tt := range tests {
+		err := ParseArgs(tt.args).Validate()
+		if len(tt.want) == 0 {
+			if err != nil {
+				t.Errorf("%q: unexpected error: %v", tt.args, err)
+			}
+			continue
+		}
+		if err == nil {
+			t.Errorf("%q: no error, want %q", tt.args, tt.want)
+			continue
+		}
+		lines := strings.Split(err.Error(), "\n")
+		if len(lines) != len(tt.want) {
+			t.Errorf("%q: got %d problems, want %d:\n%v", tt.args, len(lines), len(tt.want), err)
+		}
+		for _, w := range tt.want {
+			if !strings.Contains(err.Error(), w) {
+				t.Errorf("%q: error %q does not mention %q", tt.args, err, w)
+			}
+		}
+	}
+}
@@ -0,0 +1,52 @@
+package metrics
+
+import (
+	"crypto/subtle"
+	"net/http"
+
+	"github.com/ogpourya/iploop/pkg/proxy"
+	"github.com/ogpourya/iploop/pkg/server"
+)
+
+// NewAdminHandler returns the admin HTTP API: Prometheus metrics at
+// /metrics, a JSON snapshot at /stats, liveness/readiness probes at
+// /healthz and /readyz, pool management under /proxies and POST /reset to
+// zero the counters. If exitIPs is not nil, GET /exit-ips looks up every
+// proxy's public address.
+//
+// If user is not empty, the routes that change state (adding and removing
+// proxies, resetting counters) require HTTP basic auth with user and pass.
+// The read-only routes stay open for scrapers and probes.
+func NewAdminHandler(rotator *proxy.Rotator, srv *server.Server, exitIPs *server.ExitIPLookup, user, pass string) http.Handler {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", NewExporter(rotator, srv.Stats()))
+	mux.Handle("/stats", NewStatsHandler(rotator, srv.Stats()))
+	mux.Handle("/healthz", healthzHandler(rotator))
+	mux.Handle("/readyz", readyzHandler(rotator, srv))
+	mux.Handle("GET /proxies", listProxiesHandler(rotator))
+	mux.Handle("POST /proxies", requireAuth(user, pass, addProxiesHandler(rotator)))
+	mux.Handle("DELETE /proxies/{id...}", requireAuth(user, pass, removeProxyHandler(rotator)))
+	mux.Handle("POST /reset", requireAuth(user, pass, resetHandler(rotator, srv.Stats())))
+	if exitIPs != nil {
+		mux.Handle("GET /exit-ips", exitIPsHandler(rotator, exitIPs))
+	}
+	return mux
+}
+
+// requireAuth wraps h to answer 401 unless the request carries HTTP basic
+// auth with user and pass. An empty user leaves h open.
+func requireAuth(user, pass string, h http.Handler) http.Handler {
+	if user == "" {
+		return h
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		u, p, _ := r.BasicAuth()
+		passOK := subtle.ConstantTimeCompare([]byte(p), []byte(pass))
+		if subtle.ConstantTimeCompare([]byte(u), []byte(user))&passOK != 1 {
+			w.Header().Set("WWW-Authenticate", `Basic realm="iploop admin"`)
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
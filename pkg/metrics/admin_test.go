@@ -0,0 +1,41 @@
+package metrics
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRequireAuth(t *testing.T) {
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+	tests := []struct {
+		name       string
+		user, pass string // Configured; empty user means no auth
+		auth       bool   // Whether the request sends credentials
+		reqUser    string
+		reqPass    string
+		want       int
+	}{
+		{"open", "", "", false, "", "", http.StatusOK},
+		{"missing", "admin", "secret", false, "", "", http.StatusUnauthorized},
+		{"wrong pass", "admin", "secret", true, "admin", "nope", http.StatusUnauthorized},
+		{"wrong user", "admin", "secret", true, "root", "secret", http.StatusUnauthorized},
+		{"right", "admin", "secret", true, "admin", "secret", http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, "/reset", nil)
+			if tt.auth {
+				req.SetBasicAuth(tt.reqUser, tt.reqPass)
+			}
+			w := httptest.NewRecorder()
+			requireAuth(tt.user, tt.pass, ok).ServeHTTP(w, req)
+			if w.Code != tt.want {
+				t.Errorf("status = %d, want %d", w.Code, tt.want)
+			}
+			if w.Code == http.StatusUnauthorized && w.Header().Get("WWW-Authenticate") == "" {
+				t.Error("401 without a WWW-Authenticate challenge")
+			}
+		})
+	}
+}
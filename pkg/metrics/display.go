@@ -3,9 +3,13 @@ package metrics
 import (
 	"fmt"
 	"os"
+	"slices"
+	"strconv"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
+	"unicode/utf8"
 
 	"github.com/ogpourya/iploop/pkg/proxy"
 	"github.com/ogpourya/iploop/pkg/server"
@@ -16,9 +20,12 @@ type Display struct {
 	stats     *server.Stats
 	enabled   atomic.Bool
 	stop      chan struct{}
+	done      chan struct{} // Closed once run has restored the terminal
 	once      sync.Once
 	onDead    func()
 	deadFired atomic.Bool
+	detail    bool
+	drawn     int // Lines below the status line left by the last redraw
 }
 
 func NewDisplay(rotator *proxy.Rotator, stats *server.Stats, onAllDead func()) *Display {
@@ -30,52 +37,256 @@ func NewDisplay(rotator *proxy.Rotator, stats *server.Stats, onAllDead func()) *
 	}
 }
 
+// SetDetail adds a line per proxy under the status line, with its success
+// rate, average latency and a sparkline of recent latencies. It must be
+// called before Start.
+func (d *Display) SetDetail(detail bool) {
+	d.detail = detail
+}
+
 func (d *Display) Start() {
 	d.enabled.Store(true)
+	d.done = make(chan struct{})
 	go d.run()
 }
 
+// Stop stops redrawing and, on a terminal, waits for the cursor to be
+// shown again, so it is safe to call right before os.Exit. It must not be
+// called from the onAllDead callback, which runs on the redraw goroutine.
 func (d *Display) Stop() {
 	d.once.Do(func() {
 		d.enabled.Store(false)
 		close(d.stop)
 	})
+	if d.done != nil {
+		<-d.done
+	}
 }
 
+// plainInterval is how often a summary line is printed when stdout is not
+// a terminal.
+const plainInterval = 5 * time.Second
+
+// run redraws one status line in place on a terminal. When stdout is a
+// file or pipe, such as under systemd, it prints a plain summary line every
+// plainInterval instead, without escape sequences.
 func (d *Display) run() {
-	ticker := time.NewTicker(100 * time.Millisecond)
+	defer close(d.done)
+	tty := isTerminal(os.Stdout)
+	interval := 100 * time.Millisecond
+	if !tty {
+		interval = plainInterval
+	}
+	ticker := time.NewTicker(interval)
 	defer ticker.Stop()
 
-	fmt.Print("\033[?25l")
-	defer fmt.Print("\033[?25h\n")
+	if tty {
+		fmt.Print("\033[?25l")
+		defer fmt.Print("\033[?25h\n")
+	}
 
 	for {
 		select {
 		case <-d.stop:
 			return
 		case <-ticker.C:
-			if d.enabled.Load() {
-				d.render()
+			if !d.enabled.Load() {
+				continue
+			}
+			proxies := d.rotator.Snapshot()
+			fields := d.fields(proxies)
+			if fields == nil {
+				continue
 			}
+			var details []string
+			if d.detail {
+				details = detailLines(proxies)
+			}
+			if tty {
+				d.redraw(fitFields(fields, displayWidth()), details)
+				continue
+			}
+			var b strings.Builder
+			b.WriteString(time.Now().Format(time.DateTime) + " " + strings.Join(fields, " ") + "\n")
+			for _, line := range details {
+				b.WriteString(line + "\n")
+			}
+			os.Stdout.WriteString(b.String())
 		}
 	}
 }
 
-func (d *Display) render() {
+// redraw overwrites the previous status and detail lines in place.
+func (d *Display) redraw(status string, details []string) {
+	width := displayWidth()
+	var b strings.Builder
+	b.WriteString("\r")
+	if d.drawn > 0 {
+		fmt.Fprintf(&b, "\033[%dA", d.drawn)
+	}
+	b.WriteString("\033[K" + status)
+	for _, line := range details {
+		b.WriteString("\n\033[K" + truncate(line, width-1))
+	}
+	b.WriteString("\033[J")
+	d.drawn = len(details)
+	os.Stdout.WriteString(b.String())
+}
+
+// fields returns the status line's fields, or nil if the all-dead callback
+// fired instead.
+func (d *Display) fields(proxies []proxy.ProxyStats) []string {
 	total := d.stats.TotalRequests.Load()
 	success := d.stats.SuccessRequests.Load()
 	failed := d.stats.FailedRequests.Load()
 	active := d.stats.ActiveConns.Load()
-	alive := d.rotator.AliveCount()
-	totalProxies := d.rotator.Count()
+	alive := 0
+	exits := make(map[string]bool)
+	for _, p := range proxies {
+		if p.Alive {
+			alive++
+		}
+		if p.ExitIP != "" {
+			exits[p.ExitIP] = true
+		}
+	}
+	totalProxies := len(proxies)
 
 	if alive == 0 && totalProxies > 0 && d.onDead != nil && !d.deadFired.Swap(true) {
 		d.onDead()
-		return
+		return nil
+	}
+
+	activeStr := fmt.Sprint(active)
+	if limit := d.stats.MaxConns.Load(); limit > 0 {
+		activeStr = fmt.Sprintf("%d/%d", active, limit)
+	}
+
+	// Most important first: fields that don't fit the terminal are dropped
+	// from the end, since a wrapped line breaks the in-place redraw.
+	fields := []string{
+		"[iploop]",
+		fmt.Sprintf("reqs:%d", total),
+		fmt.Sprintf("ok:%d", success),
+		fmt.Sprintf("fail:%d", failed),
+		"active:" + activeStr,
+		fmt.Sprintf("proxies:%d/%d", alive, totalProxies),
+		"up:" + formatBytes(d.stats.BytesUp.Load()),
+		"down:" + formatBytes(d.stats.BytesDown.Load()),
+	}
+	if len(exits) > 0 {
+		fields = append(fields, fmt.Sprintf("exits:%d", len(exits)))
+	}
+	return fields
+}
+
+// maxDetailRows caps the per-proxy lines so a large pool doesn't scroll
+// the display off the screen.
+const maxDetailRows = 20
+
+// detailLines describes each proxy: state, success rate, average latency,
+// a sparkline of recent latencies and the proxy, last so a narrow terminal
+// cuts it rather than the numbers.
+func detailLines(proxies []proxy.ProxyStats) []string {
+	lines := make([]string, 0, min(len(proxies), maxDetailRows)+1)
+	for i, p := range proxies {
+		if i == maxDetailRows {
+			lines = append(lines, fmt.Sprintf("  ... and %d more", len(proxies)-i))
+			break
+		}
+		state := "up"
+		if !p.Alive {
+			state = "dead"
+		}
+		rate := "-"
+		if n := p.Requests + p.Failures; n > 0 {
+			rate = fmt.Sprintf("%.1f%%", float64(p.Requests)*100/float64(n))
+		}
+		lines = append(lines, fmt.Sprintf("  %-4s %6s %7s %-16s %s",
+			state, rate, p.AvgLatency.Round(time.Millisecond), sparkline(p.Recent), p.Proxy))
+	}
+	return lines
+}
+
+var sparkBars = []rune("▁▂▃▄▅▆▇█")
+
+// sparkline draws samples as bars scaled between their minimum and maximum.
+func sparkline(samples []time.Duration) string {
+	if len(samples) == 0 {
+		return ""
+	}
+	lo, hi := slices.Min(samples), slices.Max(samples)
+	out := make([]rune, len(samples))
+	for i, s := range samples {
+		level := 0
+		if hi > lo {
+			level = int((s - lo) * time.Duration(len(sparkBars)-1) / (hi - lo))
+		}
+		out[i] = sparkBars[level]
+	}
+	return string(out)
+}
+
+// truncate shortens s to at most width runes.
+func truncate(s string, width int) string {
+	if width < 1 || utf8.RuneCountInString(s) <= width {
+		return s
+	}
+	return string([]rune(s)[:width])
+}
+
+// isTerminal reports whether f is a character device, i.e. a terminal
+// rather than a file or pipe.
+func isTerminal(f *os.File) bool {
+	fi, err := f.Stat()
+	return err == nil && fi.Mode()&os.ModeCharDevice != 0
+}
+
+// displayWidth returns the width of the terminal on stdout, then $COLUMNS,
+// then 80.
+func displayWidth() int {
+	if w := terminalWidth(os.Stdout); w > 0 {
+		return w
 	}
+	if w, err := strconv.Atoi(os.Getenv("COLUMNS")); err == nil && w > 0 {
+		return w
+	}
+	return 80
+}
 
-	line := fmt.Sprintf("\r\033[K[iploop] reqs:%d ok:%d fail:%d active:%d proxies:%d/%d",
-		total, success, failed, active, alive, totalProxies)
+// fitFields joins fields with spaces, leaving out trailing fields that
+// would take the line to width columns or more; the last column is kept
+// free so the cursor doesn't wrap. The first field is always kept.
+func fitFields(fields []string, width int) string {
+	var b strings.Builder
+	cols := 0
+	for i, f := range fields {
+		n := utf8.RuneCountInString(f)
+		if i > 0 {
+			n++
+		}
+		if i > 0 && cols+n >= width {
+			break
+		}
+		if i > 0 {
+			b.WriteByte(' ')
+		}
+		b.WriteString(f)
+		cols += n
+	}
+	return b.String()
+}
 
-	os.Stdout.WriteString(line)
+// formatBytes renders n with a binary unit, e.g. "1.5MiB".
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%dB", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f%ciB", float64(n)/float64(div), "KMGTPE"[exp])
 }
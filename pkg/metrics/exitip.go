@@ -0,0 +1,55 @@
+package metrics
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/ogpourya/iploop/pkg/proxy"
+	"github.com/ogpourya/iploop/pkg/server"
+)
+
+const (
+	// exitIPWorkers bounds concurrent lookups for GET /exit-ips.
+	exitIPWorkers = 16
+	// exitIPTimeout bounds a whole GET /exit-ips request.
+	exitIPTimeout = 30 * time.Second
+)
+
+// exitIPsHandler looks up the exit IP of every proxy, reusing results the
+// lookup still has cached, and writes one "proxy ip" line per proxy, with
+// the error in place of the IP for proxies that failed.
+func exitIPsHandler(rotator *proxy.Rotator, lookup *server.ExitIPLookup) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := context.WithTimeout(r.Context(), exitIPTimeout)
+		defer cancel()
+
+		proxies := rotator.GetProxies()
+		lines := make([]string, len(proxies))
+		sem := make(chan struct{}, exitIPWorkers)
+		var wg sync.WaitGroup
+		for i, p := range proxies {
+			sem <- struct{}{}
+			wg.Add(1)
+			go func() {
+				defer func() {
+					<-sem
+					wg.Done()
+				}()
+				ip, err := lookup.Lookup(ctx, p)
+				if err != nil {
+					ip = "error: " + err.Error()
+				}
+				lines[i] = fmt.Sprintf("%s %s", p, ip)
+			}()
+		}
+		wg.Wait()
+
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		for _, line := range lines {
+			fmt.Fprintln(w, line)
+		}
+	}
+}
@@ -0,0 +1,34 @@
+package metrics
+
+import (
+	"net/http"
+
+	"github.com/ogpourya/iploop/pkg/proxy"
+	"github.com/ogpourya/iploop/pkg/server"
+)
+
+// healthzHandler reports 200 while at least one proxy is alive.
+func healthzHandler(rotator *proxy.Rotator) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if rotator.AliveCount() == 0 {
+			http.Error(w, "no alive proxies", http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte("ok\n"))
+	}
+}
+
+// readyzHandler additionally requires the SOCKS listener to be up.
+func readyzHandler(rotator *proxy.Rotator, srv *server.Server) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !srv.Ready() {
+			http.Error(w, "listener not ready", http.StatusServiceUnavailable)
+			return
+		}
+		if rotator.AliveCount() == 0 {
+			http.Error(w, "no alive proxies", http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte("ok\n"))
+	}
+}
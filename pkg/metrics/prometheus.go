@@ -0,0 +1,99 @@
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/ogpourya/iploop/pkg/proxy"
+	"github.com/ogpourya/iploop/pkg/server"
+)
+
+// Exporter serves server and per-proxy counters in the Prometheus text
+// exposition format.
+type Exporter struct {
+	rotator *proxy.Rotator
+	stats   *server.Stats
+}
+
+func NewExporter(rotator *proxy.Rotator, stats *server.Stats) *Exporter {
+	return &Exporter{
+		rotator: rotator,
+		stats:   stats,
+	}
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func (e *Exporter) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	bw := bufio.NewWriter(w)
+	defer bw.Flush()
+
+	writeMetric(bw, "iploop_requests_total", "counter", "Total SOCKS requests handled.", e.stats.TotalRequests.Load())
+	writeMetric(bw, "iploop_requests_success_total", "counter", "Requests that reached their target.", e.stats.SuccessRequests.Load())
+	writeMetric(bw, "iploop_requests_failed_total", "counter", "Requests that failed to reach their target.", e.stats.FailedRequests.Load())
+	writeMetric(bw, "iploop_active_connections", "gauge", "Currently open client connections.", e.stats.ActiveConns.Load())
+	writeMetric(bw, "iploop_max_connections", "gauge", "Configured connection limit, 0 if unlimited.", e.stats.MaxConns.Load())
+	writeMetric(bw, "iploop_rejected_connections_total", "counter", "Connections rejected because the limit was reached.", e.stats.RejectedConns.Load())
+	writeMetric(bw, "iploop_bytes_up_total", "counter", "Bytes relayed from clients to targets.", e.stats.BytesUp.Load())
+	writeMetric(bw, "iploop_bytes_down_total", "counter", "Bytes relayed from targets to clients.", e.stats.BytesDown.Load())
+	writeMetric(bw, "iploop_dial_attempts_total", "counter", "Dials through a proxy, including retries.", e.stats.DialAttempts.Load())
+	writeMetric(bw, "iploop_fallbacks_total", "counter", "Requests served by a proxy other than their first choice.", e.stats.Fallbacks.Load())
+	writeMetric(bw, "iploop_raced_requests_total", "counter", "Requests that had more than one proxy dial in flight at once.", e.stats.RacedRequests.Load())
+	writeMetric(bw, "iploop_relay_failures_total", "counter", "Connections cut off by an upstream error after connecting.", e.stats.RelayFailures.Load())
+
+	proxies := e.rotator.Snapshot()
+	writeProxyMetrics(bw, proxies, "iploop_proxy_requests_total", "counter", "Successful requests per proxy.",
+		func(p proxy.ProxyStats) string {
+			return fmt.Sprint(p.Requests)
+		})
+	writeProxyMetrics(bw, proxies, "iploop_proxy_failures_total", "counter", "Failed requests per proxy.",
+		func(p proxy.ProxyStats) string {
+			return fmt.Sprint(p.Failures)
+		})
+	writeProxyMetrics(bw, proxies, "iploop_proxy_latency_avg_seconds", "gauge", "Average connect latency per proxy.",
+		func(p proxy.ProxyStats) string {
+			return fmt.Sprint(p.AvgLatency.Seconds())
+		})
+	fmt.Fprintf(bw, "# HELP iploop_proxy_latency_seconds Connect latency percentiles per proxy, estimated from a histogram.\n# TYPE iploop_proxy_latency_seconds summary\n")
+	for _, p := range proxies {
+		name := labelEscaper.Replace(p.Proxy)
+		for _, q := range []struct {
+			label string
+			value time.Duration
+		}{{"0.5", p.P50}, {"0.9", p.P90}, {"0.99", p.P99}} {
+			fmt.Fprintf(bw, "iploop_proxy_latency_seconds{proxy=\"%s\",quantile=\"%s\"} %g\n", name, q.label, q.value.Seconds())
+		}
+		fmt.Fprintf(bw, "iploop_proxy_latency_seconds_sum{proxy=\"%s\"} %g\n", name, (time.Duration(p.Requests) * p.AvgLatency).Seconds())
+		fmt.Fprintf(bw, "iploop_proxy_latency_seconds_count{proxy=\"%s\"} %d\n", name, p.Requests)
+	}
+	writeProxyMetrics(bw, proxies, "iploop_proxy_bytes_up_total", "counter", "Bytes relayed from clients to targets per proxy.",
+		func(p proxy.ProxyStats) string {
+			return fmt.Sprint(p.BytesUp)
+		})
+	writeProxyMetrics(bw, proxies, "iploop_proxy_bytes_down_total", "counter", "Bytes relayed from targets to clients per proxy.",
+		func(p proxy.ProxyStats) string {
+			return fmt.Sprint(p.BytesDown)
+		})
+	writeProxyMetrics(bw, proxies, "iploop_proxy_alive", "gauge", "Whether the proxy is considered alive (1) or dead (0).",
+		func(p proxy.ProxyStats) string {
+			if p.Alive {
+				return "1"
+			}
+			return "0"
+		})
+}
+
+func writeMetric(w *bufio.Writer, name, typ, help string, value int64) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n%s %d\n", name, help, name, typ, name, value)
+}
+
+func writeProxyMetrics(w *bufio.Writer, proxies []proxy.ProxyStats, name, typ, help string, value func(proxy.ProxyStats) string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+	for _, p := range proxies {
+		fmt.Fprintf(w, "%s{proxy=\"%s\"} %s\n", name, labelEscaper.Replace(p.Proxy), value(p))
+	}
+}
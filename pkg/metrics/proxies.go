@@ -0,0 +1,61 @@
+package metrics
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/ogpourya/iploop/pkg/proxy"
+)
+
+// maxProxiesBody bounds the size of a POST /proxies request.
+const maxProxiesBody = 1 << 20
+
+// listProxiesHandler writes the pool, one proxy per line, in the form
+// DELETE /proxies/{id} expects.
+func listProxiesHandler(rotator *proxy.Rotator) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		for _, p := range rotator.GetProxies() {
+			fmt.Fprintln(w, p.String())
+		}
+	}
+}
+
+// addProxiesHandler adds the proxies in the request body, which is read
+// like a proxy file: one per line, with key=value options and '#'
+// comments. Nothing is added if any line is invalid. The proxies are not
+// tied to the proxy file or URL, so reloading those leaves them in place.
+func addProxiesHandler(rotator *proxy.Rotator) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		proxies, err := proxy.ParseProxyList(http.MaxBytesReader(w, r.Body, maxProxiesBody))
+		if err != nil {
+			http.Error(w, fmt.Sprintf("invalid proxy list: %v", err), http.StatusBadRequest)
+			return
+		}
+		if len(proxies) == 0 {
+			http.Error(w, "no proxies in request body", http.StatusBadRequest)
+			return
+		}
+
+		added := 0
+		for _, p := range proxies {
+			if rotator.AddProxy(p) {
+				added++
+			}
+		}
+		w.WriteHeader(http.StatusCreated)
+		fmt.Fprintf(w, "added %d, %d total\n", added, rotator.Count())
+	}
+}
+
+// removeProxyHandler removes the proxy named by the path, which is a proxy
+// URL or its String() form. URL-escape it so the slashes survive.
+func removeProxyHandler(rotator *proxy.Rotator) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !rotator.RemoveProxy(r.PathValue("id")) {
+			http.Error(w, "proxy not found", http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
@@ -0,0 +1,65 @@
+package metrics
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/ogpourya/iploop/pkg/proxy"
+)
+
+func TestAddProxiesHandler(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "proxies.txt")
+	if err := os.WriteFile(path, []byte("http://file:1\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	rotator := proxy.NewRotator(proxy.RotationSequential, false, 0)
+	if _, err := rotator.AddFromFile(path); err != nil {
+		t.Fatal(err)
+	}
+	post := func(body string) int {
+		t.Helper()
+		w := httptest.NewRecorder()
+		addProxiesHandler(rotator).ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/proxies", strings.NewReader(body)))
+		return w.Code
+	}
+
+	// A bad line rejects the whole body.
+	if code := post("socks5://10.0.0.5:1080\nnot a proxy\n"); code != http.StatusBadRequest {
+		t.Errorf("body with an invalid line got %d, want 400", code)
+	}
+	if n := rotator.Count(); n != 1 {
+		t.Errorf("pool has %d proxies after a rejected body, want 1", n)
+	}
+
+	// Lines read as in the proxy file: options, comments and '#' in a
+	// password.
+	body := "# spares\nsocks5://10.0.0.5:1080 region=us weight=3  # east\n10.0.0.6:8080:u:p#1\n"
+	if code := post(body); code != http.StatusCreated {
+		t.Fatalf("POST got %d, want 201", code)
+	}
+	got := make(map[string]*proxy.Proxy)
+	for _, p := range rotator.GetProxies() {
+		got[p.Address()] = p
+	}
+	if p := got["10.0.0.5:1080"]; p == nil || p.Tag != "us" || p.Weight != 3 {
+		t.Errorf("tagged line added %v, want tag us and weight 3", p)
+	}
+	if p := got["10.0.0.6:8080"]; p == nil || p.Password != "p#1" {
+		t.Errorf("host:port:user:pass line added %v, want password p#1", p)
+	}
+
+	// Reloading the file, even emptied, leaves the added proxies alone.
+	if err := os.WriteFile(path, nil, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, removed, err := rotator.ReloadFromFile(path); err != nil || removed != 1 {
+		t.Errorf("reload removed %d, %v; want 1", removed, err)
+	}
+	if n := rotator.Count(); n != 2 {
+		t.Errorf("pool has %d proxies after the reload, want the 2 added ones", n)
+	}
+}
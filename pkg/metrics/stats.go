@@ -0,0 +1,112 @@
+package metrics
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+
+	"github.com/ogpourya/iploop/pkg/proxy"
+	"github.com/ogpourya/iploop/pkg/server"
+)
+
+type statsResponse struct {
+	TotalRequests   int64        `json:"total_requests"`
+	SuccessRequests int64        `json:"success_requests"`
+	FailedRequests  int64        `json:"failed_requests"`
+	ActiveConns     int64        `json:"active_conns"`
+	MaxConns        int64        `json:"max_conns"`
+	RejectedConns   int64        `json:"rejected_conns"`
+	BytesUp         int64        `json:"bytes_up"`
+	BytesDown       int64        `json:"bytes_down"`
+	DialAttempts    int64        `json:"dial_attempts"`
+	Fallbacks       int64        `json:"fallbacks"`
+	RacedRequests   int64        `json:"raced_requests"`
+	RelayFailures   int64        `json:"relay_failures"`
+	Proxies         []proxyStats `json:"proxies"`
+}
+
+type proxyStats struct {
+	Type         string  `json:"type"`
+	Host         string  `json:"host"`
+	Port         string  `json:"port"`
+	Alive        bool    `json:"alive"`
+	Requests     int64   `json:"requests"`
+	Failures     int64   `json:"failures"`
+	AvgLatencyMs float64 `json:"avg_latency_ms"`
+	P50LatencyMs float64 `json:"p50_latency_ms"`
+	P90LatencyMs float64 `json:"p90_latency_ms"`
+	P99LatencyMs float64 `json:"p99_latency_ms"`
+	BytesUp      int64   `json:"bytes_up"`
+	BytesDown    int64   `json:"bytes_down"`
+	ExitIP       string  `json:"exit_ip,omitempty"`
+}
+
+// StatsHandler serves a JSON snapshot of server and per-proxy counters.
+type StatsHandler struct {
+	rotator *proxy.Rotator
+	stats   *server.Stats
+}
+
+// resetHandler zeroes the server and per-proxy counters, e.g. to compare
+// settings over clean windows.
+func resetHandler(rotator *proxy.Rotator, stats *server.Stats) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		stats.Reset()
+		rotator.ResetStats()
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func NewStatsHandler(rotator *proxy.Rotator, stats *server.Stats) *StatsHandler {
+	return &StatsHandler{
+		rotator: rotator,
+		stats:   stats,
+	}
+}
+
+func (h *StatsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	resp := statsResponse{
+		TotalRequests:   h.stats.TotalRequests.Load(),
+		SuccessRequests: h.stats.SuccessRequests.Load(),
+		FailedRequests:  h.stats.FailedRequests.Load(),
+		ActiveConns:     h.stats.ActiveConns.Load(),
+		MaxConns:        h.stats.MaxConns.Load(),
+		RejectedConns:   h.stats.RejectedConns.Load(),
+		BytesUp:         h.stats.BytesUp.Load(),
+		BytesDown:       h.stats.BytesDown.Load(),
+		DialAttempts:    h.stats.DialAttempts.Load(),
+		Fallbacks:       h.stats.Fallbacks.Load(),
+		RacedRequests:   h.stats.RacedRequests.Load(),
+		RelayFailures:   h.stats.RelayFailures.Load(),
+	}
+
+	proxies := h.rotator.Snapshot()
+	resp.Proxies = make([]proxyStats, 0, len(proxies))
+	for _, p := range proxies {
+		host, port, _ := net.SplitHostPort(p.Address)
+		resp.Proxies = append(resp.Proxies, proxyStats{
+			Type:         p.Type.String(),
+			Host:         host,
+			Port:         port,
+			Alive:        p.Alive,
+			Requests:     p.Requests,
+			Failures:     p.Failures,
+			AvgLatencyMs: float64(p.AvgLatency.Microseconds()) / 1000,
+			P50LatencyMs: float64(p.P50.Microseconds()) / 1000,
+			P90LatencyMs: float64(p.P90.Microseconds()) / 1000,
+			P99LatencyMs: float64(p.P99.Microseconds()) / 1000,
+			BytesUp:      p.BytesUp,
+			BytesDown:    p.BytesDown,
+			ExitIP:       p.ExitIP,
+		})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
@@ -0,0 +1,11 @@
+//go:build !(linux || darwin || freebsd || netbsd || openbsd || dragonfly)
+
+package metrics
+
+import "os"
+
+// terminalWidth is not detected on this platform; displayWidth falls back
+// to $COLUMNS.
+func terminalWidth(f *os.File) int {
+	return 0
+}
@@ -0,0 +1,122 @@
+package proxy
+
+import (
+	"context"
+	"net"
+	"sync"
+	"time"
+)
+
+// ProbeFunc reports whether p is usable. It must honor ctx.
+type ProbeFunc func(ctx context.Context, p *Proxy) error
+
+// TCPProbe returns a probe that only checks the proxy (or the first hop of
+// a chain) accepts TCP connections.
+func TCPProbe() ProbeFunc {
+	return func(ctx context.Context, p *Proxy) error {
+		var d net.Dialer
+		conn, err := d.DialContext(ctx, "tcp", p.FirstHop().Address())
+		if err != nil {
+			return err
+		}
+		return conn.Close()
+	}
+}
+
+// HealthChecker periodically probes dead proxies and returns the ones that
+// recover to rotation.
+type HealthChecker struct {
+	rotator  *Rotator
+	interval time.Duration
+	timeout  time.Duration
+	probe    ProbeFunc
+	kick     chan struct{}
+	stop     chan struct{}
+	once     sync.Once
+}
+
+const maxConcurrentProbes = 32
+
+func NewHealthChecker(rotator *Rotator, interval, timeout time.Duration, probe ProbeFunc) *HealthChecker {
+	if probe == nil {
+		probe = TCPProbe()
+	}
+	return &HealthChecker{
+		rotator:  rotator,
+		interval: interval,
+		timeout:  timeout,
+		probe:    probe,
+		kick:     make(chan struct{}, 1),
+		stop:     make(chan struct{}),
+	}
+}
+
+func (h *HealthChecker) Start() {
+	go h.run()
+}
+
+func (h *HealthChecker) Stop() {
+	h.once.Do(func() {
+		close(h.stop)
+	})
+}
+
+// CheckNow asks for a round of probes without waiting for the next tick.
+// It does not block; a request made while one is pending is dropped.
+func (h *HealthChecker) CheckNow() {
+	select {
+	case h.kick <- struct{}{}:
+	default:
+	}
+}
+
+func (h *HealthChecker) run() {
+	ticker := time.NewTicker(h.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-h.stop:
+			return
+		case <-ticker.C:
+			h.check()
+		case <-h.kick:
+			h.check()
+		}
+	}
+}
+
+func (h *HealthChecker) check() {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-h.stop:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	sem := make(chan struct{}, maxConcurrentProbes)
+	var wg sync.WaitGroup
+	for _, p := range h.rotator.GetProxies() {
+		if p.IsAlive() {
+			continue
+		}
+		sem <- struct{}{}
+		wg.Add(1)
+		go func(p *Proxy) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			pctx, pcancel := context.WithTimeout(ctx, h.timeout)
+			err := h.probe(pctx, p)
+			pcancel()
+			if err == nil {
+				h.rotator.MarkAlive(p)
+			}
+		}(p)
+	}
+	wg.Wait()
+}
@@ -0,0 +1,85 @@
+package proxy
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// latencyBuckets are the upper bounds of the latency histogram's buckets.
+// A final bucket holds everything slower.
+var latencyBuckets = [...]time.Duration{
+	time.Millisecond,
+	2500 * time.Microsecond,
+	5 * time.Millisecond,
+	10 * time.Millisecond,
+	25 * time.Millisecond,
+	50 * time.Millisecond,
+	100 * time.Millisecond,
+	250 * time.Millisecond,
+	500 * time.Millisecond,
+	time.Second,
+	2500 * time.Millisecond,
+	5 * time.Second,
+	10 * time.Second,
+}
+
+// latencyHistogram counts latencies in fixed buckets, so percentiles can
+// be estimated in constant memory.
+type latencyHistogram struct {
+	counts [len(latencyBuckets) + 1]atomic.Int64
+}
+
+func (h *latencyHistogram) observe(d time.Duration) {
+	i := 0
+	for i < len(latencyBuckets) && d > latencyBuckets[i] {
+		i++
+	}
+	h.counts[i].Add(1)
+}
+
+func (h *latencyHistogram) reset() {
+	for i := range h.counts {
+		h.counts[i].Store(0)
+	}
+}
+
+// quantile estimates the q-th quantile (0 < q <= 1) by interpolating
+// within the bucket it falls in. It returns 0 without samples, and the
+// largest bound for samples past it.
+func (h *latencyHistogram) quantile(q float64) time.Duration {
+	var counts [len(latencyBuckets) + 1]int64
+	var total int64
+	for i := range h.counts {
+		counts[i] = h.counts[i].Load()
+		total += counts[i]
+	}
+	if total == 0 {
+		return 0
+	}
+
+	rank := q * float64(total)
+	var seen int64
+	for i, n := range counts {
+		if n == 0 || float64(seen+n) < rank {
+			seen += n
+			continue
+		}
+		if i == len(latencyBuckets) {
+			break
+		}
+		var lo time.Duration
+		if i > 0 {
+			lo = latencyBuckets[i-1]
+		}
+		frac := (rank - float64(seen)) / float64(n)
+		return lo + time.Duration(frac*float64(latencyBuckets[i]-lo))
+	}
+	return latencyBuckets[len(latencyBuckets)-1]
+}
+
+// LatencyQuantile estimates the q-th quantile of p's request latencies,
+// e.g. 0.9 for p90, from a fixed-bucket histogram. It returns 0 until a
+// request succeeds.
+func (p *Proxy) LatencyQuantile(q float64) time.Duration {
+	return p.latency.quantile(q)
+}
@@ -0,0 +1,48 @@
+package proxy
+
+// Observer is notified of proxy lifecycle events by a Rotator. Methods are
+// called synchronously on the goroutine that caused the event, after the
+// rotator's lock is released, so they may call back into the rotator but
+// should return quickly.
+type Observer interface {
+	// OnDead is called when MarkDead takes a live proxy out of service.
+	OnDead(p *Proxy)
+	// OnAlive is called when MarkAlive returns a dead proxy to service.
+	OnAlive(p *Proxy)
+	// OnSelect is called for every proxy Next, NextTagged, NextForTarget
+	// or NextForSession hands out.
+	OnSelect(p *Proxy)
+}
+
+// ObserverFuncs adapts plain functions to Observer. Nil fields are skipped.
+type ObserverFuncs struct {
+	Dead   func(p *Proxy)
+	Alive  func(p *Proxy)
+	Select func(p *Proxy)
+}
+
+func (o ObserverFuncs) OnDead(p *Proxy) {
+	if o.Dead != nil {
+		o.Dead(p)
+	}
+}
+
+func (o ObserverFuncs) OnAlive(p *Proxy) {
+	if o.Alive != nil {
+		o.Alive(p)
+	}
+}
+
+func (o ObserverFuncs) OnSelect(p *Proxy) {
+	if o.Select != nil {
+		o.Select(p)
+	}
+}
+
+// SetObserver registers o for the rotator's events, replacing any earlier
+// observer. A nil o turns notifications off.
+func (r *Rotator) SetObserver(o Observer) {
+	r.mu.Lock()
+	r.observer = o
+	r.mu.Unlock()
+}
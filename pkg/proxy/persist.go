@@ -0,0 +1,91 @@
+package proxy
+
+import (
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// savedStats is the on-disk form of one proxy's history.
+type savedStats struct {
+	Proxy     string `json:"proxy"`
+	Requests  int64  `json:"requests"`
+	Failures  int64  `json:"failures"`
+	TotalTime int64  `json:"total_time_ns"`
+	Alive     bool   `json:"alive"`
+}
+
+// SaveStats writes every proxy's counters and alive state to path as JSON.
+// The file is replaced atomically so a crash never leaves it half-written.
+func (r *Rotator) SaveStats(path string) error {
+	r.mu.Lock()
+	saved := make([]savedStats, len(r.proxies))
+	for i, p := range r.proxies {
+		saved[i] = savedStats{
+			Proxy:     p.String(),
+			Requests:  p.requests.Load(),
+			Failures:  p.failures.Load(),
+			TotalTime: p.totalTime.Load(),
+			Alive:     p.IsAlive(),
+		}
+	}
+	r.mu.Unlock()
+
+	data, err := json.MarshalIndent(saved, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// LoadStats restores counters saved by SaveStats onto the proxies in the
+// pool with the same String() form, returning how many matched. Entries
+// for proxies no longer in the pool are skipped, and a missing file is not
+// an error.
+func (r *Rotator) LoadStats(path string) (int, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	var saved []savedStats
+	if err := json.Unmarshal(data, &saved); err != nil {
+		return 0, err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	byKey := make(map[string]*Proxy, len(r.proxies))
+	for _, p := range r.proxies {
+		byKey[p.String()] = p
+	}
+	restored := 0
+	for _, s := range saved {
+		p, ok := byKey[s.Proxy]
+		if !ok {
+			continue
+		}
+		p.restoreStats(s.Requests, s.Failures, time.Duration(s.TotalTime), s.Alive)
+		restored++
+	}
+	return restored, nil
+}
@@ -4,108 +4,581 @@ import (
 	"bufio"
 	"errors"
 	"fmt"
+	"io"
 	"math/rand/v2"
+	"net/http"
+	"net/url"
 	"os"
+	"slices"
 	"strings"
 	"sync"
+	"time"
 )
 
 var ErrAllProxiesDead = errors.New("all proxies are dead")
 
+// ErrNoMoreProxies is returned when every usable proxy was excluded by
+// the caller.
+var ErrNoMoreProxies = errors.New("no more proxies to try")
+
+// ErrAllProxiesBusy is returned when every usable proxy is at its
+// concurrent connection limit.
+var ErrAllProxiesBusy = errors.New("all proxies are at their connection limit")
+
 type RotationStrategy int
 
 const (
 	RotationRandom RotationStrategy = iota
 	RotationSequential
+	RotationWeighted
+	// RotationRoundRobin advances to the next proxy on every call,
+	// ignoring requestsPer, so a burst of concurrent requests is spread
+	// evenly. RotationSequential walks the same order but stays on each
+	// proxy for requestsPer requests.
+	RotationRoundRobin
+	// RotationStaticWeighted shares traffic in proportion to each proxy's
+	// configured Weight, regardless of how it performs, interleaving picks
+	// so the shares hold over short windows too.
+	RotationStaticWeighted
 )
 
 func (s RotationStrategy) String() string {
-	if s == RotationRandom {
+	switch s {
+	case RotationRandom:
 		return "random"
+	case RotationWeighted:
+		return "weighted"
+	case RotationRoundRobin:
+		return "round-robin"
+	case RotationStaticWeighted:
+		return "static-weighted"
+	default:
+		return "sequential"
 	}
-	return "sequential"
 }
 
 func ParseRotationStrategy(s string) RotationStrategy {
-	if s == "sequential" || s == "seq" {
+	switch s {
+	case "sequential", "seq":
 		return RotationSequential
+	case "weighted", "weight":
+		return RotationWeighted
+	case "round-robin", "roundrobin", "rr":
+		return RotationRoundRobin
+	case "static-weighted", "static", "wrr":
+		return RotationStaticWeighted
+	default:
+		return RotationRandom
+	}
+}
+
+const (
+	// baselineLatency is assumed for proxies without successful samples so
+	// new proxies still get picked.
+	baselineLatency = 500 * time.Millisecond
+	// minWeightLatency caps how much a very fast proxy can dominate.
+	minWeightLatency = 10 * time.Millisecond
+)
+
+// weight scores p for weighted rotation: a higher success ratio and a lower
+// p90 latency yield a higher weight. The p90 keeps a proxy with a slow tail
+// from hiding behind a good average; the average is used until the
+// histogram has samples, as after restoring saved stats.
+func weight(p *Proxy) float64 {
+	requests, failures, avg := p.Stats()
+	if p90 := p.LatencyQuantile(0.9); p90 > 0 {
+		avg = p90
+	}
+	if requests == 0 {
+		avg = baselineLatency
+	}
+	if avg < minWeightLatency {
+		avg = minWeightLatency
 	}
-	return RotationRandom
+	// Laplace smoothing keeps unsampled proxies at a neutral ratio and never
+	// drops a proxy to zero weight.
+	success := float64(requests+1) / float64(requests+failures+2)
+	return success / avg.Seconds()
 }
 
 type Rotator struct {
 	proxies     []*Proxy
-	seen        map[string]bool
+	seen        map[string]*Proxy   // Pool entry by String() form
+	sources     map[string][]string // Sources listing each key; see reload
 	strategy    RotationStrategy
+	selector    Selector
 	skipDead    bool
 	mu          sync.Mutex
 	requestsPer int
 	current     *Proxy
 	counter     int
-	seqIndex    int
-	shuffled    []*Proxy
-	shuffleIdx  int
-	poolCache   []*Proxy
+	since       time.Time           // When current was picked
+	interval    time.Duration       // Stay on current this long, if set, instead of counting requests
+	sessions    map[string]*session // By token; see NextForSession
+	sessionTTL  time.Duration       // Unused sessions are forgotten after this, 0 means DefaultSessionTTL
+	sessionGC   int                 // Session count at which expired ones are swept
+	poolCache   []*Proxy            // Scratch space for getPool; see there
+	maxPerProxy int                 // Default per-proxy connection limit, 0 means unlimited
+	limited     bool                // Whether any connection limit is in effect
+	closeOnDead bool                // MarkDead closes the proxy's tracked connections
+	rng         *rand.Rand
+	observer    Observer
 }
 
+// NewRotator creates an empty rotator. requestsPer sets how many requests
+// Next serves from a proxy before moving on: 0 picks afresh on every call
+// and never tracks a current proxy, N stays for N requests, and -1 stays
+// until the proxy dies or fills up. Which proxy comes next is up to the
+// built-in Selector for strategy, or one set with SetSelector.
 func NewRotator(strategy RotationStrategy, skipDead bool, requestsPer int) *Rotator {
-	return &Rotator{
+	r := &Rotator{
 		proxies:     make([]*Proxy, 0, 64),
-		seen:        make(map[string]bool),
+		seen:        make(map[string]*Proxy),
+		sources:     make(map[string][]string),
 		strategy:    strategy,
 		skipDead:    skipDead,
 		requestsPer: requestsPer,
 		poolCache:   make([]*Proxy, 0, 64),
+		rng:         rand.New(rand.NewPCG(rand.Uint64(), rand.Uint64())),
 	}
+	r.selector = r.builtinSelector(strategy)
+	return r
 }
 
-func (r *Rotator) AddProxy(p *Proxy) {
-	key := p.String()
+// SetSeed makes random and weighted picks reproducible for a given seed and
+// sequence of calls. Rotators are randomly seeded by default.
+func (r *Rotator) SetSeed(seed uint64) {
 	r.mu.Lock()
-	if r.seen[key] {
-		r.mu.Unlock()
-		return
+	r.rng = rand.New(rand.NewPCG(seed, seed))
+	if s, ok := r.selector.(*randomSelector); ok {
+		s.bag = nil
 	}
-	r.seen[key] = true
+	r.mu.Unlock()
+}
+
+// AddProxy adds p to the pool and reports whether it was new. Proxies
+// added this way stay until RemoveProxy; reloads of a file or URL leave
+// them alone.
+func (r *Rotator) AddProxy(p *Proxy) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.add(p, "")
+}
+
+// add adds p to the pool as listed by source, "" for none, and reports
+// whether it was new. A proxy already in the pool is only recorded as
+// listed by source too.
+func (r *Rotator) add(p *Proxy, source string) bool {
+	key := p.String()
+	if r.seen[key] != nil {
+		if !slices.Contains(r.sources[key], source) {
+			r.sources[key] = append(r.sources[key], source)
+		}
+		return false
+	}
+	r.seen[key] = p
+	r.sources[key] = []string{source}
 	r.proxies = append(r.proxies, p)
-	r.poolCache = r.poolCache[:0]
-	r.shuffled = nil
+	if p.MaxConns > 0 {
+		r.limited = true
+	}
+	return true
+}
+
+// RemoveProxy removes the proxy identified by key, either its String() form
+// or a URL that parses to it, and reports whether it was in the pool.
+func (r *Rotator) RemoveProxy(key string) bool {
+	if p, err := NewProxy(key); err == nil {
+		key = p.String()
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.seen[key] == nil {
+		return false
+	}
+	// Build a new slice rather than shifting in place so copies handed
+	// out earlier never observe a partial removal.
+	next := make([]*Proxy, 0, len(r.proxies))
+	for _, p := range r.proxies {
+		if p.String() == key {
+			if r.current == p {
+				r.current = nil
+				r.counter = 0
+			}
+			r.dropSessions(p)
+			continue
+		}
+		next = append(next, p)
+	}
+	delete(r.seen, key)
+	delete(r.sources, key)
+	r.proxies = next
+	r.updateLimited()
+	return true
+}
+
+// SetMaxPerProxy limits concurrent connections through each proxy that
+// doesn't set its own limit. Zero means unlimited.
+func (r *Rotator) SetMaxPerProxy(n int) {
+	r.mu.Lock()
+	r.maxPerProxy = n
+	r.updateLimited()
+	r.mu.Unlock()
+}
+
+func (r *Rotator) updateLimited() {
+	r.limited = r.maxPerProxy > 0
+	for _, p := range r.proxies {
+		if p.MaxConns > 0 {
+			r.limited = true
+		}
+	}
+}
+
+func (r *Rotator) full(p *Proxy) bool {
+	limit := r.limit(p)
+	return limit > 0 && p.ActiveConns() >= limit
+}
+
+// limit returns p's connection limit, 0 meaning none.
+func (r *Rotator) limit(p *Proxy) int64 {
+	if p.MaxConns > 0 {
+		return int64(p.MaxConns)
+	}
+	return int64(r.maxPerProxy)
+}
+
+// Reserve takes one of p's connection slots, as Acquire does, unless p is
+// at its limit from SetMaxPerProxy or its max option. Next and friends
+// skip full proxies, but callers picking concurrently can all see the same
+// last free slot; Reserve is what holds the limit. Pair it with Release.
+func (r *Rotator) Reserve(p *Proxy) bool {
+	r.mu.Lock()
+	limit := r.limit(p)
 	r.mu.Unlock()
+	return p.tryAcquire(limit)
 }
 
+func (r *Rotator) usable(p *Proxy) bool {
+	return (!r.skipDead || p.IsAlive()) && !r.full(p)
+}
+
+// LoadFromReader adds the proxies listed in rd, one per line in the proxy
+// file format, and returns how many were not in the pool yet. Lines that
+// don't parse are skipped and reported in err as *LineError, joined with
+// any read error; SkippedLines tells them apart. Proxies read before an
+// error are kept.
+func (r *Rotator) LoadFromReader(rd io.Reader) (added int, err error) {
+	return r.loadFrom(rd, "")
+}
+
+// loadFrom is LoadFromReader recording the proxies as listed by source.
+func (r *Rotator) loadFrom(rd io.Reader, source string) (added int, err error) {
+	proxies, err := ParseProxyList(rd)
+	r.mu.Lock()
+	for _, p := range proxies {
+		if r.add(p, source) {
+			added++
+		}
+	}
+	r.mu.Unlock()
+	return added, err
+}
+
+// AddFromFile is LoadFromReader for the proxy file at path. Its proxies
+// are the ones a later ReloadFromFile of path updates.
+func (r *Rotator) AddFromFile(path string) (added int, err error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	return r.loadFrom(f, path)
+}
+
+// LoadFromFile adds the proxies in the file at path. Invalid lines are
+// printed to stderr and skipped; use AddFromFile to handle them instead.
 func (r *Rotator) LoadFromFile(path string) error {
+	_, err := r.AddFromFile(path)
+	return printSkipped(err)
+}
+
+// ReloadFromFile updates the proxies loaded from path (see AddFromFile)
+// to the ones it lists now. Proxies that remain keep their stats and alive
+// state. A proxy no longer listed is dropped unless another source lists
+// it or it was added on its own; proxies from -proxies, a proxy URL or
+// AddProxy are left alone. The pool is left untouched if the file cannot
+// be read.
+func (r *Rotator) ReloadFromFile(path string) (added, removed int, err error) {
+	proxies, err := readProxyFile(path)
+	if err := printSkipped(err); err != nil {
+		return 0, 0, err
+	}
+	added, removed = r.reload(path, proxies)
+	return added, removed, nil
+}
+
+// reload makes proxies the ones listed by source, keeping the existing
+// entries for proxies already in the pool. Proxies source listed before
+// but not now lose it, and leave the pool once no source lists them.
+func (r *Rotator) reload(source string, proxies []*Proxy) (added, removed int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	listed := make(map[string]bool, len(proxies))
+	for _, p := range proxies {
+		listed[p.String()] = true
+		if r.add(p, source) {
+			added++
+		}
+	}
+
+	next := make([]*Proxy, 0, len(r.proxies))
+	for _, p := range r.proxies {
+		key := p.String()
+		if listed[key] || !slices.Contains(r.sources[key], source) {
+			next = append(next, p)
+			continue
+		}
+		r.sources[key] = slices.DeleteFunc(r.sources[key], func(s string) bool { return s == source })
+		if len(r.sources[key]) > 0 {
+			next = append(next, p)
+			continue
+		}
+		if r.current == p {
+			r.current = nil
+			r.counter = 0
+		}
+		r.dropSessions(p)
+		delete(r.seen, key)
+		delete(r.sources, key)
+		removed++
+	}
+	r.proxies = next
+	r.updateLimited()
+	return added, removed
+}
+
+// AddFromURL is LoadFromReader for the proxy list fetched from rawURL.
+// Its proxies are the ones a later ReloadFromURL of rawURL updates.
+func (r *Rotator) AddFromURL(rawURL string) (added int, err error) {
+	body, err := openProxyList(rawURL)
+	if err != nil {
+		return 0, err
+	}
+	defer body.Close()
+	return r.loadFrom(body, rawURL)
+}
+
+// LoadFromURL fetches a proxy list in the proxy file format from rawURL
+// and adds its proxies. Invalid lines are printed to stderr and skipped;
+// use AddFromURL to handle them instead.
+func (r *Rotator) LoadFromURL(rawURL string) error {
+	_, err := r.AddFromURL(rawURL)
+	return printSkipped(err)
+}
+
+// ReloadFromURL is like ReloadFromFile but fetches the list from rawURL,
+// updating only the proxies loaded from it (see AddFromURL). The pool is
+// left untouched if the request fails or doesn't return 200.
+func (r *Rotator) ReloadFromURL(rawURL string) (added, removed int, err error) {
+	proxies, err := fetchProxyList(rawURL)
+	if err := printSkipped(err); err != nil {
+		return 0, 0, err
+	}
+	// An empty list is more likely a provider hiccup than intent.
+	if len(proxies) == 0 {
+		return 0, 0, fmt.Errorf("empty proxy list")
+	}
+	added, removed = r.reload(rawURL, proxies)
+	return added, removed, nil
+}
+
+const maxProxyListSize = 16 << 20
+
+var listClient = &http.Client{Timeout: 30 * time.Second}
+
+func fetchProxyList(rawURL string) ([]*Proxy, error) {
+	body, err := openProxyList(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+	return ParseProxyList(body)
+}
+
+// openProxyList requests the proxy list at rawURL and returns its body,
+// capped at maxProxyListSize.
+func openProxyList(rawURL string) (io.ReadCloser, error) {
+	resp, err := listClient.Get(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("unexpected status: %s", resp.Status)
+	}
+	return struct {
+		io.Reader
+		io.Closer
+	}{io.LimitReader(resp.Body, maxProxyListSize), resp.Body}, nil
+}
+
+func readProxyFile(path string) ([]*Proxy, error) {
 	f, err := os.Open(path)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	defer f.Close()
+	return ParseProxyList(f)
+}
 
-	scanner := bufio.NewScanner(f)
-	for scanner.Scan() {
-		line := strings.TrimSpace(scanner.Text())
-		if len(line) == 0 || line[0] == '#' {
+// LineError is an entry of a proxy list that could not be parsed.
+type LineError struct {
+	Line int    // Counted from 1
+	Text string // The entry as written, credentials included
+	Err  error
+}
+
+func (e *LineError) Error() string {
+	return fmt.Sprintf("line %d: %s: %v", e.Line, e.Text, e.Err)
+}
+
+func (e *LineError) Unwrap() error {
+	return e.Err
+}
+
+// SkippedLines splits an error from the loaders into the entries they
+// skipped and the rest, which is nil if the whole list was read.
+func SkippedLines(err error) (skipped []*LineError, rest error) {
+	var errs []error
+	if joined, ok := err.(interface{ Unwrap() []error }); ok {
+		errs = joined.Unwrap()
+	} else if err != nil {
+		errs = []error{err}
+	}
+	var others []error
+	for _, e := range errs {
+		if le, ok := e.(*LineError); ok {
+			skipped = append(skipped, le)
+		} else {
+			others = append(others, e)
+		}
+	}
+	return skipped, errors.Join(others...)
+}
+
+// printSkipped prints the entries a loader skipped to stderr, as the
+// loaders that predate AddFromFile and friends always did, and returns
+// the rest of err.
+func printSkipped(err error) error {
+	skipped, rest := SkippedLines(err)
+	for _, le := range skipped {
+		fmt.Fprintf(os.Stderr, "Invalid proxy URL: %s: %v\n", le.Text, le.Err)
+	}
+	return rest
+}
+
+// ParseProxyList reads a list in the proxy file format: one proxy per
+// line, optionally followed by key=value options such as "region=us", with
+// blank lines and '#' comments skipped. Invalid lines are skipped and
+// returned as *LineError, joined with any read error.
+func ParseProxyList(rd io.Reader) ([]*Proxy, error) {
+	var proxies []*Proxy
+	var errs []error
+	scanner := bufio.NewScanner(rd)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(stripComment(scanner.Text()))
+		if len(line) == 0 {
 			continue
 		}
-		p, err := NewProxy(line)
+		p, err := parseListLine(line)
 		if err != nil {
-			fmt.Fprintf(os.Stderr, "Invalid proxy URL: %s: %v\n", line, err)
+			errs = append(errs, &LineError{Line: n, Text: line, Err: err})
 			continue
 		}
-		r.AddProxy(p)
+		proxies = append(proxies, p)
 	}
-	return scanner.Err()
+	return proxies, errors.Join(append(errs, scanner.Err())...)
 }
 
-func (r *Rotator) LoadFromStrings(urls []string) error {
-	for _, u := range urls {
+// stripComment cuts a '#' comment from a proxy list line. Only a '#' that
+// starts the line or follows whitespace begins one, so URL fragments and
+// passwords containing '#' are left alone.
+func stripComment(line string) string {
+	for i := 0; i < len(line); i++ {
+		if line[i] == '#' && (i == 0 || line[i-1] == ' ' || line[i-1] == '\t') {
+			return line[:i]
+		}
+	}
+	return line
+}
+
+// parseListLine parses a proxy list entry: a proxy as NewProxy takes it,
+// optionally followed by whitespace-separated key=value options such as
+// "region=us weight=5". They are the URL query options and override the
+// URL's own.
+func parseListLine(line string) (*Proxy, error) {
+	fields := strings.Fields(line)
+	n := len(fields)
+	for n > 1 && isListOption(fields[n-1]) {
+		n--
+	}
+	p, err := NewProxy(strings.Join(fields[:n], " "))
+	if err != nil || n == len(fields) {
+		return p, err
+	}
+	q := url.Values{}
+	for _, f := range fields[n:] {
+		k, v, _ := strings.Cut(f, "=")
+		q.Set(k, v)
+	}
+	if err := p.parseOptions(q); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// isListOption reports whether a field after a proxy is a key=value
+// option rather than part of the proxy, such as a chain hop.
+func isListOption(field string) bool {
+	k, _, ok := strings.Cut(field, "=")
+	if !ok || k == "" {
+		return false
+	}
+	for _, c := range k {
+		if c < 'a' || c > 'z' {
+			return false
+		}
+	}
+	return true
+}
+
+// AddFromStrings adds the proxies in urls and returns how many were not
+// in the pool yet. Invalid entries are skipped and reported in err as
+// *LineError, numbered by their position in urls.
+func (r *Rotator) AddFromStrings(urls []string) (added int, err error) {
+	var errs []error
+	for i, u := range urls {
 		p, err := NewProxy(u)
 		if err != nil {
-			fmt.Fprintf(os.Stderr, "Invalid proxy URL: %s: %v\n", u, err)
+			errs = append(errs, &LineError{Line: i + 1, Text: u, Err: err})
 			continue
 		}
-		r.AddProxy(p)
+		if r.AddProxy(p) {
+			added++
+		}
 	}
-	return nil
+	return added, errors.Join(errs...)
+}
+
+// LoadFromStrings adds the proxies in urls. Invalid entries are printed to
+// stderr and skipped; use AddFromStrings to handle them instead.
+func (r *Rotator) LoadFromStrings(urls []string) error {
+	_, err := r.AddFromStrings(urls)
+	return printSkipped(err)
 }
 
 func (r *Rotator) Count() int {
@@ -115,6 +588,76 @@ func (r *Rotator) Count() int {
 	return n
 }
 
+// GetProxies returns a copy of the proxy list, taken under the lock, so
+// callers may iterate it while the pool is changed concurrently. The
+// proxies themselves are shared and their counters stay live.
+func (r *Rotator) GetProxies() []*Proxy {
+	r.mu.Lock()
+	out := make([]*Proxy, len(r.proxies))
+	copy(out, r.proxies)
+	r.mu.Unlock()
+	return out
+}
+
+// ProxyStats is a point-in-time copy of one proxy's state.
+type ProxyStats struct {
+	Proxy       string // String() form, unique within the pool
+	Type        ProxyType
+	Address     string
+	Tag         string
+	Alive       bool
+	Requests    int64
+	Failures    int64
+	AvgLatency  time.Duration
+	P50         time.Duration // Latency percentiles, estimated from a histogram
+	P90         time.Duration
+	P99         time.Duration
+	ActiveConns int64
+	BytesUp     int64           // Client to target
+	BytesDown   int64           // Target to client
+	ExitIP      string          // Public egress address, if looked up
+	Recent      []time.Duration // Latest request latencies, oldest first
+}
+
+// Snapshot copies the state of every proxy in pool order, so observers
+// don't read live counters while they render.
+func (r *Rotator) Snapshot() []ProxyStats {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	out := make([]ProxyStats, len(r.proxies))
+	for i, p := range r.proxies {
+		requests, failures, avg := p.Stats()
+		up, down := p.Bytes()
+		exit, _ := p.ExitIP()
+		out[i] = ProxyStats{
+			Proxy:       p.String(),
+			Type:        p.Type,
+			Address:     p.Address(),
+			Tag:         p.Tag,
+			Alive:       p.IsAlive(),
+			Requests:    requests,
+			Failures:    failures,
+			AvgLatency:  avg,
+			P50:         p.LatencyQuantile(0.5),
+			P90:         p.LatencyQuantile(0.9),
+			P99:         p.LatencyQuantile(0.99),
+			ActiveConns: p.ActiveConns(),
+			BytesUp:     up,
+			BytesDown:   down,
+			ExitIP:      exit,
+			Recent:      p.RecentLatencies(),
+		}
+	}
+	return out
+}
+
+// ResetStats calls ResetStats on every proxy in the pool.
+func (r *Rotator) ResetStats() {
+	for _, p := range r.GetProxies() {
+		p.ResetStats()
+	}
+}
+
 func (r *Rotator) AliveCount() int {
 	r.mu.Lock()
 	defer r.mu.Unlock()
@@ -127,85 +670,193 @@ func (r *Rotator) AliveCount() int {
 	return count
 }
 
+// getPool returns the proxies Next may pick from. The result aliases
+// r.proxies or r.poolCache, which getPool rebuilds on every call, so it is
+// only valid while r.mu is held and must never be returned to callers or
+// kept; anything that outlives the lock is copied first, as GetProxies
+// does. poolCache is reused only to save an allocation per pick.
 func (r *Rotator) getPool() ([]*Proxy, error) {
-	if !r.skipDead {
+	if !r.skipDead && !r.limited {
 		return r.proxies, nil
 	}
 
 	r.poolCache = r.poolCache[:0]
+	busy := false
 	for _, p := range r.proxies {
-		if p.IsAlive() {
-			r.poolCache = append(r.poolCache, p)
+		if r.skipDead && !p.IsAlive() {
+			continue
+		}
+		if r.full(p) {
+			busy = true
+			continue
 		}
+		r.poolCache = append(r.poolCache, p)
 	}
 
 	if len(r.poolCache) == 0 {
+		if busy {
+			return nil, ErrAllProxiesBusy
+		}
 		return nil, ErrAllProxiesDead
 	}
 	return r.poolCache, nil
 }
 
 func (r *Rotator) Next() (*Proxy, error) {
+	return r.NextTagged("")
+}
+
+// NextTagged is like Next but only rotates among proxies whose Tag matches
+// tag, ignoring case. It falls back to the whole pool when no usable proxy
+// has the tag. An empty tag matches every proxy.
+//
+// Proxies in exclude are passed over, so a caller can get fallbacks for a
+// request. Such a pick is a one-off: it neither uses nor replaces the
+// proxy Next is staying on.
+func (r *Rotator) NextTagged(tag string, exclude ...*Proxy) (*Proxy, error) {
 	r.mu.Lock()
-	defer r.mu.Unlock()
+	p, err := r.nextTagged(tag, exclude)
+	o := r.observer
+	r.mu.Unlock()
+	if o != nil && p != nil {
+		o.OnSelect(p)
+	}
+	return p, err
+}
 
+func (r *Rotator) nextTagged(tag string, exclude []*Proxy) (*Proxy, error) {
 	if len(r.proxies) == 0 {
 		return nil, fmt.Errorf("no proxies available")
 	}
 
 	// Stay on current proxy if requested
-	if r.current != nil && (r.requestsPer == -1 || r.counter < r.requestsPer) {
-		if !r.skipDead || r.current.IsAlive() {
+	sticky := len(exclude) == 0 && (r.interval > 0 || r.strategy != RotationRoundRobin && r.requestsPer != 0)
+	if sticky && r.current != nil && r.stay() {
+		if r.usable(r.current) && (tag == "" || strings.EqualFold(r.current.Tag, tag)) {
 			r.counter++
 			return r.current, nil
 		}
 	}
 
-	pool, err := r.getPool()
+	proxy, err := r.pick(tag, exclude)
 	if err != nil {
 		return nil, err
 	}
+	if sticky {
+		r.current = proxy
+		r.counter = 1
+		r.since = time.Now()
+	}
+	return proxy, nil
+}
 
-	var proxy *Proxy
+// pick has the selector choose among the usable proxies, preferring those
+// tagged tag and passing over exclude. It leaves r.current alone.
+func (r *Rotator) pick(tag string, exclude []*Proxy) (*Proxy, error) {
+	pool, err := r.getPool()
+	if err != nil {
+		return nil, err
+	}
 
-	switch r.strategy {
-	case RotationSequential:
-		r.seqIndex = r.seqIndex % len(pool)
-		proxy = pool[r.seqIndex]
-		r.seqIndex++
+	if len(exclude) > 0 {
+		// pool may alias r.proxies or r.poolCache, so filter into a copy.
+		var rest []*Proxy
+		for _, p := range pool {
+			if !slices.Contains(exclude, p) {
+				rest = append(rest, p)
+			}
+		}
+		if len(rest) == 0 {
+			return nil, ErrNoMoreProxies
+		}
+		pool = rest
+	}
 
-	case RotationRandom:
-		needReshuffle := r.shuffled == nil || r.shuffleIdx >= len(r.shuffled)
-		if r.skipDead && len(r.shuffled) != len(pool) {
-			needReshuffle = true
-		}
-		if needReshuffle {
-			if cap(r.shuffled) < len(pool) {
-				r.shuffled = make([]*Proxy, len(pool))
-			} else {
-				r.shuffled = r.shuffled[:len(pool)]
+	if tag != "" {
+		var matched []*Proxy
+		for _, p := range pool {
+			if strings.EqualFold(p.Tag, tag) {
+				matched = append(matched, p)
 			}
-			copy(r.shuffled, pool)
-			rand.Shuffle(len(r.shuffled), func(i, j int) {
-				r.shuffled[i], r.shuffled[j] = r.shuffled[j], r.shuffled[i]
-			})
-			r.shuffleIdx = 0
 		}
-		proxy = r.shuffled[r.shuffleIdx]
-		r.shuffleIdx++
+		if len(matched) > 0 {
+			pool = matched
+		}
 	}
 
-	r.current = proxy
-	r.counter = 1
+	proxy, err := r.selector.Select(pool)
+	if err != nil {
+		return nil, err
+	}
+	if proxy == nil {
+		return nil, fmt.Errorf("selector returned no proxy")
+	}
 	return proxy, nil
 }
 
+// SetRotateInterval makes Next stay on a proxy for d after picking it,
+// however many requests it serves, instead of for requestsPer requests.
+// A proxy that dies or fills up is still left early. Zero goes back to
+// counting requests.
+func (r *Rotator) SetRotateInterval(d time.Duration) {
+	r.mu.Lock()
+	r.interval = d
+	r.mu.Unlock()
+}
+
+// stay reports whether Next may keep serving r.current.
+func (r *Rotator) stay() bool {
+	if r.interval > 0 {
+		return time.Since(r.since) < r.interval
+	}
+	return r.requestsPer == -1 || r.counter < r.requestsPer
+}
+
+// Advance makes Next move on from p: if p is the proxy Next is staying on
+// for requestsPer requests, the next call picks afresh. Callers use it
+// after a failure so later requests leave through another proxy even
+// while p is still considered alive.
+func (r *Rotator) Advance(p *Proxy) {
+	r.mu.Lock()
+	if r.current == p {
+		r.current = nil
+		r.counter = 0
+	}
+	r.mu.Unlock()
+}
+
 func (r *Rotator) MarkDead(p *Proxy) {
 	r.mu.Lock()
+	changed := p.IsAlive()
 	p.MarkDead()
-	if r.skipDead {
-		r.shuffled = nil
-		r.poolCache = r.poolCache[:0]
+	o := r.observer
+	closeConns := changed && r.closeOnDead
+	r.mu.Unlock()
+	if closeConns {
+		p.CloseConns()
 	}
+	if o != nil && changed {
+		o.OnDead(p)
+	}
+}
+
+// SetCloseOnDead makes MarkDead close the connections relayed through a
+// live proxy it takes out of service (see Proxy.Track), so their clients
+// fail fast and retry through another one instead of staying on a proxy
+// that may be blocked. Off by default, which lets them finish.
+func (r *Rotator) SetCloseOnDead(on bool) {
+	r.mu.Lock()
+	r.closeOnDead = on
+	r.mu.Unlock()
+}
+
+func (r *Rotator) MarkAlive(p *Proxy) {
+	r.mu.Lock()
+	changed := !p.IsAlive()
+	p.MarkAlive()
+	o := r.observer
 	r.mu.Unlock()
+	if o != nil && changed {
+		o.OnAlive(p)
+	}
 }
@@ -0,0 +1,191 @@
+package proxy
+
+import (
+	"fmt"
+	"slices"
+)
+
+// Selector picks the proxy for a request from pool, which holds the
+// proxies that may serve it in the rotator's order: with skip-dead only
+// live ones, never any at their connection limit, and only those with the
+// requested tag when one matches. pool is never empty. Select runs with
+// the rotator locked, so it must not call back into the Rotator, and it
+// must not keep or modify pool.
+//
+// The rotator still decides how long to stay on a pick (see NewRotator);
+// Select is only called when it moves on.
+type Selector interface {
+	Select(pool []*Proxy) (*Proxy, error)
+}
+
+// SelectorFunc adapts a function to the Selector interface.
+type SelectorFunc func(pool []*Proxy) (*Proxy, error)
+
+func (f SelectorFunc) Select(pool []*Proxy) (*Proxy, error) {
+	return f(pool)
+}
+
+// SetSelector replaces the strategy given to NewRotator with s, e.g. to
+// pick by region or a custom score. nil restores the built-in selector
+// for the rotator's strategy.
+func (r *Rotator) SetSelector(s Selector) {
+	r.mu.Lock()
+	if s == nil {
+		s = r.builtinSelector(r.strategy)
+	}
+	r.selector = s
+	r.mu.Unlock()
+}
+
+// builtinSelector returns the selector implementing strategy.
+func (r *Rotator) builtinSelector(strategy RotationStrategy) Selector {
+	switch strategy {
+	case RotationRandom:
+		return &randomSelector{r: r}
+	case RotationWeighted:
+		return &weightedSelector{r: r}
+	case RotationStaticWeighted:
+		return &staticWeightSelector{r: r, current: make(map[*Proxy]int)}
+	default:
+		return &orderSelector{r: r}
+	}
+}
+
+// orderSelector walks the rotator's proxies in order, for the sequential
+// and round-robin strategies. The cursor follows the last pick rather
+// than an index into the pool, so proxies dying or reviving don't make it
+// skip ahead or revisit recent picks.
+type orderSelector struct {
+	r     *Rotator
+	index int    // Position in r.proxies after the last pick
+	last  *Proxy // Last pick
+}
+
+func (s *orderSelector) Select(pool []*Proxy) (*Proxy, error) {
+	all := s.r.proxies
+	start := s.index
+	if s.last != nil && (start == 0 || start > len(all) || all[start-1] != s.last) {
+		// The pool changed under the cursor; find the last pick again. If
+		// it was removed, carry on from the same position.
+		if i := slices.Index(all, s.last); i >= 0 {
+			start = i + 1
+		}
+	}
+
+	// pool is a subsequence of all, so one pass finds the first member at
+	// or after start, or else the first member, wrapping around.
+	j, first := 0, -1
+	for i, p := range all {
+		if j == len(pool) {
+			break
+		}
+		if pool[j] != p {
+			continue
+		}
+		if first < 0 {
+			first = i
+		}
+		if i >= start {
+			first = i
+			break
+		}
+		j++
+	}
+	if first < 0 {
+		return nil, fmt.Errorf("selector pool is not from the rotator")
+	}
+	s.index = first + 1
+	s.last = all[first]
+	return s.last, nil
+}
+
+// randomSelector deals proxies from a shuffled bag, so every proxy is
+// used once before any repeats. The bag is reshuffled when the pool
+// changes size; picks no longer in the pool are passed over.
+type randomSelector struct {
+	r   *Rotator
+	bag []*Proxy
+	idx int
+}
+
+func (s *randomSelector) Select(pool []*Proxy) (*Proxy, error) {
+	for {
+		fresh := s.idx >= len(s.bag) || len(s.bag) != len(pool)
+		if fresh {
+			s.bag = append(s.bag[:0], pool...)
+			s.r.rng.Shuffle(len(s.bag), func(i, j int) {
+				s.bag[i], s.bag[j] = s.bag[j], s.bag[i]
+			})
+			s.idx = 0
+		}
+		p := s.bag[s.idx]
+		s.idx++
+		// A fresh shuffle comes from pool itself; an older one may hold
+		// proxies that have since died, filled up or been removed.
+		if fresh || slices.Contains(pool, p) {
+			return p, nil
+		}
+	}
+}
+
+// weightedSelector picks proxies at random in proportion to weight.
+type weightedSelector struct {
+	r *Rotator
+}
+
+func (s *weightedSelector) Select(pool []*Proxy) (*Proxy, error) {
+	var total float64
+	weights := make([]float64, len(pool))
+	for i, p := range pool {
+		weights[i] = weight(p)
+		total += weights[i]
+	}
+	pick := s.r.rng.Float64() * total
+	for i, w := range weights {
+		if pick < w {
+			return pool[i], nil
+		}
+		pick -= w
+	}
+	return pool[len(pool)-1], nil
+}
+
+// staticWeightSelector is smooth weighted round-robin over the proxies'
+// configured weights: on every pick each proxy in the pool earns its
+// weight, and the richest one is picked and pays back the pool's total.
+// With weights 3 and 1 that gives a a b a rather than a a a b.
+type staticWeightSelector struct {
+	r       *Rotator
+	current map[*Proxy]int
+}
+
+func (s *staticWeightSelector) Select(pool []*Proxy) (*Proxy, error) {
+	if len(s.current) > len(s.r.proxies) {
+		s.prune()
+	}
+	var best *Proxy
+	total := 0
+	for _, p := range pool {
+		w := max(p.Weight, 1)
+		total += w
+		s.current[p] += w
+		if best == nil || s.current[p] > s.current[best] {
+			best = p
+		}
+	}
+	s.current[best] -= total
+	return best, nil
+}
+
+// prune forgets proxies that have left the rotator.
+func (s *staticWeightSelector) prune() {
+	keep := make(map[*Proxy]bool, len(s.r.proxies))
+	for _, p := range s.r.proxies {
+		keep[p] = true
+	}
+	for p := range s.current {
+		if !keep[p] {
+			delete(s.current, p)
+		}
+	}
+}
@@ -0,0 +1,315 @@
+package proxy
+
+import (
+	"math"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// newTestRotator returns a rotator picking afresh on every call from the
+// proxies in urls.
+func newTestRotator(t *testing.T, strategy RotationStrategy, urls ...string) *Rotator {
+	t.Helper()
+	r := NewRotator(strategy, false, 0)
+	r.SetSeed(1)
+	if _, err := r.AddFromStrings(urls); err != nil {
+		t.Fatal(err)
+	}
+	return r
+}
+
+// countPicks calls Next n times and counts each proxy's picks.
+func countPicks(t *testing.T, r *Rotator, n int) map[*Proxy]int {
+	t.Helper()
+	counts := make(map[*Proxy]int)
+	for range n {
+		p, err := r.Next()
+		if err != nil {
+			t.Fatal(err)
+		}
+		counts[p]++
+	}
+	return counts
+}
+
+func TestWeightedSelectorTracksWeights(t *testing.T) {
+	r := newTestRotator(t, RotationWeighted, "http://a:1", "http://b:1", "http://c:1")
+	proxies := r.GetProxies()
+	// a is fast and reliable, b slow, c fast but failing half the time.
+	for range 20 {
+		proxies[0].RecordRequest(50 * time.Millisecond)
+		proxies[1].RecordRequest(400 * time.Millisecond)
+		proxies[2].RecordRequest(50 * time.Millisecond)
+		proxies[2].RecordFailure()
+	}
+
+	var total float64
+	for _, p := range proxies {
+		total += weight(p)
+	}
+	if !(weight(proxies[0]) > weight(proxies[2]) && weight(proxies[2]) > weight(proxies[1])) {
+		t.Fatalf("weights a=%.2f b=%.2f c=%.2f, want a > c > b",
+			weight(proxies[0]), weight(proxies[1]), weight(proxies[2]))
+	}
+
+	const n = 50000
+	counts := countPicks(t, r, n)
+	for _, p := range proxies {
+		want := weight(p) / total
+		got := float64(counts[p]) / n
+		if math.Abs(got-want) > 0.01 {
+			t.Errorf("%s got %.3f of picks, want %.3f", p, got, want)
+		}
+	}
+}
+
+func TestWeightedSelectorUnsampledEven(t *testing.T) {
+	r := newTestRotator(t, RotationWeighted, "http://a:1", "http://b:1", "http://c:1", "http://d:1")
+	const n = 40000
+	counts := countPicks(t, r, n)
+	for _, p := range r.GetProxies() {
+		if got := float64(counts[p]) / n; math.Abs(got-0.25) > 0.01 {
+			t.Errorf("%s got %.3f of picks, want 0.25", p, got)
+		}
+	}
+}
+
+func TestStaticWeightSelectorSequence(t *testing.T) {
+	tests := []struct {
+		urls []string
+		want string
+	}{
+		{[]string{"http://a:1?weight=3", "http://b:1"}, "aaba"},
+		{[]string{"http://a:1?weight=5", "http://b:1", "http://c:1"}, "aabacaa"},
+		{[]string{"http://a:1?weight=2", "http://b:1?weight=2"}, "abab"},
+		{[]string{"http://a:1", "http://b:1", "http://c:1"}, "abc"},
+	}
+	for _, tt := range tests {
+		r := newTestRotator(t, RotationStaticWeighted, tt.urls...)
+		// Two cycles: the sequence must repeat exactly.
+		var got []byte
+		for range 2 * len(tt.want) {
+			p, err := r.Next()
+			if err != nil {
+				t.Fatal(err)
+			}
+			got = append(got, p.Host[0])
+		}
+		if want := tt.want + tt.want; string(got) != want {
+			t.Errorf("%v picked %s, want %s", tt.urls, got, want)
+		}
+	}
+}
+
+func TestStaticWeightSelectorShares(t *testing.T) {
+	r := NewRotator(RotationStaticWeighted, true, 0)
+	list := "http://a:1?weight=3\nhttp://b:1\nhttp://c:1?weight=2\n"
+	if _, err := r.LoadFromReader(strings.NewReader(list)); err != nil {
+		t.Fatal(err)
+	}
+	proxies := r.GetProxies()
+	// Measured latency and failures must not shift static weights.
+	for range 20 {
+		proxies[0].RecordRequest(2 * time.Second)
+		proxies[0].RecordFailure()
+	}
+
+	// Every window of one cycle (6 picks) holds each proxy's exact share.
+	got := picks(t, r, 600)
+	for i := 0; i+6 <= len(got); i += 6 {
+		w := got[i : i+6]
+		if strings.Count(w, "a") != 3 || strings.Count(w, "b") != 1 || strings.Count(w, "c") != 2 {
+			t.Fatalf("picks %d-%d were %s, want 3 a, 1 b and 2 c", i+1, i+6, w)
+		}
+	}
+
+	// A dead proxy's share goes to the others in proportion.
+	r.MarkDead(proxies[2])
+	got = picks(t, r, 400)
+	if a, b := strings.Count(got, "a"), strings.Count(got, "b"); a != 300 || b != 100 {
+		t.Errorf("with c dead: a %d, b %d picks; want 300 and 100", a, b)
+	}
+}
+
+func TestRoundRobinConcurrentEven(t *testing.T) {
+	// requestsPer is ignored by round-robin, so a burst is spread evenly.
+	r := NewRotator(RotationRoundRobin, false, 10)
+	if _, err := r.AddFromStrings([]string{"http://a:1", "http://b:1", "http://c:1", "http://d:1"}); err != nil {
+		t.Fatal(err)
+	}
+
+	const perProxy = 250
+	var mu sync.Mutex
+	counts := make(map[*Proxy]int)
+	var wg sync.WaitGroup
+	for range 4 * perProxy {
+		wg.Go(func() {
+			p, err := r.Next()
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			mu.Lock()
+			counts[p]++
+			mu.Unlock()
+		})
+	}
+	wg.Wait()
+	for _, p := range r.GetProxies() {
+		if counts[p] != perProxy {
+			t.Errorf("%s got %d picks, want %d", p, counts[p], perProxy)
+		}
+	}
+}
+
+func TestSequentialStaysForRequestsPer(t *testing.T) {
+	r := NewRotator(RotationSequential, false, 3)
+	if _, err := r.AddFromStrings([]string{"http://a:1", "http://b:1"}); err != nil {
+		t.Fatal(err)
+	}
+	var got []byte
+	for range 8 {
+		p, err := r.Next()
+		if err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, p.Host[0])
+	}
+	if string(got) != "aaabbbaa" {
+		t.Errorf("sequential picked %s, want aaabbbaa", got)
+	}
+}
+
+func TestRequestsPerRegimes(t *testing.T) {
+	tests := []struct {
+		requestsPer int
+		want        string // Picks, with b marked dead at the bar
+	}{
+		{0, "abcab|cacac"},
+		{1, "abcab|cacac"},
+		{2, "aabbc|caacc"},
+		{-1, "aaaaa|aaaaa"},
+	}
+	for _, tt := range tests {
+		r := NewRotator(RotationSequential, true, tt.requestsPer)
+		if _, err := r.AddFromStrings([]string{"http://a:1", "http://b:1", "http://c:1"}); err != nil {
+			t.Fatal(err)
+		}
+		got := picks(t, r, 5)
+		r.MarkDead(r.GetProxies()[1])
+		got += "|" + picks(t, r, 5)
+		if got != tt.want {
+			t.Errorf("requestsPer %d picked %s, want %s", tt.requestsPer, got, tt.want)
+		}
+	}
+}
+
+func TestRequestsPerZeroKeepsNoCurrent(t *testing.T) {
+	// 0 differs from 1 in never tracking a current proxy at all.
+	r := NewRotator(RotationRandom, true, 0)
+	r.SetSeed(1)
+	if _, err := r.AddFromStrings([]string{"http://a:1", "http://b:1"}); err != nil {
+		t.Fatal(err)
+	}
+	picks(t, r, 10)
+	if r.current != nil {
+		t.Errorf("current = %s after Next with requestsPer 0, want nil", r.current)
+	}
+}
+
+func TestRequestsPerAutoStaysUntilDead(t *testing.T) {
+	r := NewRotator(RotationRandom, true, -1)
+	r.SetSeed(1)
+	if _, err := r.AddFromStrings([]string{"http://a:1", "http://b:1", "http://c:1"}); err != nil {
+		t.Fatal(err)
+	}
+	first, err := r.Next()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for range 20 {
+		if p, _ := r.Next(); p != first {
+			t.Fatalf("auto moved from %s to %s while it was alive", first, p)
+		}
+	}
+	r.MarkDead(first)
+	if p, _ := r.Next(); p == first {
+		t.Errorf("auto stayed on dead %s", first)
+	}
+}
+
+// picks calls Next n times and returns the first letters of the picked
+// hosts.
+func picks(t *testing.T, r *Rotator, n int) string {
+	t.Helper()
+	var got []byte
+	for range n {
+		p, err := r.Next()
+		if err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, p.Host[0])
+	}
+	return string(got)
+}
+
+func TestOrderSelectorFairWhenProxiesDie(t *testing.T) {
+	for _, strategy := range []RotationStrategy{RotationSequential, RotationRoundRobin} {
+		r := NewRotator(strategy, true, 1)
+		if _, err := r.AddFromStrings([]string{"http://a:1", "http://b:1", "http://c:1", "http://d:1", "http://e:1"}); err != nil {
+			t.Fatal(err)
+		}
+		byHost := make(map[string]*Proxy)
+		for _, p := range r.GetProxies() {
+			byHost[p.Host] = p
+		}
+
+		got := picks(t, r, 2)
+		r.MarkDead(byHost["c"])
+		got += "|" + picks(t, r, 5)
+		r.MarkAlive(byHost["c"])
+		r.MarkDead(byHost["d"])
+		got += "|" + picks(t, r, 5)
+		r.RemoveProxy("http://e:1")
+		got += "|" + picks(t, r, 4)
+		if want := "ab|deabd|eabce|abca"; got != want {
+			t.Errorf("%s picked %s, want %s", strategy, got, want)
+		}
+	}
+}
+
+func TestSeedMakesRandomReproducible(t *testing.T) {
+	urls := []string{"http://a:1", "http://b:1", "http://c:1", "http://d:1", "http://e:1", "http://f:1"}
+	run := func(strategy RotationStrategy, seed uint64) string {
+		r := NewRotator(strategy, false, 0)
+		r.SetSeed(seed)
+		if _, err := r.AddFromStrings(urls); err != nil {
+			t.Fatal(err)
+		}
+		return picks(t, r, 30)
+	}
+	for _, strategy := range []RotationStrategy{RotationRandom, RotationWeighted} {
+		a, b := run(strategy, 42), run(strategy, 42)
+		if a != b {
+			t.Errorf("%s with one seed picked %s, then %s", strategy, a, b)
+		}
+		if c := run(strategy, 43); c == a {
+			t.Errorf("%s picked %s under seeds 42 and 43", strategy, a)
+		}
+	}
+}
+
+func TestRandomSelectorDealsEveryProxy(t *testing.T) {
+	r := newTestRotator(t, RotationRandom, "http://a:1", "http://b:1", "http://c:1", "http://d:1")
+	got := picks(t, r, 40)
+	for i := 0; i < len(got); i += 4 {
+		deal := []byte(got[i : i+4])
+		slices.Sort(deal)
+		if string(deal) != "abcd" {
+			t.Errorf("picks %d-%d were %s, want each proxy once", i+1, i+4, got[i:i+4])
+		}
+	}
+}
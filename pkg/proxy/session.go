@@ -0,0 +1,86 @@
+package proxy
+
+import (
+	"slices"
+	"time"
+)
+
+// DefaultSessionTTL is how long an unused session keeps its proxy unless
+// SetSessionTTL says otherwise.
+const DefaultSessionTTL = 10 * time.Minute
+
+// session is a client-chosen token's binding to a proxy.
+type session struct {
+	proxy    *Proxy
+	lastUsed time.Time
+}
+
+// SetSessionTTL sets how long a session may go unused before
+// NextForSession forgets its proxy. Zero restores DefaultSessionTTL.
+func (r *Rotator) SetSessionTTL(ttl time.Duration) {
+	r.mu.Lock()
+	r.sessionTTL = ttl
+	r.mu.Unlock()
+}
+
+// NextForSession returns the proxy bound to token, binding one picked as
+// by Next the first time the token is seen or once it has gone unused for
+// the session TTL. Every request with the token leaves through that proxy
+// until it dies, fills up, is removed or is in exclude; then the session
+// moves to a new pick. Requests without a session are not held to the
+// session's proxy.
+func (r *Rotator) NextForSession(token string, exclude ...*Proxy) (*Proxy, error) {
+	r.mu.Lock()
+	p, err := r.nextForSession(token, exclude)
+	o := r.observer
+	r.mu.Unlock()
+	if o != nil && p != nil {
+		o.OnSelect(p)
+	}
+	return p, err
+}
+
+func (r *Rotator) nextForSession(token string, exclude []*Proxy) (*Proxy, error) {
+	now := time.Now()
+	ttl := r.sessionTTL
+	if ttl <= 0 {
+		ttl = DefaultSessionTTL
+	}
+	if s, ok := r.sessions[token]; ok && now.Sub(s.lastUsed) < ttl {
+		// Compare pointers: a proxy removed and added again is a new
+		// entry, and the session must not go on using the old one.
+		p := s.proxy
+		if r.seen[p.String()] == p && p.IsAlive() && !r.full(p) && !slices.Contains(exclude, p) {
+			s.lastUsed = now
+			return p, nil
+		}
+	}
+
+	p, err := r.pick("", exclude)
+	if err != nil {
+		return nil, err
+	}
+	if r.sessions == nil {
+		r.sessions = make(map[string]*session)
+	}
+	if len(r.sessions) >= r.sessionGC {
+		for k, s := range r.sessions {
+			if now.Sub(s.lastUsed) >= ttl {
+				delete(r.sessions, k)
+			}
+		}
+		r.sessionGC = max(64, 2*len(r.sessions))
+	}
+	r.sessions[token] = &session{proxy: p, lastUsed: now}
+	return p, nil
+}
+
+// dropSessions forgets the sessions bound to p, which is leaving the pool,
+// so they pick a proxy afresh instead of holding on to it.
+func (r *Rotator) dropSessions(p *Proxy) {
+	for token, s := range r.sessions {
+		if s.proxy == p {
+			delete(r.sessions, token)
+		}
+	}
+}
@@ -0,0 +1,90 @@
+package proxy
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNextForSessionKeepsProxy(t *testing.T) {
+	r := newTestRotator(t, RotationRoundRobin, "http://a:1", "http://b:1", "http://c:1")
+	first, err := r.NextForSession("tok")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for range 5 {
+		r.Next() // Rotation goes on without the session.
+		if p, _ := r.NextForSession("tok"); p != first {
+			t.Fatalf("session moved from %s to %s", first, p)
+		}
+	}
+	if p, _ := r.NextForSession("tok", first); p == first {
+		t.Errorf("session kept excluded proxy %s", p)
+	}
+}
+
+func TestRemoveProxyDropsSessions(t *testing.T) {
+	r := newTestRotator(t, RotationRoundRobin, "http://a:1", "http://b:1")
+	p, err := r.NextForSession("tok")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !r.RemoveProxy(p.String()) {
+		t.Fatalf("RemoveProxy(%s) found nothing", p)
+	}
+	r.mu.Lock()
+	n := len(r.sessions)
+	r.mu.Unlock()
+	if n != 0 {
+		t.Errorf("%d sessions left bound to a removed proxy", n)
+	}
+	if q, _ := r.NextForSession("tok"); q == p {
+		t.Errorf("session still uses removed proxy %s", p)
+	}
+}
+
+func TestReloadDropsSessionsOfRemovedProxies(t *testing.T) {
+	r := NewRotator(RotationRoundRobin, false, 0)
+	if _, err := r.loadFrom(strings.NewReader("http://a:1\nhttp://b:1\n"), "list"); err != nil {
+		t.Fatal(err)
+	}
+	pa, _ := r.NextForSession("ta")
+	pb, _ := r.NextForSession("tb")
+	kept, err := NewProxy(pa.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.reload("list", []*Proxy{kept})
+	r.mu.Lock()
+	_, okA := r.sessions["ta"]
+	_, okB := r.sessions["tb"]
+	r.mu.Unlock()
+	if !okA || okB {
+		t.Errorf("after reload keeping %s: session ta kept %v, tb (on %s) kept %v", kept, okA, pb, okB)
+	}
+}
+
+func TestNextForSessionSkipsStaleProxy(t *testing.T) {
+	r := newTestRotator(t, RotationRoundRobin, "http://a:1")
+	old, err := r.NextForSession("tok")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.RemoveProxy(old.String())
+	if _, err := r.AddFromStrings([]string{old.String()}); err != nil {
+		t.Fatal(err)
+	}
+	// Bind the session to the removed entry again, as a binding made
+	// while the proxy was leaving would be.
+	r.mu.Lock()
+	r.sessions["tok"] = &session{proxy: old, lastUsed: time.Now()}
+	r.mu.Unlock()
+
+	p, err := r.NextForSession("tok")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p == old || p != r.GetProxies()[0] {
+		t.Errorf("session used %p, want the re-added entry %p", p, r.GetProxies()[0])
+	}
+}
@@ -0,0 +1,81 @@
+package proxy
+
+import (
+	"fmt"
+	"hash/fnv"
+	"slices"
+)
+
+// NextForTarget returns the proxy assigned to host by rendezvous hashing,
+// so requests for one host keep leaving through the same proxy while it is
+// alive. Adding or removing a proxy only moves the hosts that hash to it.
+// When the assigned proxy is dead or at its connection limit, the host's
+// next-ranked proxy is used; dead proxies are only returned if skipDead is
+// off and no live one is left. Proxies in exclude are passed over, so a
+// caller can retry with the next choice. Next's rotation is unaffected.
+func (r *Rotator) NextForTarget(host string, exclude ...*Proxy) (*Proxy, error) {
+	r.mu.Lock()
+	p, err := r.nextForTarget(host, exclude)
+	o := r.observer
+	r.mu.Unlock()
+	if o != nil && p != nil {
+		o.OnSelect(p)
+	}
+	return p, err
+}
+
+func (r *Rotator) nextForTarget(host string, exclude []*Proxy) (*Proxy, error) {
+	var best, fallback *Proxy
+	var bestScore, fallbackScore uint64
+	busy, dead := false, false
+	for _, p := range r.proxies {
+		if slices.Contains(exclude, p) {
+			continue
+		}
+		if r.full(p) {
+			busy = true
+			continue
+		}
+		score := rendezvousScore(host, p)
+		if p.IsAlive() {
+			if best == nil || score > bestScore {
+				best, bestScore = p, score
+			}
+			continue
+		}
+		dead = true
+		if !r.skipDead && (fallback == nil || score > fallbackScore) {
+			fallback, fallbackScore = p, score
+		}
+	}
+	if best == nil {
+		best = fallback
+	}
+	if best == nil {
+		switch {
+		case busy:
+			return nil, ErrAllProxiesBusy
+		case dead:
+			return nil, ErrAllProxiesDead
+		}
+		return nil, fmt.Errorf("no proxies available")
+	}
+	return best, nil
+}
+
+// rendezvousScore ranks p for host; the highest-scoring proxy wins.
+func rendezvousScore(host string, p *Proxy) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(host))
+	h.Write([]byte{0})
+	h.Write([]byte(p.String()))
+	// FNV mixes its last bytes poorly, so finish with a 64-bit mixer to
+	// spread hosts evenly.
+	x := h.Sum64()
+	x ^= x >> 33
+	x *= 0xff51afd7ed558ccd
+	x ^= x >> 33
+	x *= 0xc4ceb9fe1a85ec53
+	x ^= x >> 33
+	return x
+}
@@ -0,0 +1,84 @@
+package proxy
+
+import (
+	"fmt"
+	"testing"
+)
+
+// assign maps each of n hosts to its proxy from NextForTarget.
+func assign(t *testing.T, r *Rotator, n int) map[string]*Proxy {
+	t.Helper()
+	m := make(map[string]*Proxy, n)
+	for i := range n {
+		host := fmt.Sprintf("site%d.example", i)
+		p, err := r.NextForTarget(host)
+		if err != nil {
+			t.Fatal(err)
+		}
+		m[host] = p
+	}
+	return m
+}
+
+func TestNextForTargetStableOnRemove(t *testing.T) {
+	r := newTestRotator(t, RotationRandom, "http://a:1", "http://b:1", "http://c:1", "http://d:1", "http://e:1")
+	before := assign(t, r, 1000)
+
+	perProxy := make(map[*Proxy]int)
+	for _, p := range before {
+		perProxy[p]++
+	}
+	for _, p := range r.GetProxies() {
+		if n := perProxy[p]; n < 150 || n > 250 {
+			t.Errorf("%s got %d of 1000 hosts, want about 200", p, n)
+		}
+	}
+
+	removed := before["site0.example"]
+	r.RemoveProxy(removed.String())
+	after := assign(t, r, 1000)
+	for host, p := range before {
+		switch {
+		case p == removed && after[host] == removed:
+			t.Errorf("%s still assigned to removed %s", host, p)
+		case p != removed && after[host] != p:
+			t.Errorf("%s moved from %s to %s though its proxy stayed", host, p, after[host])
+		}
+	}
+
+	// Adding it back restores the original assignment.
+	r.AddProxy(removed)
+	for host, p := range assign(t, r, 1000) {
+		if p != before[host] {
+			t.Errorf("%s assigned to %s after re-adding, want %s", host, p, before[host])
+		}
+	}
+}
+
+func TestNextForTargetSkipsDeadAndExcluded(t *testing.T) {
+	r := NewRotator(RotationRandom, true, 0)
+	if _, err := r.AddFromStrings([]string{"http://a:1", "http://b:1", "http://c:1"}); err != nil {
+		t.Fatal(err)
+	}
+	first, _ := r.NextForTarget("example.com")
+	second, _ := r.NextForTarget("example.com", first)
+	if second == first {
+		t.Fatalf("excluding %s returned it again", first)
+	}
+
+	r.MarkDead(first)
+	if p, _ := r.NextForTarget("example.com"); p != second {
+		t.Errorf("with %s dead got %s, want next-ranked %s", first, p, second)
+	}
+	r.MarkAlive(first)
+	if p, _ := r.NextForTarget("example.com"); p != first {
+		t.Errorf("after %s revived got %s", first, p)
+	}
+
+	for _, p := range r.GetProxies() {
+		r.MarkDead(p)
+	}
+	if _, err := r.NextForTarget("example.com"); err != ErrAllProxiesDead {
+		t.Errorf("all dead: err = %v, want ErrAllProxiesDead", err)
+	}
+}
@@ -2,8 +2,13 @@ package proxy
 
 import (
 	"fmt"
+	"io"
+	"net"
+	"net/netip"
 	"net/url"
+	"strconv"
 	"strings"
+	"sync"
 	"sync/atomic"
 	"time"
 )
@@ -15,6 +20,7 @@ const (
 	ProxyTypeHTTPS
 	ProxyTypeSOCKS4
 	ProxyTypeSOCKS5
+	ProxyTypeSOCKS4A
 )
 
 func (t ProxyType) String() string {
@@ -27,6 +33,8 @@ func (t ProxyType) String() string {
 		return "SOCKS4"
 	case ProxyTypeSOCKS5:
 		return "SOCKS5"
+	case ProxyTypeSOCKS4A:
+		return "SOCKS4A"
 	default:
 		return "UNKNOWN"
 	}
@@ -38,19 +46,70 @@ type Proxy struct {
 	Port     string
 	Username string
 	Password string
+	Via      []*Proxy // Hops to tunnel through, in order, before reaching this proxy
+
+	// RemoteDNS is set for "socks5h://" proxies, which are always sent
+	// target hostnames, even when the dialer resolves locally.
+	RemoteDNS bool
+
+	// Options from the URL query, e.g. "?weight=5&region=us&max=10&timeout=3s".
+	// Unknown parameters are ignored.
+	Weight   int           // Relative share of traffic for static weighting, default 1
+	Tag      string        // Region or other label from "region=" or "tag="
+	MaxConns int           // Concurrent connection limit, 0 uses the rotator default
+	Timeout  time.Duration // Dial timeout override, 0 uses the dialer default
+	BindAddr netip.Addr    // Local address to dial from, from "bind="; zero uses the dialer's
 
 	requests  atomic.Int64
 	failures  atomic.Int64
+	active    atomic.Int64
 	totalTime atomic.Int64
 	alive     atomic.Bool
+	bytesUp   atomic.Int64
+	bytesDown atomic.Int64
+	exit      atomic.Pointer[exitIP]
+	broken    atomic.Int64 // Relays in a row that failed after connecting
+
+	connsMu sync.Mutex
+	conns   map[*[]io.Closer]struct{} // Registered with Track
+
+	// recent is a ring of the last latencyHistory request latencies;
+	// recentN counts every sample written to it.
+	recent  [latencyHistory]atomic.Int64
+	recentN atomic.Uint64
+	latency latencyHistogram
+}
+
+// latencyHistory is how many recent latencies each proxy keeps.
+const latencyHistory = 16
+
+// exitIP is the public address a proxy's traffic was last seen leaving from.
+type exitIP struct {
+	ip string
+	at time.Time
 }
 
+// DefaultScheme is the proxy type assumed for entries written without a
+// scheme, as "host:port" or "host:port:user:pass".
+var DefaultScheme = "http"
+
+// NewProxy parses a proxy URL. A chain of proxies is written as URLs
+// separated by '>', e.g. "socks5://a:1080 > http://b:8080"; the returned
+// proxy is the last hop with the earlier ones in Via.
 func NewProxy(rawURL string) (*Proxy, error) {
 	rawURL = strings.TrimSpace(rawURL)
 	if rawURL == "" {
 		return nil, fmt.Errorf("empty proxy URL")
 	}
 
+	if strings.Contains(rawURL, ">") {
+		return newChain(strings.Split(rawURL, ">"))
+	}
+
+	if !strings.Contains(rawURL, "://") {
+		return newColonProxy(rawURL)
+	}
+
 	u, err := url.Parse(rawURL)
 	if err != nil {
 		return nil, fmt.Errorf("invalid proxy URL: %w", err)
@@ -61,9 +120,11 @@ func NewProxy(rawURL string) (*Proxy, error) {
 		return nil, fmt.Errorf("missing hostname")
 	}
 
+	// Hostnames are case-insensitive; normalize so String() dedupes them.
 	p := &Proxy{
-		Host: host,
-		Port: u.Port(),
+		Host:   strings.ToLower(host),
+		Port:   u.Port(),
+		Weight: 1,
 	}
 	p.alive.Store(true)
 
@@ -72,6 +133,10 @@ func NewProxy(rawURL string) (*Proxy, error) {
 		p.Password, _ = u.User.Password()
 	}
 
+	if err := p.parseOptions(u.Query()); err != nil {
+		return nil, err
+	}
+
 	switch strings.ToLower(u.Scheme) {
 	case "http":
 		p.Type = ProxyTypeHTTP
@@ -88,35 +153,324 @@ func NewProxy(rawURL string) (*Proxy, error) {
 		if p.Port == "" {
 			p.Port = "1080"
 		}
-	case "socks5":
+	case "socks4a":
+		p.Type = ProxyTypeSOCKS4A
+		if p.Port == "" {
+			p.Port = "1080"
+		}
+	case "socks5", "socks5h", "socks":
 		p.Type = ProxyTypeSOCKS5
+		p.RemoteDNS = strings.EqualFold(u.Scheme, "socks5h")
 		if p.Port == "" {
 			p.Port = "1080"
 		}
 	default:
-		return nil, fmt.Errorf("unsupported proxy scheme: %s", u.Scheme)
+		return nil, fmt.Errorf("unsupported proxy scheme %q (want http, https, socks4, socks4a, socks5, socks5h or socks)", u.Scheme)
 	}
 
 	return p, nil
 }
 
+func (p *Proxy) parseOptions(q url.Values) error {
+	if v := q.Get("weight"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			return fmt.Errorf("invalid weight: %s", v)
+		}
+		p.Weight = n
+	}
+
+	if v := q.Get("region"); v != "" {
+		p.Tag = v
+	} else if v := q.Get("tag"); v != "" {
+		p.Tag = v
+	}
+
+	if v := q.Get("max"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			return fmt.Errorf("invalid max: %s", v)
+		}
+		p.MaxConns = n
+	}
+
+	if v := q.Get("timeout"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			// A bare number is taken as seconds, like -dial-timeout.
+			n, nerr := strconv.Atoi(v)
+			if nerr != nil {
+				return fmt.Errorf("invalid timeout: %s", v)
+			}
+			d = time.Duration(n) * time.Second
+		}
+		if d <= 0 {
+			return fmt.Errorf("invalid timeout: %s", v)
+		}
+		p.Timeout = d
+	}
+
+	if v := q.Get("bind"); v != "" {
+		ip, err := netip.ParseAddr(v)
+		if err != nil {
+			return fmt.Errorf("invalid bind: %s", v)
+		}
+		p.BindAddr = ip
+	}
+
+	return nil
+}
+
+// newColonProxy parses the vendor list format "host:port" or
+// "host:port:user:pass" using DefaultScheme. The password may itself
+// contain colons.
+func newColonProxy(s string) (*Proxy, error) {
+	fields := strings.SplitN(s, ":", 4)
+	u := url.URL{Scheme: DefaultScheme}
+	switch len(fields) {
+	case 2:
+	case 4:
+		u.User = url.UserPassword(fields[2], fields[3])
+	default:
+		return nil, fmt.Errorf("invalid proxy: want scheme://host:port, host:port or host:port:user:pass")
+	}
+	if fields[0] == "" || fields[1] == "" {
+		return nil, fmt.Errorf("invalid proxy: missing host or port")
+	}
+	u.Host = net.JoinHostPort(fields[0], fields[1])
+	return NewProxy(u.String())
+}
+
+func newChain(hops []string) (*Proxy, error) {
+	chain := make([]*Proxy, 0, len(hops))
+	for i, hop := range hops {
+		p, err := NewProxy(hop)
+		if err != nil {
+			return nil, fmt.Errorf("chain hop %d: %w", i+1, err)
+		}
+		chain = append(chain, p)
+	}
+	last := chain[len(chain)-1]
+	last.Via = chain[:len(chain)-1]
+	return last, nil
+}
+
 func (p *Proxy) Address() string {
-	return p.Host + ":" + p.Port
+	return net.JoinHostPort(p.Host, p.Port)
+}
+
+// Chain returns every hop needed to reach the target through p, ending with p.
+func (p *Proxy) Chain() []*Proxy {
+	chain := make([]*Proxy, 0, len(p.Via)+1)
+	chain = append(chain, p.Via...)
+	return append(chain, p)
+}
+
+// FirstHop returns the proxy that is dialed directly.
+func (p *Proxy) FirstHop() *Proxy {
+	if len(p.Via) > 0 {
+		return p.Via[0]
+	}
+	return p
 }
 
+// String identifies p for deduplication, logs and metrics. The username is
+// included since vendors often serve different sessions or exits on one
+// endpoint by username; the password never is. socks5h proxies keep their
+// scheme, so they are not merged with socks5 ones for the same endpoint.
 func (p *Proxy) String() string {
-	return fmt.Sprintf("%s://%s:%s", strings.ToLower(p.Type.String()), p.Host, p.Port)
+	var user string
+	if p.Username != "" {
+		user = url.User(p.Username).String() + "@"
+	}
+	scheme := strings.ToLower(p.Type.String())
+	if p.RemoteDNS {
+		scheme = "socks5h"
+	}
+	s := fmt.Sprintf("%s://%s%s", scheme, user, p.Address())
+	if len(p.Via) == 0 {
+		return s
+	}
+	hops := make([]string, 0, len(p.Via)+1)
+	for _, hop := range p.Via {
+		hops = append(hops, hop.String())
+	}
+	return strings.Join(append(hops, s), " > ")
+}
+
+// URL returns p in a form NewProxy parses back to the same proxy,
+// password and options included. Unlike String it holds secrets, so use it
+// for writing proxy lists rather than for display.
+func (p *Proxy) URL() string {
+	u := url.URL{
+		Scheme: strings.ToLower(p.Type.String()),
+		Host:   p.Address(),
+	}
+	if p.RemoteDNS {
+		u.Scheme = "socks5h"
+	}
+	if p.Username != "" || p.Password != "" {
+		u.User = url.UserPassword(p.Username, p.Password)
+	}
+	q := url.Values{}
+	if p.Weight > 1 {
+		q.Set("weight", strconv.Itoa(p.Weight))
+	}
+	if p.Tag != "" {
+		q.Set("tag", p.Tag)
+	}
+	if p.MaxConns > 0 {
+		q.Set("max", strconv.Itoa(p.MaxConns))
+	}
+	if p.Timeout > 0 {
+		q.Set("timeout", p.Timeout.String())
+	}
+	if p.BindAddr.IsValid() {
+		q.Set("bind", p.BindAddr.String())
+	}
+	u.RawQuery = q.Encode()
+
+	if len(p.Via) == 0 {
+		return u.String()
+	}
+	hops := make([]string, 0, len(p.Via)+1)
+	for _, hop := range p.Via {
+		hops = append(hops, hop.URL())
+	}
+	return strings.Join(append(hops, u.String()), " > ")
 }
 
 func (p *Proxy) RecordRequest(latency time.Duration) {
 	p.requests.Add(1)
 	p.totalTime.Add(int64(latency))
+	i := p.recentN.Add(1) - 1
+	p.recent[i%latencyHistory].Store(int64(latency))
+	p.latency.observe(latency)
+}
+
+// RecentLatencies returns the latencies of up to the last 16 successful
+// requests, oldest first.
+func (p *Proxy) RecentLatencies() []time.Duration {
+	n := p.recentN.Load()
+	k := min(n, latencyHistory)
+	out := make([]time.Duration, k)
+	for j := range k {
+		out[j] = time.Duration(p.recent[(n-k+j)%latencyHistory].Load())
+	}
+	return out
 }
 
 func (p *Proxy) RecordFailure() {
 	p.failures.Add(1)
 }
 
+// RecordRelayFailure counts a relay through p that broke after
+// connecting as a failure and returns how many have in a row.
+func (p *Proxy) RecordRelayFailure() int64 {
+	p.failures.Add(1)
+	return p.broken.Add(1)
+}
+
+// RecordRelaySuccess notes that a relay through p ended normally, which
+// ends any run of broken ones.
+func (p *Proxy) RecordRelaySuccess() {
+	p.broken.Store(0)
+}
+
+// RecordBytes adds to the bytes relayed through p: up is sent by clients
+// toward targets, down the replies.
+func (p *Proxy) RecordBytes(up, down int64) {
+	if up != 0 {
+		p.bytesUp.Add(up)
+	}
+	if down != 0 {
+		p.bytesDown.Add(down)
+	}
+}
+
+// Bytes returns the totals recorded by RecordBytes.
+func (p *Proxy) Bytes() (up, down int64) {
+	return p.bytesUp.Load(), p.bytesDown.Load()
+}
+
+// SetExitIP records the public address p's traffic leaves from, as
+// reported by an IP echo service.
+func (p *Proxy) SetExitIP(ip string) {
+	p.exit.Store(&exitIP{ip: ip, at: time.Now()})
+}
+
+// ExitIP returns the address from SetExitIP and when it was recorded, or
+// an empty string if it was never looked up.
+func (p *Proxy) ExitIP() (ip string, at time.Time) {
+	if e := p.exit.Load(); e != nil {
+		return e.ip, e.at
+	}
+	return "", time.Time{}
+}
+
+// Acquire records a connection through p; pair it with Release.
+func (p *Proxy) Acquire() {
+	p.active.Add(1)
+}
+
+// tryAcquire is Acquire unless p already has limit connections. A limit
+// of zero or less means no limit.
+func (p *Proxy) tryAcquire(limit int64) bool {
+	for {
+		n := p.active.Load()
+		if limit > 0 && n >= limit {
+			return false
+		}
+		if p.active.CompareAndSwap(n, n+1) {
+			return true
+		}
+	}
+}
+
+func (p *Proxy) Release() {
+	p.active.Add(-1)
+}
+
+// Track registers the connections of one relay through p, so CloseConns
+// can cut it off; call the returned function when the relay ends.
+func (p *Proxy) Track(conns ...io.Closer) (untrack func()) {
+	key := &conns
+	p.connsMu.Lock()
+	if p.conns == nil {
+		p.conns = make(map[*[]io.Closer]struct{})
+	}
+	p.conns[key] = struct{}{}
+	p.connsMu.Unlock()
+	return func() {
+		p.connsMu.Lock()
+		delete(p.conns, key)
+		p.connsMu.Unlock()
+	}
+}
+
+// CloseConns closes every connection registered with Track and returns
+// how many relays it cut off.
+func (p *Proxy) CloseConns() int {
+	p.connsMu.Lock()
+	relays := make([]*[]io.Closer, 0, len(p.conns))
+	for key := range p.conns {
+		relays = append(relays, key)
+	}
+	clear(p.conns)
+	p.connsMu.Unlock()
+	for _, conns := range relays {
+		for _, c := range *conns {
+			c.Close()
+		}
+	}
+	return len(relays)
+}
+
+// ActiveConns returns the number of connections currently through p.
+func (p *Proxy) ActiveConns() int64 {
+	return p.active.Load()
+}
+
 func (p *Proxy) MarkDead() {
 	p.alive.Store(false)
 }
@@ -129,6 +483,25 @@ func (p *Proxy) IsAlive() bool {
 	return p.alive.Load()
 }
 
+// ResetStats zeroes p's request, failure, latency and byte counters. Its
+// alive state, active connections and exit IP are kept.
+func (p *Proxy) ResetStats() {
+	p.requests.Store(0)
+	p.failures.Store(0)
+	p.totalTime.Store(0)
+	p.bytesUp.Store(0)
+	p.bytesDown.Store(0)
+	p.recentN.Store(0)
+	p.latency.reset()
+}
+
+func (p *Proxy) restoreStats(requests, failures int64, totalTime time.Duration, alive bool) {
+	p.requests.Store(requests)
+	p.failures.Store(failures)
+	p.totalTime.Store(int64(totalTime))
+	p.alive.Store(alive)
+}
+
 func (p *Proxy) Stats() (requests, failures int64, avgLatency time.Duration) {
 	requests = p.requests.Load()
 	failures = p.failures.Load()
@@ -0,0 +1,91 @@
+package proxy
+
+import (
+	"os"
+	"sync"
+	"time"
+)
+
+// FileWatcher polls a proxy file and reloads the rotator when it changes.
+// A change is only applied once the file has looked the same for a whole
+// interval, so a write in progress isn't loaded half-finished.
+type FileWatcher struct {
+	rotator  *Rotator
+	path     string
+	interval time.Duration
+	onReload func(added, removed int, err error)
+	stop     chan struct{}
+	once     sync.Once
+}
+
+// NewFileWatcher watches path every interval. onReload, if not nil, is
+// called with the result of each reload.
+func NewFileWatcher(rotator *Rotator, path string, interval time.Duration, onReload func(added, removed int, err error)) *FileWatcher {
+	return &FileWatcher{
+		rotator:  rotator,
+		path:     path,
+		interval: interval,
+		onReload: onReload,
+		stop:     make(chan struct{}),
+	}
+}
+
+func (w *FileWatcher) Start() {
+	// Stat before returning, so an edit made right after Start is seen.
+	loaded, _ := os.Stat(w.path)
+	go w.run(loaded)
+}
+
+func (w *FileWatcher) Stop() {
+	w.once.Do(func() {
+		close(w.stop)
+	})
+}
+
+// run polls until Stop. loaded is the version currently in the rotator,
+// pending the last version seen that differs from it.
+func (w *FileWatcher) run(loaded os.FileInfo) {
+	ticker := time.NewTicker(w.interval)
+	defer ticker.Stop()
+
+	var pending os.FileInfo
+
+	for {
+		select {
+		case <-w.stop:
+			return
+		case <-ticker.C:
+		}
+
+		fi, err := os.Stat(w.path)
+		if err != nil {
+			// Editors often replace the file; wait for it to reappear.
+			pending = nil
+			continue
+		}
+		if sameFileVersion(fi, loaded) {
+			pending = nil
+			continue
+		}
+		if !sameFileVersion(fi, pending) {
+			pending = fi
+			continue
+		}
+
+		added, removed, err := w.rotator.ReloadFromFile(w.path)
+		if err == nil {
+			loaded = fi
+		}
+		pending = nil
+		if w.onReload != nil {
+			w.onReload(added, removed, err)
+		}
+	}
+}
+
+func sameFileVersion(a, b os.FileInfo) bool {
+	if a == nil || b == nil {
+		return false
+	}
+	return os.SameFile(a, b) && a.ModTime().Equal(b.ModTime()) && a.Size() == b.Size()
+}
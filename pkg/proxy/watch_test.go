@@ -0,0 +1,56 @@
+package proxy
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestFileWatcherKeepsOtherSources(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "proxies.txt")
+	if err := os.WriteFile(path, []byte("http://f1:1\nhttp://f2:1\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	r := NewRotator(RotationSequential, false, 0)
+	if _, err := r.AddFromFile(path); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.AddFromStrings([]string{"http://flag:1", "http://f2:1"}); err != nil {
+		t.Fatal(err)
+	}
+
+	type result struct{ added, removed int }
+	reloads := make(chan result, 1)
+	w := NewFileWatcher(r, path, 10*time.Millisecond, func(added, removed int, err error) {
+		if err != nil {
+			t.Errorf("reload: %v", err)
+		}
+		reloads <- result{added, removed}
+	})
+	w.Start()
+	defer w.Stop()
+
+	// Push the modification time forward so the change is seen even on
+	// filesystems with a coarse clock.
+	if err := os.WriteFile(path, []byte("http://f3:1\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	later := time.Now().Add(time.Minute)
+	if err := os.Chtimes(path, later, later); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case res := <-reloads:
+		if res.added != 1 || res.removed != 1 {
+			t.Errorf("reload added %d, removed %d; want 1 and 1", res.added, res.removed)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("watcher did not reload the edited file")
+	}
+	want := []string{"http://f2:1", "http://flag:1", "http://f3:1"}
+	if got := poolKeys(r); !slices.Equal(got, want) {
+		t.Errorf("pool after the watched reload = %v, want %v", got, want)
+	}
+}
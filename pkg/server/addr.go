@@ -0,0 +1,181 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// unixSocketPath reports whether a listen address names a Unix socket and
+// returns its path.
+func unixSocketPath(addr string) (string, bool) {
+	if path, ok := strings.CutPrefix(addr, "unix://"); ok {
+		return path, true
+	}
+	if strings.HasPrefix(addr, "/") || strings.HasPrefix(addr, "./") {
+		return addr, true
+	}
+	return "", false
+}
+
+// removeStaleSocket deletes a socket file left behind by a previous run.
+// It refuses to touch anything that isn't a socket or that still has a
+// server accepting on it.
+func removeStaleSocket(path string) error {
+	fi, err := os.Lstat(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if fi.Mode()&fs.ModeSocket == 0 {
+		return fmt.Errorf("%s exists and is not a socket", path)
+	}
+	if conn, err := net.DialTimeout("unix", path, time.Second); err == nil {
+		conn.Close()
+		return fmt.Errorf("%s is in use", path)
+	}
+	return os.Remove(path)
+}
+
+// tagSuffix marks a target hostname that asks for proxies with a given tag,
+// since SOCKS5 has no field for it: "example.com.us.iploop" connects to
+// example.com through a proxy tagged "us".
+const tagSuffix = ".iploop"
+
+// splitTag strips a tag request from target, returning the real target and
+// the tag. Targets without one are returned unchanged with an empty tag.
+func splitTag(target string) (string, string) {
+	host, port, err := net.SplitHostPort(target)
+	if err != nil || len(host) <= len(tagSuffix) || !strings.HasSuffix(strings.ToLower(host), tagSuffix) {
+		return target, ""
+	}
+	host = host[:len(host)-len(tagSuffix)]
+	i := strings.LastIndexByte(host, '.')
+	if i <= 0 || i == len(host)-1 {
+		return target, ""
+	}
+	return net.JoinHostPort(host[:i], port), host[i+1:]
+}
+
+// checkTarget rejects a client's request target that can't name a real
+// endpoint: an empty or non-printable hostname, or port 0 on CONNECT.
+// UDP ASSOCIATE may legitimately send port 0 for "any".
+func checkTarget(cmd byte, target string) error {
+	host, port, err := net.SplitHostPort(target)
+	if err != nil {
+		return err
+	}
+	if host == "" {
+		return fmt.Errorf("empty hostname")
+	}
+	for i := 0; i < len(host); i++ {
+		if host[i] <= ' ' || host[i] >= 0x7f {
+			return fmt.Errorf("invalid byte 0x%02x in hostname", host[i])
+		}
+	}
+	if cmd == cmdConnect && port == "0" {
+		return fmt.Errorf("port 0")
+	}
+	return nil
+}
+
+// appendSocksAddr appends ATYP, DST.ADDR and DST.PORT for host:port to b.
+func appendSocksAddr(b []byte, host string, port int) []byte {
+	ip := net.ParseIP(host)
+	if ip != nil {
+		if ip4 := ip.To4(); ip4 != nil {
+			b = append(b, addrIPv4)
+			b = append(b, ip4...)
+		} else {
+			b = append(b, addrIPv6)
+			b = append(b, ip.To16()...)
+		}
+	} else {
+		b = append(b, addrDomain, byte(len(host)))
+		b = append(b, host...)
+	}
+	return append(b, byte(port>>8), byte(port))
+}
+
+// readSocksAddr reads an address of type atyp followed by a port from r.
+func readSocksAddr(r io.Reader, atyp byte) (string, error) {
+	var buf [257]byte
+	var host string
+	switch atyp {
+	case addrIPv4:
+		if _, err := io.ReadFull(r, buf[:4]); err != nil {
+			return "", err
+		}
+		host = net.IP(buf[:4]).String()
+	case addrDomain:
+		if _, err := io.ReadFull(r, buf[:1]); err != nil {
+			return "", err
+		}
+		dlen := int(buf[0])
+		if _, err := io.ReadFull(r, buf[:dlen]); err != nil {
+			return "", err
+		}
+		host = string(buf[:dlen])
+	case addrIPv6:
+		if _, err := io.ReadFull(r, buf[:16]); err != nil {
+			return "", err
+		}
+		host = net.IP(buf[:16]).String()
+	default:
+		return "", fmt.Errorf("unknown atyp: %d", atyp)
+	}
+
+	if _, err := io.ReadFull(r, buf[:2]); err != nil {
+		return "", err
+	}
+	port := int(buf[0])<<8 | int(buf[1])
+	return net.JoinHostPort(host, strconv.Itoa(port)), nil
+}
+
+// parseSocksAddr decodes an address starting at b[0] (the ATYP byte) and
+// returns it along with the number of bytes consumed.
+func parseSocksAddr(b []byte) (string, int, error) {
+	if len(b) < 1 {
+		return "", 0, fmt.Errorf("short address")
+	}
+	var host string
+	n := 1
+	switch b[0] {
+	case addrIPv4:
+		if len(b) < n+4+2 {
+			return "", 0, fmt.Errorf("short address")
+		}
+		host = net.IP(b[n : n+4]).String()
+		n += 4
+	case addrDomain:
+		if len(b) < n+1 {
+			return "", 0, fmt.Errorf("short address")
+		}
+		dlen := int(b[n])
+		n++
+		if len(b) < n+dlen+2 {
+			return "", 0, fmt.Errorf("short address")
+		}
+		host = string(b[n : n+dlen])
+		n += dlen
+	case addrIPv6:
+		if len(b) < n+16+2 {
+			return "", 0, fmt.Errorf("short address")
+		}
+		host = net.IP(b[n : n+16]).String()
+		n += 16
+	default:
+		return "", 0, fmt.Errorf("unknown atyp: %d", b[0])
+	}
+	port := int(b[n])<<8 | int(b[n+1])
+	n += 2
+	return net.JoinHostPort(host, strconv.Itoa(port)), n, nil
+}
@@ -0,0 +1,138 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/netip"
+	"os"
+	"time"
+
+	"github.com/ogpourya/iploop/pkg/proxy"
+)
+
+// handleBind serves a SOCKS5 BIND: the upstream proxy listens for one
+// connection from target, the peer a client such as active-mode FTP
+// expects, and relays it to the client. The client gets two replies, the
+// first with the address the proxy listens on and the second with the
+// address of the peer once it connects.
+func (s *Server) handleBind(conn net.Conn, target string) {
+	if s.filter != nil && !unspecifiedTarget(target) {
+		if _, err := s.filter.Check(s.ctx, target); err != nil {
+			s.logger.Info("target refused", "client", conn.RemoteAddr().String(), "target", target, "error", err)
+			s.sendReply(conn, replyNotAllowed, nil)
+			return
+		}
+	}
+
+	p, err := s.rotator.Next()
+	if err != nil || !s.rotator.Reserve(p) {
+		s.stats.FailedRequests.Add(1)
+		s.sendReply(conn, replyGeneralFail, nil)
+		return
+	}
+	defer p.Release()
+
+	bd, ok := s.dialer.(BindDialer)
+	if !ok || p.Type != proxy.ProxyTypeSOCKS5 {
+		s.logger.Debug("BIND not supported by proxy", "proxy", p.String())
+		s.sendReply(conn, replyCmdNotSupp, nil)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(s.ctx, s.connectTTL)
+	start := time.Now()
+	upstream, bound, err := bd.DialBind(ctx, p, target)
+	cancel()
+	latency := time.Since(start)
+
+	s.logger.Debug("BIND", "proxy", p.String(), "bound", bound, latencyMs(latency), "success", err == nil)
+
+	if err != nil {
+		s.stats.FailedRequests.Add(1)
+		p.RecordFailure()
+		// A proxy that refuses BIND is still fine for CONNECT.
+		var socksErr *SOCKS5Error
+		if !errors.As(err, &socksErr) {
+			s.rotator.MarkDead(p)
+		}
+		s.sendReply(conn, replyCode(err), nil)
+		return
+	}
+	defer upstream.Close()
+
+	if err := s.sendReply(conn, replySuccess, bindAddr(bound, p)); err != nil {
+		return
+	}
+
+	peer, err := s.awaitBind(conn, upstream, bd)
+	if err == nil && s.filter != nil {
+		_, err = s.filter.Check(s.ctx, peer)
+	}
+	if err != nil {
+		s.logger.Debug("BIND peer not accepted", "proxy", p.String(), "error", err)
+		s.stats.FailedRequests.Add(1)
+		s.sendReply(conn, replyCode(err), nil)
+		return
+	}
+
+	s.stats.SuccessRequests.Add(1)
+	p.RecordRequest(latency)
+	defer p.Track(conn, upstream)()
+
+	if err := s.sendReply(conn, replySuccess, bindAddr(peer, p)); err != nil {
+		return
+	}
+	s.relay(conn, upstream, p)
+}
+
+// awaitBind waits for the proxy to report the peer of a BIND, for at most
+// the idle timeout if one is set. It gives up if the client hangs up or
+// sends data before the peer arrives.
+func (s *Server) awaitBind(client, upstream net.Conn, bd BindDialer) (string, error) {
+	if s.idle > 0 {
+		upstream.SetReadDeadline(time.Now().Add(s.idle))
+		defer upstream.SetReadDeadline(time.Time{})
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		var b [1]byte
+		_, err := client.Read(b[:])
+		if errors.Is(err, os.ErrDeadlineExceeded) {
+			return
+		}
+		upstream.Close()
+	}()
+
+	peer, err := bd.AcceptBind(upstream)
+	client.SetReadDeadline(time.Now())
+	<-done
+	client.SetReadDeadline(time.Time{})
+	return peer, err
+}
+
+// unspecifiedTarget reports whether a BIND target leaves the peer open,
+// as clients that do not know it send 0.0.0.0:0.
+func unspecifiedTarget(target string) bool {
+	ap, err := netip.ParseAddrPort(target)
+	return err == nil && ap.Addr().IsUnspecified()
+}
+
+// bindAddr converts an address from a proxy's BIND reply for the client.
+// Proxies may announce an unspecified address, meaning their own, which is
+// filled in if the proxy was given by IP; names cannot be reported and
+// become 0.0.0.0.
+func bindAddr(addr string, p *proxy.Proxy) net.Addr {
+	ap, err := netip.ParseAddrPort(addr)
+	if err != nil {
+		return nil
+	}
+	if ap.Addr().IsUnspecified() {
+		if ip, err := netip.ParseAddr(p.Host); err == nil {
+			ap = netip.AddrPortFrom(ip, ap.Port())
+		}
+	}
+	return net.TCPAddrFromAddrPort(ap)
+}
@@ -2,14 +2,17 @@ package server
 
 import (
 	"bufio"
+	"cmp"
 	"context"
 	"crypto/tls"
 	"encoding/base64"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
+	"log/slog"
 	"net"
-	"os"
+	"net/netip"
 	"strconv"
 	"strings"
 	"time"
@@ -17,41 +20,336 @@ import (
 	"github.com/ogpourya/iploop/pkg/proxy"
 )
 
+// ErrProxyAuth is returned when an upstream proxy requires credentials or
+// rejects the ones configured for it.
+var ErrProxyAuth = errors.New("proxy authentication failed")
+
+// ErrUnsupportedTarget is returned when a proxy cannot carry a connection
+// to the requested target, e.g. an IPv6-only host through SOCKS4. It says
+// nothing about the proxy's health.
+var ErrUnsupportedTarget = errors.New("target not supported by proxy")
+
+// SOCKS5Error is a failed reply from an upstream SOCKS5 proxy. Code is
+// the proxy's REP field, which the server passes on to its own clients.
+type SOCKS5Error struct {
+	Code byte
+}
+
+func (e *SOCKS5Error) Error() string {
+	return fmt.Sprintf("SOCKS5 failed: %d", e.Code)
+}
+
+// httpStatusError is a non-200 reply to an HTTP CONNECT.
+type httpStatusError struct {
+	code   int
+	status string
+}
+
+func (e *httpStatusError) Error() string {
+	return "HTTP proxy returned: " + e.status
+}
+
+// ResolveMode controls where target hostnames are resolved.
+type ResolveMode int
+
+const (
+	// ResolveRemote hands hostnames to the upstream proxy untouched.
+	// Plain SOCKS4 cannot carry hostnames and always resolves locally.
+	ResolveRemote ResolveMode = iota
+	// ResolveLocal resolves hostnames before dialing and sends the proxy
+	// an IP address, except to proxies marked RemoteDNS.
+	ResolveLocal
+)
+
+func (m ResolveMode) String() string {
+	if m == ResolveLocal {
+		return "local"
+	}
+	return "remote"
+}
+
+func ParseResolveMode(s string) ResolveMode {
+	if s == "local" {
+		return ResolveLocal
+	}
+	return ResolveRemote
+}
+
 type Dialer struct {
 	timeout    time.Duration
+	hsTimeout  time.Duration
+	keepAlive  time.Duration
+	fallback   time.Duration
+	bindAddr   netip.Addr
 	trustProxy bool
-	verbose    bool
+	logger     *slog.Logger
+	resolve    ResolveMode
+	resolver   *net.Resolver
+	dnsCache   *DNSCache
+	tlsConfig  *tls.Config
+
+	forwardClientIP bool
 }
 
-func NewDialer(trustProxy bool, timeout time.Duration, verbose bool) *Dialer {
+func NewDialer(trustProxy bool, timeout time.Duration, logger *slog.Logger) *Dialer {
+	if logger == nil {
+		logger = slog.New(slog.DiscardHandler)
+	}
 	return &Dialer{
 		timeout:    timeout,
 		trustProxy: trustProxy,
-		verbose:    verbose,
+		logger:     logger,
+	}
+}
+
+// SetResolveMode selects local or remote resolution of target hostnames.
+func (d *Dialer) SetResolveMode(m ResolveMode) {
+	d.resolve = m
+}
+
+// SetResolver sets the resolver for every lookup the dialer makes itself:
+// targets under ResolveLocal or for SOCKS4, and proxy hostnames. nil uses
+// the system resolver.
+func (d *Dialer) SetResolver(r *net.Resolver) {
+	d.resolver = r
+}
+
+// Resolver returns the resolver set with SetResolver, or
+// net.DefaultResolver.
+func (d *Dialer) Resolver() *net.Resolver {
+	if d.resolver == nil {
+		return net.DefaultResolver
+	}
+	return d.resolver
+}
+
+// SetDNSCache makes target lookups go through c, which should wrap the
+// dialer's resolver. Proxy hostnames are still looked up on every dial.
+func (d *Dialer) SetDNSCache(c *DNSCache) {
+	d.dnsCache = c
+}
+
+// DNSCache returns the cache set with SetDNSCache, or nil.
+func (d *Dialer) DNSCache() *DNSCache {
+	return d.dnsCache
+}
+
+// lookupTarget returns the addresses of a target host, preferring those
+// the target filter checked.
+func (d *Dialer) lookupTarget(ctx context.Context, host string) ([]netip.Addr, error) {
+	if addrs, ok := resolvedFromContext(ctx, host); ok {
+		return addrs, nil
+	}
+	if d.dnsCache != nil {
+		return d.dnsCache.LookupNetIP(ctx, host)
+	}
+	return d.Resolver().LookupNetIP(ctx, "ip", host)
+}
+
+// SetKeepAlive sets the TCP keepalive period for connections to proxies.
+// Zero uses Go's default of 15 seconds and a negative value disables
+// keepalives.
+func (d *Dialer) SetKeepAlive(period time.Duration) {
+	d.keepAlive = period
+}
+
+// SetFallbackDelay sets how long a connection to a proxy with both IPv6
+// and IPv4 addresses tries the first family alone before racing the
+// other (RFC 8305 happy eyeballs), so a broken IPv6 path does not use up
+// the dial timeout. Zero uses Go's default of 300ms and a negative value
+// tries the addresses one after another.
+func (d *Dialer) SetFallbackDelay(delay time.Duration) {
+	d.fallback = delay
+}
+
+// SetBindAddr makes connections to proxies leave from the local address
+// ip, for hosts with several interfaces that reach different providers.
+// Proxies with a bind option use their own. The zero Addr lets the system
+// choose.
+func (d *Dialer) SetBindAddr(ip netip.Addr) {
+	d.bindAddr = ip
+}
+
+// netDialer returns the dialer for connecting to p itself.
+func (d *Dialer) netDialer(p *proxy.Proxy) *net.Dialer {
+	nd := &net.Dialer{Timeout: d.timeoutFor(p), KeepAlive: d.keepAlive, FallbackDelay: d.fallback, Resolver: d.resolver}
+	if ip := cmp.Or(p.BindAddr, d.bindAddr); ip.IsValid() {
+		nd.LocalAddr = &net.TCPAddr{IP: ip.AsSlice(), Zone: ip.Zone()}
+	}
+	return nd
+}
+
+// timeoutFor returns p's own timeout from its URL, if set, or the
+// dialer's.
+func (d *Dialer) timeoutFor(p *proxy.Proxy) time.Duration {
+	if p.Timeout > 0 {
+		return p.Timeout
+	}
+	return d.timeout
+}
+
+// SetHandshakeTimeout bounds everything after the TCP connect to a proxy:
+// TLS, authentication and the tunnel request, until the proxy reports
+// success. Zero uses the dial timeout.
+func (d *Dialer) SetHandshakeTimeout(timeout time.Duration) {
+	d.hsTimeout = timeout
+}
+
+func (d *Dialer) handshakeDeadline(p *proxy.Proxy) time.Time {
+	if d.hsTimeout > 0 {
+		return time.Now().Add(d.hsTimeout)
+	}
+	return time.Now().Add(d.timeoutFor(p))
+}
+
+// SetForwardClientIP makes HTTP and HTTPS proxies receive the client's IP
+// in an X-Forwarded-For header on CONNECT, taken from the dial context
+// (see ContextWithClientAddr). SOCKS proxies have no equivalent. Off by
+// default, since it reveals clients to the proxies.
+func (d *Dialer) SetForwardClientIP(on bool) {
+	d.forwardClientIP = on
+}
+
+type clientAddrKey struct{}
+
+// ContextWithClientAddr returns a copy of ctx recording the address of the
+// client a dial is made for, for dialers that pass it upstream.
+func ContextWithClientAddr(ctx context.Context, addr net.Addr) context.Context {
+	return context.WithValue(ctx, clientAddrKey{}, addr)
+}
+
+// ClientAddrFromContext returns the client address stored by
+// ContextWithClientAddr, if any.
+func ClientAddrFromContext(ctx context.Context) (net.Addr, bool) {
+	addr, ok := ctx.Value(clientAddrKey{}).(net.Addr)
+	return addr, ok && addr != nil
+}
+
+type resolvedKey struct{}
+
+// resolvedHost is what ContextWithResolved records.
+type resolvedHost struct {
+	host  string
+	addrs []netip.Addr
+}
+
+// ContextWithResolved returns a copy of ctx recording addrs as the
+// addresses of host, as looked up by TargetFilter.Check. Dialers that
+// resolve host locally use them instead of asking DNS again.
+func ContextWithResolved(ctx context.Context, host string, addrs []netip.Addr) context.Context {
+	return context.WithValue(ctx, resolvedKey{}, resolvedHost{normalizeHost(host), addrs})
+}
+
+// resolvedFromContext returns the addresses ContextWithResolved recorded
+// for host, if any.
+func resolvedFromContext(ctx context.Context, host string) ([]netip.Addr, bool) {
+	r, ok := ctx.Value(resolvedKey{}).(resolvedHost)
+	if !ok || r.host != normalizeHost(host) {
+		return nil, false
+	}
+	return r.addrs, true
+}
+
+// forwardedFor returns the X-Forwarded-For value for a dial, or "" when
+// forwarding is off or the client has no IP, as on a Unix socket.
+func (d *Dialer) forwardedFor(ctx context.Context) string {
+	if !d.forwardClientIP {
+		return ""
+	}
+	addr, ok := ClientAddrFromContext(ctx)
+	if !ok {
+		return ""
 	}
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil || net.ParseIP(host) == nil {
+		return ""
+	}
+	return host
+}
+
+// SetTLSConfig sets the base TLS configuration for HTTPS proxies, replacing
+// the default built from trustProxy. See TLSOptions.
+func (d *Dialer) SetTLSConfig(cfg *tls.Config) {
+	d.tlsConfig = cfg
 }
 
 func (d *Dialer) Dial(ctx context.Context, p *proxy.Proxy, target string) (net.Conn, error) {
-	dialer := &net.Dialer{Timeout: d.timeout}
-	if d.verbose {
-		fmt.Fprintf(os.Stderr, "Dialing proxy (tcp) %s\n", p.Address())
+	return d.DialChain(ctx, p.Chain(), target)
+}
+
+// DialChain tunnels through each proxy in chain in order and finally
+// connects to target. A failure at any hop closes the whole chain.
+func (d *Dialer) DialChain(ctx context.Context, chain []*proxy.Proxy, target string) (net.Conn, error) {
+	if len(chain) == 0 {
+		return nil, fmt.Errorf("empty proxy chain")
 	}
-	start := time.Now()
-	conn, err := dialer.DialContext(ctx, "tcp", p.Address())
-	if d.verbose {
-		fmt.Fprintf(os.Stderr, "Dial proxy (tcp) %s took %v (err=%v)\n", p.Address(), time.Since(start), err)
+
+	last := chain[len(chain)-1]
+	if d.resolve == ResolveLocal && !last.RemoteDNS {
+		resolved, err := d.resolveTarget(ctx, target, last.Type == proxy.ProxyTypeSOCKS4)
+		if err != nil {
+			return nil, err
+		}
+		target = resolved
 	}
+
+	first := chain[0]
+	dialer := d.netDialer(first)
+	d.logger.Debug("dialing proxy", "proxy", first.Address())
+	start := time.Now()
+	conn, err := dialer.DialContext(ctx, "tcp", first.Address())
 	if err != nil {
+		d.logger.Debug("dial proxy failed", "proxy", first.Address(), latencyMs(time.Since(start)), "error", err)
 		return nil, err
 	}
+	d.logger.Debug("dialed proxy", "proxy", first.Address(), latencyMs(time.Since(start)))
+
+	xff := d.forwardedFor(ctx)
+	stop := closeOnDone(ctx, conn)
+	for i, hop := range chain {
+		next := target
+		if i+1 < len(chain) {
+			next = chain[i+1].Address()
+		}
+		conn, err = d.handshake(ctx, conn, hop, next, xff)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+			if len(chain) > 1 {
+				err = fmt.Errorf("hop %d (%s): %w", i+1, hop, err)
+			}
+			return nil, err
+		}
+	}
+	if !stop() {
+		conn.Close()
+		return nil, ctx.Err()
+	}
+	return conn, nil
+}
+
+// closeOnDone closes conn when ctx is done, interrupting a handshake in
+// progress. Calling the returned stop detaches it; stop returns false if
+// ctx already fired and conn is closed.
+func closeOnDone(ctx context.Context, conn net.Conn) (stop func() bool) {
+	return context.AfterFunc(ctx, func() {
+		conn.Close()
+	})
+}
 
+// handshake asks p, reached over conn, to connect to target. xff, if set,
+// is sent to HTTP proxies as X-Forwarded-For. conn is closed on failure.
+func (d *Dialer) handshake(ctx context.Context, conn net.Conn, p *proxy.Proxy, target, xff string) (net.Conn, error) {
 	switch p.Type {
 	case proxy.ProxyTypeHTTP:
-		return d.doHTTPConnect(conn, p, target)
+		return d.doHTTPConnect(conn, p, target, xff)
 	case proxy.ProxyTypeHTTPS:
-		return d.dialHTTPS(conn, p, target)
+		return d.dialHTTPS(conn, p, target, xff)
 	case proxy.ProxyTypeSOCKS4:
-		return d.dialSOCKS4(conn, p, target)
+		return d.dialSOCKS4(ctx, conn, p, target)
+	case proxy.ProxyTypeSOCKS4A:
+		return d.dialSOCKS4A(conn, p, target)
 	case proxy.ProxyTypeSOCKS5:
 		return d.dialSOCKS5(conn, p, target)
 	default:
@@ -60,6 +358,38 @@ func (d *Dialer) Dial(ctx context.Context, p *proxy.Proxy, target string) (net.C
 	}
 }
 
+// resolveTarget replaces the hostname in target with one of its addresses.
+func (d *Dialer) resolveTarget(ctx context.Context, target string, v4only bool) (string, error) {
+	host, port, err := net.SplitHostPort(target)
+	if err != nil {
+		return "", err
+	}
+	if net.ParseIP(host) != nil {
+		return target, nil
+	}
+
+	addrs, err := d.lookupTarget(ctx, host)
+	if err != nil {
+		return "", err
+	}
+	for _, addr := range addrs {
+		addr = addr.Unmap()
+		if v4only && !addr.Is4() {
+			continue
+		}
+		d.logger.Debug("resolved target", "host", host, "ip", addr.String())
+		return net.JoinHostPort(addr.String(), port), nil
+	}
+	if v4only {
+		return "", fmt.Errorf("%w: no IPv4 address for %s", ErrUnsupportedTarget, host)
+	}
+	return "", fmt.Errorf("no usable address for %s", host)
+}
+
+// bufferedConn hands out bytes a handshake read past the proxy's reply
+// before reading from the connection again. The SOCKS handshakes read
+// exact lengths straight from the conn and never over-read; only the HTTP
+// CONNECT path needs a buffered reader and therefore this wrapper.
 type bufferedConn struct {
 	net.Conn
 	r *bufio.Reader
@@ -69,46 +399,75 @@ func (c *bufferedConn) Read(p []byte) (int, error) {
 	return c.r.Read(p)
 }
 
+// WriteTo drains the buffered bytes and then defers to the raw
+// connection's WriteTo, so relaying still gets splice(2) on Linux once the
+// leftovers are out.
+func (c *bufferedConn) WriteTo(w io.Writer) (int64, error) {
+	return c.r.WriteTo(w)
+}
+
+func (c *bufferedConn) CloseWrite() error {
+	if cw, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return nil
+}
+
+// wrapBuffered returns conn itself when br holds no unread bytes, keeping
+// the raw connection's fast paths, and a bufferedConn otherwise.
+func wrapBuffered(conn net.Conn, br *bufio.Reader) net.Conn {
+	if br.Buffered() == 0 {
+		return conn
+	}
+	return &bufferedConn{Conn: conn, r: br}
+}
+
 func (d *Dialer) dialHTTP(p *proxy.Proxy, target string) (net.Conn, error) {
-	dialer := &net.Dialer{Timeout: d.timeout}
+	dialer := d.netDialer(p)
 	conn, err := dialer.Dial("tcp", p.Address())
 	if err != nil {
 		return nil, err
 	}
-	return d.doHTTPConnect(conn, p, target)
+	return d.doHTTPConnect(conn, p, target, "")
 }
 
-func (d *Dialer) dialHTTPS(conn net.Conn, p *proxy.Proxy, target string) (net.Conn, error) {
-	tlsConfig := &tls.Config{
-		ServerName:         p.Host,
-		InsecureSkipVerify: d.trustProxy,
+func (d *Dialer) dialHTTPS(conn net.Conn, p *proxy.Proxy, target, xff string) (net.Conn, error) {
+	var tlsConfig *tls.Config
+	if d.tlsConfig != nil {
+		tlsConfig = d.tlsConfig.Clone()
+		tlsConfig.ServerName = p.Host
+	} else {
+		tlsConfig = &tls.Config{
+			ServerName:         p.Host,
+			InsecureSkipVerify: d.trustProxy,
+		}
 	}
 
 	tlsConn := tls.Client(conn, tlsConfig)
-	tlsConn.SetDeadline(time.Now().Add(d.timeout))
+	tlsConn.SetDeadline(d.handshakeDeadline(p))
 
 	if err := tlsConn.Handshake(); err != nil {
 		conn.Close()
 		return nil, fmt.Errorf("TLS handshake failed: %w", err)
 	}
 
-	return d.doHTTPConnect(tlsConn, p, target)
+	return d.doHTTPConnect(tlsConn, p, target, xff)
 }
 
-func (d *Dialer) doHTTPConnect(conn net.Conn, p *proxy.Proxy, target string) (net.Conn, error) {
-	if d.verbose {
-		fmt.Fprintf(os.Stderr, "Sending HTTP CONNECT to %s for %s\n", p.Address(), target)
-	}
+func (d *Dialer) doHTTPConnect(conn net.Conn, p *proxy.Proxy, target, xff string) (net.Conn, error) {
+	d.logger.Debug("sending HTTP CONNECT", "proxy", p.Address(), "target", target)
 	start := time.Now()
 
 	req := "CONNECT " + target + " HTTP/1.1\r\nHost: " + target + "\r\n"
 	if p.Username != "" {
-		auth := base64.StdEncoding.EncodeToString([]byte(p.Username + ":" + p.Password))
-		req += "Proxy-Authorization: Basic " + auth + "\r\n"
+		req += "Proxy-Authorization: " + basicAuth(p) + "\r\n"
+	}
+	if xff != "" {
+		req += "X-Forwarded-For: " + xff + "\r\n"
 	}
 	req += "\r\n"
 
-	conn.SetDeadline(time.Now().Add(d.timeout))
+	conn.SetDeadline(d.handshakeDeadline(p))
 	if _, err := conn.Write([]byte(req)); err != nil {
 		conn.Close()
 		return nil, err
@@ -121,9 +480,15 @@ func (d *Dialer) doHTTPConnect(conn net.Conn, p *proxy.Proxy, target string) (ne
 		conn.Close()
 		return nil, err
 	}
-	if !strings.Contains(line, " 200 ") {
+	status := strings.TrimSpace(line)
+	if code := httpStatusCode(line); code != 200 {
+		if code == 407 {
+			err = proxyAuthError(br, p)
+		} else {
+			err = &httpStatusError{code: code, status: status}
+		}
 		conn.Close()
-		return nil, fmt.Errorf("HTTP proxy returned: %s", strings.TrimSpace(line))
+		return nil, err
 	}
 
 	// Read until empty line (end of headers)
@@ -138,15 +503,65 @@ func (d *Dialer) doHTTPConnect(conn net.Conn, p *proxy.Proxy, target string) (ne
 		}
 	}
 
-	if d.verbose {
-		fmt.Fprintf(os.Stderr, "HTTP CONNECT handshake with %s took %v\n", p.Address(), time.Since(start))
-	}
+	d.logger.Debug("HTTP CONNECT handshake done", "proxy", p.Address(), "target", target, latencyMs(time.Since(start)))
 
 	conn.SetDeadline(time.Time{})
-	return &bufferedConn{Conn: conn, r: br}, nil
+	return wrapBuffered(conn, br), nil
+}
+
+func basicAuth(p *proxy.Proxy) string {
+	return "Basic " + base64.StdEncoding.EncodeToString([]byte(p.Username+":"+p.Password))
+}
+
+// httpStatusCode extracts the status code from an HTTP status line, or
+// returns 0 if it is malformed.
+func httpStatusCode(line string) int {
+	fields := strings.Fields(line)
+	if len(fields) < 2 || !strings.HasPrefix(fields[0], "HTTP/") {
+		return 0
+	}
+	code, err := strconv.Atoi(fields[1])
+	if err != nil {
+		return 0
+	}
+	return code
+}
+
+// proxyAuthError reads the rest of a 407 response header and describes the
+// proxy's Proxy-Authenticate challenge.
+func proxyAuthError(br *bufio.Reader, p *proxy.Proxy) error {
+	var challenges []string
+	for {
+		line, err := br.ReadString('\n')
+		if err != nil || line == "\r\n" || line == "\n" {
+			break
+		}
+		name, value, ok := strings.Cut(line, ":")
+		if ok && strings.EqualFold(strings.TrimSpace(name), "Proxy-Authenticate") {
+			challenges = append(challenges, strings.TrimSpace(value))
+		}
+	}
+
+	challenge := "no challenge"
+	if len(challenges) > 0 {
+		challenge = strings.Join(challenges, ", ")
+	}
+	if p.Username == "" {
+		return fmt.Errorf("%w: credentials required (%s)", ErrProxyAuth, challenge)
+	}
+	return fmt.Errorf("%w: credentials rejected (%s)", ErrProxyAuth, challenge)
 }
 
-func (d *Dialer) dialSOCKS4(conn net.Conn, p *proxy.Proxy, target string) (net.Conn, error) {
+// socks4Error describes a SOCKS4 reply code other than "granted". Codes
+// 0x5C and 0x5D mean the proxy's identd check rejected our user ID.
+func socks4Error(proto string, code byte) error {
+	if code == 0x5C || code == 0x5D {
+		return fmt.Errorf("%w: %s user ID rejected (%d)", ErrProxyAuth, proto, code)
+	}
+	return fmt.Errorf("%s rejected: %d", proto, code)
+}
+
+func (d *Dialer) dialSOCKS4(ctx context.Context, conn net.Conn, p *proxy.Proxy, target string) (net.Conn, error) {
 	host, portStr, err := net.SplitHostPort(target)
 	if err != nil {
 		conn.Close()
@@ -158,20 +573,20 @@ func (d *Dialer) dialSOCKS4(conn net.Conn, p *proxy.Proxy, target string) (net.C
 		ip = ip.To4()
 	}
 	if ip == nil {
-		ips, err := net.LookupIP(host)
-		if err != nil || len(ips) == 0 {
+		addrs, err := d.lookupTarget(ctx, host)
+		if err != nil || len(addrs) == 0 {
 			conn.Close()
 			return nil, fmt.Errorf("resolve failed: %s", host)
 		}
-		for _, addr := range ips {
-			if v4 := addr.To4(); v4 != nil {
-				ip = v4
+		for _, addr := range addrs {
+			if addr = addr.Unmap(); addr.Is4() {
+				ip = net.IP(addr.AsSlice())
 				break
 			}
 		}
 		if ip == nil {
 			conn.Close()
-			return nil, fmt.Errorf("no IPv4 for %s", host)
+			return nil, fmt.Errorf("%w: no IPv4 address for %s", ErrUnsupportedTarget, host)
 		}
 	}
 
@@ -181,14 +596,17 @@ func (d *Dialer) dialSOCKS4(conn net.Conn, p *proxy.Proxy, target string) (net.C
 		return nil, fmt.Errorf("invalid port")
 	}
 
-	var req [9]byte
+	// SOCKS4 has no password; the username is sent as the user ID.
+	req := make([]byte, 8, 9+len(p.Username))
 	req[0] = 0x04
 	req[1] = 0x01
 	binary.BigEndian.PutUint16(req[2:4], uint16(port))
 	copy(req[4:8], ip)
+	req = append(req, p.Username...)
+	req = append(req, 0x00)
 
-	conn.SetDeadline(time.Now().Add(d.timeout))
-	if _, err = conn.Write(req[:]); err != nil {
+	conn.SetDeadline(d.handshakeDeadline(p))
+	if _, err = conn.Write(req); err != nil {
 		conn.Close()
 		return nil, err
 	}
@@ -201,136 +619,265 @@ func (d *Dialer) dialSOCKS4(conn net.Conn, p *proxy.Proxy, target string) (net.C
 
 	if resp[1] != 0x5A {
 		conn.Close()
-		return nil, fmt.Errorf("SOCKS4 rejected: %d", resp[1])
+		return nil, socks4Error("SOCKS4", resp[1])
 	}
 
 	conn.SetDeadline(time.Time{})
 	return conn, nil
 }
 
-func (d *Dialer) dialSOCKS5(conn net.Conn, p *proxy.Proxy, target string) (net.Conn, error) {
-	conn.SetDeadline(time.Now().Add(d.timeout))
+// dialSOCKS4A sends the hostname to the proxy for remote resolution,
+// signalled by the invalid destination IP 0.0.0.x (x != 0).
+func (d *Dialer) dialSOCKS4A(conn net.Conn, p *proxy.Proxy, target string) (net.Conn, error) {
+	host, portStr, err := net.SplitHostPort(target)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
 
-	var methods []byte
-	if p.Username != "" {
-		methods = []byte{0x05, 0x02, 0x00, 0x02}
+	port, err := strconv.Atoi(portStr)
+	if err != nil || port < 1 || port > 65535 {
+		conn.Close()
+		return nil, fmt.Errorf("invalid port")
+	}
+
+	req := make([]byte, 0, 10+len(p.Username)+len(host))
+	req = append(req, 0x04, 0x01, byte(port>>8), byte(port))
+	if ip := net.ParseIP(host).To4(); ip != nil {
+		req = append(req, ip...)
+		req = append(req, p.Username...)
+		req = append(req, 0x00)
 	} else {
-		methods = []byte{0x05, 0x01, 0x00}
+		req = append(req, 0x00, 0x00, 0x00, 0x01)
+		req = append(req, p.Username...)
+		req = append(req, 0x00)
+		req = append(req, host...)
+		req = append(req, 0x00)
 	}
 
-	if _, err := conn.Write(methods); err != nil {
+	conn.SetDeadline(d.handshakeDeadline(p))
+	if _, err = conn.Write(req); err != nil {
 		conn.Close()
 		return nil, err
 	}
 
-	var resp [2]byte
-	if _, err := io.ReadFull(conn, resp[:]); err != nil {
+	var resp [8]byte
+	if _, err = io.ReadFull(conn, resp[:]); err != nil {
 		conn.Close()
 		return nil, err
 	}
 
-	if resp[0] != 0x05 {
+	if resp[1] != 0x5A {
 		conn.Close()
-		return nil, fmt.Errorf("bad SOCKS5 version")
+		return nil, socks4Error("SOCKS4a", resp[1])
 	}
 
-	if resp[1] == 0x02 {
-		if err := d.socks5Auth(conn, p.Username, p.Password); err != nil {
-			conn.Close()
-			return nil, err
-		}
-	} else if resp[1] != 0x00 {
-		conn.Close()
-		return nil, fmt.Errorf("auth not supported: %d", resp[1])
-	}
+	conn.SetDeadline(time.Time{})
+	return conn, nil
+}
 
-	host, portStr, err := net.SplitHostPort(target)
-	if err != nil {
+func (d *Dialer) dialSOCKS5(conn net.Conn, p *proxy.Proxy, target string) (net.Conn, error) {
+	conn.SetDeadline(d.handshakeDeadline(p))
+
+	if err := d.socks5Greet(conn, p); err != nil {
 		conn.Close()
 		return nil, err
 	}
 
-	port, err := strconv.Atoi(portStr)
-	if err != nil || port < 1 || port > 65535 {
+	if _, err := d.socks5Request(conn, 0x01, target); err != nil {
 		conn.Close()
-		return nil, fmt.Errorf("invalid port")
+		return nil, err
 	}
 
-	if len(host) > 255 {
-		conn.Close()
-		return nil, fmt.Errorf("hostname too long")
+	conn.SetDeadline(time.Time{})
+	return conn, nil
+}
+
+// DialUDP performs a SOCKS5 UDP ASSOCIATE with p. The returned control
+// connection must stay open for the lifetime of the association; relay is
+// a UDP socket connected to the relay address announced by the proxy.
+func (d *Dialer) DialUDP(ctx context.Context, p *proxy.Proxy) (ctrl net.Conn, relay net.Conn, err error) {
+	if p.Type != proxy.ProxyTypeSOCKS5 || len(p.Via) > 0 {
+		return nil, nil, fmt.Errorf("UDP not supported by %s proxy", p)
 	}
 
-	req := make([]byte, 0, 22)
-	req = append(req, 0x05, 0x01, 0x00)
+	dialer := d.netDialer(p)
+	conn, err := dialer.DialContext(ctx, "tcp", p.Address())
+	if err != nil {
+		return nil, nil, err
+	}
 
-	ip := net.ParseIP(host)
-	if ip != nil {
-		if ip4 := ip.To4(); ip4 != nil {
-			req = append(req, 0x01)
-			req = append(req, ip4...)
-		} else {
-			req = append(req, 0x04)
-			req = append(req, ip.To16()...)
+	stop := closeOnDone(ctx, conn)
+	defer func() {
+		if stop() {
+			return
 		}
-	} else {
-		req = append(req, 0x03, byte(len(host)))
-		req = append(req, host...)
-	}
-	req = append(req, byte(port>>8), byte(port))
+		if err == nil {
+			ctrl.Close()
+			relay.Close()
+			ctrl, relay = nil, nil
+		}
+		err = ctx.Err()
+	}()
 
-	if _, err := conn.Write(req); err != nil {
+	conn.SetDeadline(d.handshakeDeadline(p))
+	if err := d.socks5Greet(conn, p); err != nil {
 		conn.Close()
-		return nil, err
+		return nil, nil, err
 	}
 
-	var hdr [4]byte
-	if _, err := io.ReadFull(conn, hdr[:]); err != nil {
+	// The client address is not known in advance, so announce 0.0.0.0:0.
+	bound, err := d.socks5Request(conn, 0x03, "0.0.0.0:0")
+	if err != nil {
 		conn.Close()
-		return nil, err
+		return nil, nil, err
 	}
 
-	if hdr[0] != 0x05 {
+	host, port, err := net.SplitHostPort(bound)
+	if err != nil {
 		conn.Close()
-		return nil, fmt.Errorf("bad SOCKS5 response")
+		return nil, nil, err
+	}
+	// Proxies commonly announce an unspecified address, meaning "same host".
+	if ip := net.ParseIP(host); ip != nil && ip.IsUnspecified() {
+		host = p.Host
 	}
 
-	if hdr[1] != 0x00 {
+	// The relay socket needs a UDP local address when a bind address is
+	// set; a TCP one makes the dial fail.
+	udpDialer := *dialer
+	if ip := cmp.Or(p.BindAddr, d.bindAddr); ip.IsValid() {
+		udpDialer.LocalAddr = &net.UDPAddr{IP: ip.AsSlice(), Zone: ip.Zone()}
+	}
+	udpConn, err := udpDialer.DialContext(ctx, "udp", net.JoinHostPort(host, port))
+	if err != nil {
 		conn.Close()
-		return nil, fmt.Errorf("SOCKS5 failed: %d", hdr[1])
+		return nil, nil, err
 	}
 
-	if err := d.consumeBoundAddr(conn, hdr[3]); err != nil {
-		conn.Close()
-		return nil, err
+	d.logger.Debug("UDP associate established", "proxy", p.Address(), "relay", udpConn.RemoteAddr().String())
+
+	conn.SetDeadline(time.Time{})
+	return conn, udpConn, nil
+}
+
+// DialBind asks p, which must be a SOCKS5 proxy, to accept one inbound
+// connection from target (the SOCKS5 BIND command) and returns the
+// control connection and the address the proxy listens on. Pass conn to
+// AcceptBind to wait for the peer. The hops before p in a chain are
+// tunneled through as by Dial.
+func (d *Dialer) DialBind(ctx context.Context, p *proxy.Proxy, target string) (conn net.Conn, bound string, err error) {
+	if p.Type != proxy.ProxyTypeSOCKS5 {
+		return nil, "", fmt.Errorf("BIND not supported by %s proxy", p)
+	}
+	if len(p.Via) > 0 {
+		conn, err = d.DialChain(ctx, p.Via, p.Address())
+	} else {
+		conn, err = d.netDialer(p).DialContext(ctx, "tcp", p.Address())
+	}
+	if err != nil {
+		return nil, "", err
 	}
 
+	stop := closeOnDone(ctx, conn)
+	conn.SetDeadline(d.handshakeDeadline(p))
+	err = d.socks5Greet(conn, p)
+	if err == nil {
+		bound, err = d.socks5Request(conn, 0x02, target)
+	}
+	if !stop() {
+		conn.Close()
+		return nil, "", ctx.Err()
+	}
+	if err != nil {
+		conn.Close()
+		return nil, "", err
+	}
 	conn.SetDeadline(time.Time{})
-	return conn, nil
+	return conn, bound, nil
 }
 
-func (d *Dialer) consumeBoundAddr(conn net.Conn, atyp byte) error {
-	switch atyp {
-	case 0x01:
-		var buf [6]byte
-		_, err := io.ReadFull(conn, buf[:])
-		return err
-	case 0x03:
-		var lenBuf [1]byte
-		if _, err := io.ReadFull(conn, lenBuf[:]); err != nil {
-			return err
-		}
-		dlen := int(lenBuf[0])
-		buf := make([]byte, dlen+2)
-		_, err := io.ReadFull(conn, buf)
+// AcceptBind waits on a connection from DialBind for the proxy's second
+// reply, sent once the peer connects, and returns the peer's address.
+// From then on conn carries the peer's traffic.
+func (d *Dialer) AcceptBind(conn net.Conn) (peer string, err error) {
+	return readSocks5Reply(conn)
+}
+
+func (d *Dialer) socks5Greet(conn net.Conn, p *proxy.Proxy) error {
+	var methods []byte
+	if p.Username != "" {
+		methods = []byte{0x05, 0x02, 0x00, 0x02}
+	} else {
+		methods = []byte{0x05, 0x01, 0x00}
+	}
+
+	if _, err := conn.Write(methods); err != nil {
 		return err
-	case 0x04:
-		var buf [18]byte
-		_, err := io.ReadFull(conn, buf[:])
+	}
+
+	var resp [2]byte
+	if _, err := io.ReadFull(conn, resp[:]); err != nil {
 		return err
-	default:
-		return fmt.Errorf("unknown atyp: %d", atyp)
 	}
+
+	if resp[0] != 0x05 {
+		return fmt.Errorf("bad SOCKS5 version")
+	}
+
+	if resp[1] == 0x02 {
+		return d.socks5Auth(conn, p.Username, p.Password)
+	} else if resp[1] == 0xFF {
+		return fmt.Errorf("%w: no acceptable SOCKS5 auth method", ErrProxyAuth)
+	} else if resp[1] != 0x00 {
+		return fmt.Errorf("auth not supported: %d", resp[1])
+	}
+	return nil
+}
+
+// socks5Request sends a SOCKS5 command for target and returns the bound
+// address from the proxy's reply.
+func (d *Dialer) socks5Request(conn net.Conn, cmd byte, target string) (string, error) {
+	host, portStr, err := net.SplitHostPort(target)
+	if err != nil {
+		return "", err
+	}
+
+	port, err := strconv.Atoi(portStr)
+	if err != nil || port < 0 || port > 65535 || (port == 0 && cmd == 0x01) {
+		return "", fmt.Errorf("invalid port")
+	}
+
+	if len(host) > 255 {
+		return "", fmt.Errorf("hostname too long")
+	}
+
+	req := make([]byte, 0, 22)
+	req = append(req, 0x05, cmd, 0x00)
+	req = appendSocksAddr(req, host, port)
+
+	if _, err := conn.Write(req); err != nil {
+		return "", err
+	}
+	return readSocks5Reply(conn)
+}
+
+// readSocks5Reply reads a SOCKS5 reply and returns its address.
+func readSocks5Reply(conn net.Conn) (string, error) {
+	var hdr [4]byte
+	if _, err := io.ReadFull(conn, hdr[:]); err != nil {
+		return "", err
+	}
+
+	if hdr[0] != 0x05 {
+		return "", fmt.Errorf("bad SOCKS5 response")
+	}
+
+	if hdr[1] != 0x00 {
+		return "", &SOCKS5Error{Code: hdr[1]}
+	}
+
+	return readSocksAddr(conn, hdr[3])
 }
 
 func (d *Dialer) socks5Auth(conn net.Conn, user, pass string) error {
@@ -354,7 +901,7 @@ func (d *Dialer) socks5Auth(conn net.Conn, user, pass string) error {
 	}
 
 	if resp[1] != 0x00 {
-		return fmt.Errorf("auth failed")
+		return fmt.Errorf("%w: SOCKS5 credentials rejected", ErrProxyAuth)
 	}
 	return nil
 }
@@ -0,0 +1,322 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"net"
+	"net/netip"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/ogpourya/iploop/pkg/proxy"
+)
+
+// fakeProxy accepts connections on a loopback listener and hands each to
+// serve, closing it when serve returns. It returns the listener's address.
+func fakeProxy(t testing.TB, serve func(conn net.Conn, br *bufio.Reader)) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				serve(conn, bufio.NewReader(conn))
+			}()
+		}
+	}()
+	return ln.Addr().String()
+}
+
+// socks5Accept answers a SOCKS5 greeting without auth and reads the
+// request that follows, returning its command and address.
+func socks5Accept(conn net.Conn, br *bufio.Reader) (cmd byte, addr string, err error) {
+	var hdr [4]byte
+	if _, err := io.ReadFull(br, hdr[:2]); err != nil {
+		return 0, "", err
+	}
+	if _, err := io.ReadFull(br, make([]byte, hdr[1])); err != nil {
+		return 0, "", err
+	}
+	if _, err := conn.Write([]byte{socks5Version, authNone}); err != nil {
+		return 0, "", err
+	}
+	if _, err := io.ReadFull(br, hdr[:]); err != nil {
+		return 0, "", err
+	}
+	addr, err = readSocksAddr(br, hdr[3])
+	return hdr[1], addr, err
+}
+
+// socks5Reply is a successful SOCKS5 reply carrying addr.
+func socks5Reply(addr string) []byte {
+	host, port, _ := net.SplitHostPort(addr)
+	n, _ := strconv.Atoi(port)
+	return appendSocksAddr([]byte{socks5Version, replySuccess, 0x00}, host, n)
+}
+
+// mustProxy parses rawURL or fails the test.
+func mustProxy(t testing.TB, rawURL string) *proxy.Proxy {
+	t.Helper()
+	p, err := proxy.NewProxy(rawURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func TestDialKeepsBytesAfterHandshake(t *testing.T) {
+	const payload = "early bytes from the target"
+	tests := []struct {
+		scheme string
+		serve  func(conn net.Conn, br *bufio.Reader) error
+	}{
+		{"http", func(conn net.Conn, br *bufio.Reader) error {
+			for {
+				line, err := br.ReadString('\n')
+				if err != nil {
+					return err
+				}
+				if line == "\r\n" {
+					break
+				}
+			}
+			_, err := conn.Write([]byte("HTTP/1.1 200 Connection established\r\nVia: fake\r\n\r\n" + payload))
+			return err
+		}},
+		{"socks4", func(conn net.Conn, br *bufio.Reader) error {
+			if _, err := io.ReadFull(br, make([]byte, 8)); err != nil {
+				return err
+			}
+			if _, err := br.ReadString(0); err != nil {
+				return err
+			}
+			_, err := conn.Write(append([]byte{0x00, 0x5A, 0, 0, 0, 0, 0, 0}, payload...))
+			return err
+		}},
+		{"socks4a", func(conn net.Conn, br *bufio.Reader) error {
+			if _, err := io.ReadFull(br, make([]byte, 8)); err != nil {
+				return err
+			}
+			for range 2 { // User ID and hostname
+				if _, err := br.ReadString(0); err != nil {
+					return err
+				}
+			}
+			_, err := conn.Write(append([]byte{0x00, 0x5A, 0, 0, 0, 0, 0, 0}, payload...))
+			return err
+		}},
+		{"socks5", func(conn net.Conn, br *bufio.Reader) error {
+			if _, _, err := socks5Accept(conn, br); err != nil {
+				return err
+			}
+			_, err := conn.Write(append(socks5Reply("10.0.0.1:4000"), payload...))
+			return err
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.scheme, func(t *testing.T) {
+			addr := fakeProxy(t, func(conn net.Conn, br *bufio.Reader) {
+				if err := tt.serve(conn, br); err != nil {
+					t.Errorf("fake proxy: %v", err)
+					return
+				}
+				io.Copy(io.Discard, br)
+			})
+			target := "example.com:80"
+			if tt.scheme == "socks4" {
+				target = "192.0.2.1:80"
+			}
+			d := NewDialer(true, 2*time.Second, nil)
+			conn, err := d.Dial(context.Background(), mustProxy(t, tt.scheme+"://"+addr), target)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+			got := make([]byte, len(payload))
+			if _, err := io.ReadFull(conn, got); err != nil || string(got) != payload {
+				t.Errorf("read %q, %v; want %q", got, err, payload)
+			}
+		})
+	}
+}
+
+func TestDialHTTPChainKeepsBytes(t *testing.T) {
+	// The last hop sends the target's first bytes with its reply.
+	inner := fakeProxy(t, func(conn net.Conn, br *bufio.Reader) {
+		for {
+			line, err := br.ReadString('\n')
+			if err != nil || line == "\r\n" {
+				break
+			}
+		}
+		conn.Write([]byte("HTTP/1.1 200 OK\r\n\r\npayload"))
+		io.Copy(io.Discard, br)
+	})
+	outer := fakeProxy(t, func(conn net.Conn, br *bufio.Reader) {
+		if _, _, err := socks5Accept(conn, br); err != nil {
+			return
+		}
+		up, err := net.Dial("tcp", inner)
+		if err != nil {
+			return
+		}
+		defer up.Close()
+		conn.Write(socks5Reply(inner))
+		go io.Copy(up, br)
+		io.Copy(conn, up)
+	})
+
+	chain := mustProxy(t, "socks5://"+outer+" > http://"+inner)
+	d := NewDialer(true, 2*time.Second, nil)
+	conn, err := d.Dial(context.Background(), chain, "example.com:443")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	got := make([]byte, len("payload"))
+	if _, err := io.ReadFull(conn, got); err != nil || string(got) != "payload" {
+		t.Errorf("read %q, %v; want payload", got, err)
+	}
+}
+
+func TestDialTimeoutUnroutable(t *testing.T) {
+	// 10.255.255.1 normally drops SYNs; some sandboxes refuse at once
+	// instead, which also satisfies the bound.
+	for _, tt := range []struct {
+		url     string
+		timeout time.Duration
+	}{
+		{"http://10.255.255.1:8080", 200 * time.Millisecond},
+		{"http://10.255.255.1:8080?timeout=200ms", 10 * time.Second},
+	} {
+		d := NewDialer(true, tt.timeout, nil)
+		start := time.Now()
+		conn, err := d.Dial(context.Background(), mustProxy(t, tt.url), "example.com:80")
+		if err == nil {
+			conn.Close()
+			t.Errorf("%s: dial succeeded", tt.url)
+			continue
+		}
+		if elapsed := time.Since(start); elapsed > time.Second {
+			t.Errorf("%s: dial failed after %v, want about 200ms", tt.url, elapsed)
+		}
+	}
+}
+
+func TestDialTimeoutSilentProxy(t *testing.T) {
+	// The proxy accepts but never answers, so the handshake deadline,
+	// not the connect timeout, has to end the dial.
+	addr := fakeProxy(t, func(conn net.Conn, br *bufio.Reader) {
+		io.Copy(io.Discard, br)
+	})
+	for _, scheme := range []string{"http", "https", "socks4", "socks4a", "socks5"} {
+		for _, tt := range []struct {
+			query   string
+			timeout time.Duration
+		}{
+			{"", 200 * time.Millisecond},
+			{"?timeout=200ms", 10 * time.Second},
+		} {
+			url := scheme + "://" + addr + tt.query
+			d := NewDialer(true, tt.timeout, nil)
+			start := time.Now()
+			conn, err := d.Dial(context.Background(), mustProxy(t, url), "192.0.2.1:80")
+			elapsed := time.Since(start)
+			if err == nil {
+				conn.Close()
+				t.Errorf("%s: dial succeeded", url)
+				continue
+			}
+			if elapsed < 150*time.Millisecond || elapsed > time.Second {
+				t.Errorf("%s: dial failed after %v, want about 200ms", url, elapsed)
+			}
+		}
+	}
+}
+
+func TestHandshakeTimeoutOverridesDialTimeout(t *testing.T) {
+	addr := fakeProxy(t, func(conn net.Conn, br *bufio.Reader) {
+		io.Copy(io.Discard, br)
+	})
+	d := NewDialer(true, 10*time.Second, nil)
+	d.SetHandshakeTimeout(200 * time.Millisecond)
+	start := time.Now()
+	if conn, err := d.Dial(context.Background(), mustProxy(t, "socks5://"+addr), "192.0.2.1:80"); err == nil {
+		conn.Close()
+		t.Fatal("dial succeeded")
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("dial failed after %v, want about 200ms", elapsed)
+	}
+}
+
+func TestDialUDPWithBindAddr(t *testing.T) {
+	// The fake proxy announces a UDP relay that echoes datagrams.
+	addr := fakeProxy(t, func(conn net.Conn, br *bufio.Reader) {
+		cmd, _, err := socks5Accept(conn, br)
+		if err != nil || cmd != cmdUDPAssociate {
+			t.Errorf("fake proxy: command %#x, %v; want UDP ASSOCIATE", cmd, err)
+			return
+		}
+		pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer pc.Close()
+		if _, err := conn.Write(socks5Reply(pc.LocalAddr().String())); err != nil {
+			return
+		}
+		buf := make([]byte, 512)
+		pc.SetReadDeadline(time.Now().Add(2 * time.Second))
+		if n, from, err := pc.ReadFrom(buf); err == nil {
+			pc.WriteTo(buf[:n], from)
+		}
+		io.Copy(io.Discard, br)
+	})
+
+	for _, tt := range []struct {
+		name string
+		url  string
+		bind string
+	}{
+		{"dialer bind address", "socks5://" + addr, "127.0.0.1"},
+		{"proxy bind option", "socks5://" + addr + "?bind=127.0.0.1", ""},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			d := NewDialer(true, 2*time.Second, nil)
+			if tt.bind != "" {
+				d.SetBindAddr(netip.MustParseAddr(tt.bind))
+			}
+			ctrl, relay, err := d.DialUDP(context.Background(), mustProxy(t, tt.url))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer ctrl.Close()
+			defer relay.Close()
+			if ip := relay.LocalAddr().(*net.UDPAddr).IP; !ip.Equal(net.IPv4(127, 0, 0, 1)) {
+				t.Errorf("relay socket bound to %s, want 127.0.0.1", ip)
+			}
+			relay.SetDeadline(time.Now().Add(2 * time.Second))
+			if _, err := relay.Write([]byte("ping")); err != nil {
+				t.Fatal(err)
+			}
+			buf := make([]byte, 16)
+			if n, err := relay.Read(buf); err != nil || string(buf[:n]) != "ping" {
+				t.Errorf("relay echoed %q, %v; want ping", buf[:n], err)
+			}
+		})
+	}
+}
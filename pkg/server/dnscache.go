@@ -0,0 +1,99 @@
+package server
+
+import (
+	"container/list"
+	"context"
+	"errors"
+	"net"
+	"net/netip"
+	"sync"
+	"time"
+)
+
+// negativeTTL caps how long a name that does not exist is remembered, so a
+// record that appears is picked up soon.
+const negativeTTL = 5 * time.Second
+
+// DNSCache remembers lookups made through a resolver for a fixed TTL, since
+// Go's resolver does not report record TTLs. Names that do not exist are
+// remembered for at most negativeTTL; other failures are not cached. The
+// least recently used entry is dropped when the cache is full.
+type DNSCache struct {
+	resolver *net.Resolver
+	ttl      time.Duration
+	size     int
+
+	mu      sync.Mutex
+	entries map[string]*list.Element
+	lru     *list.List // of *dnsEntry, most recently used first
+}
+
+type dnsEntry struct {
+	host    string
+	addrs   []netip.Addr
+	err     error
+	expires time.Time
+}
+
+// NewDNSCache returns a cache of up to size names looked up with r, nil
+// meaning the system resolver, and kept for ttl.
+func NewDNSCache(r *net.Resolver, size int, ttl time.Duration) *DNSCache {
+	if r == nil {
+		r = net.DefaultResolver
+	}
+	return &DNSCache{
+		resolver: r,
+		ttl:      ttl,
+		size:     size,
+		entries:  make(map[string]*list.Element),
+		lru:      list.New(),
+	}
+}
+
+// LookupNetIP returns host's addresses, from the cache while they are
+// fresh. The slice is shared and must not be modified.
+func (c *DNSCache) LookupNetIP(ctx context.Context, host string) ([]netip.Addr, error) {
+	now := time.Now()
+	c.mu.Lock()
+	if el, ok := c.entries[host]; ok {
+		e := el.Value.(*dnsEntry)
+		if now.Before(e.expires) {
+			c.lru.MoveToFront(el)
+			c.mu.Unlock()
+			return e.addrs, e.err
+		}
+		c.lru.Remove(el)
+		delete(c.entries, host)
+	}
+	c.mu.Unlock()
+
+	addrs, err := c.resolver.LookupNetIP(ctx, "ip", host)
+	ttl := c.ttl
+	if err != nil {
+		var dnsErr *net.DNSError
+		if !errors.As(err, &dnsErr) || !dnsErr.IsNotFound {
+			return nil, err
+		}
+		ttl = min(ttl, negativeTTL)
+	}
+	if ttl > 0 && c.size > 0 {
+		c.store(&dnsEntry{host: host, addrs: addrs, err: err, expires: now.Add(ttl)})
+	}
+	return addrs, err
+}
+
+func (c *DNSCache) store(e *dnsEntry) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if el, ok := c.entries[e.host]; ok {
+		el.Value = e
+		c.lru.MoveToFront(el)
+		return
+	}
+	for c.lru.Len() >= c.size {
+		oldest := c.lru.Back()
+		c.lru.Remove(oldest)
+		delete(c.entries, oldest.Value.(*dnsEntry).host)
+	}
+	c.entries[e.host] = c.lru.PushFront(e)
+}
@@ -0,0 +1,205 @@
+package server
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeDNS answers the Go resolver over an in-memory stream: names starting
+// with "found" get 192.0.2.1, "missing" ones NXDOMAIN and the rest
+// SERVFAIL. Names starting with "rebind" get 93.184.216.34 the first time
+// and 127.0.0.1 after that, as a DNS rebinding attack would. It counts the
+// queries per name.
+type fakeDNS struct {
+	mu      sync.Mutex
+	queries map[string]int
+	rebinds int // A queries answered for "rebind" names
+}
+
+func (f *fakeDNS) resolver() *net.Resolver {
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+			client, server := net.Pipe()
+			go f.serve(server)
+			return client, nil
+		},
+	}
+}
+
+func (f *fakeDNS) count(name string) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.queries[name]
+}
+
+// serve answers length-prefixed queries, as over TCP, until conn closes.
+func (f *fakeDNS) serve(conn net.Conn) {
+	defer conn.Close()
+	for {
+		var n [2]byte
+		if _, err := io.ReadFull(conn, n[:]); err != nil {
+			return
+		}
+		q := make([]byte, binary.BigEndian.Uint16(n[:]))
+		if _, err := io.ReadFull(conn, q); err != nil {
+			return
+		}
+		resp := f.answer(q)
+		if resp == nil {
+			return
+		}
+		if _, err := conn.Write(binary.BigEndian.AppendUint16(nil, uint16(len(resp)))); err != nil {
+			return
+		}
+		if _, err := conn.Write(resp); err != nil {
+			return
+		}
+	}
+}
+
+func (f *fakeDNS) answer(q []byte) []byte {
+	// Walk the question's name to find its type.
+	var labels []string
+	i := 12
+	for i < len(q) && q[i] != 0 {
+		l := int(q[i])
+		if i+1+l > len(q) {
+			return nil
+		}
+		labels = append(labels, string(q[i+1:i+1+l]))
+		i += 1 + l
+	}
+	if i+5 > len(q) {
+		return nil
+	}
+	name := strings.Join(labels, ".")
+	qtype := binary.BigEndian.Uint16(q[i+1:])
+	question := q[12 : i+5]
+	f.mu.Lock()
+	f.queries[name]++
+	addr := []byte{192, 0, 2, 1}
+	if strings.HasPrefix(name, "rebind") && qtype == 1 {
+		addr = []byte{93, 184, 216, 34}
+		if f.rebinds > 0 {
+			addr = []byte{127, 0, 0, 1}
+		}
+		f.rebinds++
+	}
+	f.mu.Unlock()
+
+	var rcode uint16
+	var answers int
+	switch {
+	case strings.HasPrefix(name, "found"), strings.HasPrefix(name, "rebind"):
+		if qtype == 1 { // A
+			answers = 1
+		}
+	case strings.HasPrefix(name, "missing"):
+		rcode = 3
+	default:
+		rcode = 2
+	}
+	resp := append([]byte{}, q[:2]...) // ID
+	resp = binary.BigEndian.AppendUint16(resp, 0x8180|rcode)
+	resp = append(resp, 0, 1, 0, byte(answers), 0, 0, 0, 0)
+	resp = append(resp, question...)
+	if answers > 0 {
+		// Name pointer, type A, class IN, TTL 60, 4 bytes of address.
+		resp = append(resp, 0xC0, 12, 0, 1, 0, 1, 0, 0, 0, 60, 0, 4)
+		resp = append(resp, addr...)
+	}
+	return resp
+}
+
+func TestDNSCache(t *testing.T) {
+	f := &fakeDNS{queries: make(map[string]int)}
+	lookup := func(c *DNSCache, host string) {
+		t.Helper()
+		addrs, err := c.LookupNetIP(context.Background(), host+".")
+		if strings.HasPrefix(host, "found") && (err != nil || len(addrs) != 1 || addrs[0].String() != "192.0.2.1") {
+			t.Errorf("lookup %s = %v, %v; want 192.0.2.1", host, addrs, err)
+		}
+		if !strings.HasPrefix(host, "found") && err == nil {
+			t.Errorf("lookup %s = %v, want an error", host, addrs)
+		}
+	}
+	// asked reports whether looking host up reached the server.
+	asked := func(c *DNSCache, host string) bool {
+		t.Helper()
+		before := f.count(host)
+		lookup(c, host)
+		return f.count(host) > before
+	}
+
+	t.Run("ttl", func(t *testing.T) {
+		c := NewDNSCache(f.resolver(), 8, 100*time.Millisecond)
+		if !asked(c, "found-ttl.test") || asked(c, "found-ttl.test") {
+			t.Error("second lookup within the TTL was not served from the cache")
+		}
+		time.Sleep(150 * time.Millisecond)
+		if !asked(c, "found-ttl.test") {
+			t.Error("lookup after the TTL was served from the cache")
+		}
+	})
+
+	t.Run("negative", func(t *testing.T) {
+		c := NewDNSCache(f.resolver(), 8, time.Hour)
+		start := time.Now()
+		if !asked(c, "missing.test") || asked(c, "missing.test") {
+			t.Error("NXDOMAIN was not cached")
+		}
+		var dnsErr *net.DNSError
+		if _, err := c.LookupNetIP(context.Background(), "missing.test."); !errors.As(err, &dnsErr) || !dnsErr.IsNotFound {
+			t.Errorf("cached error = %v, want not found", err)
+		}
+		c.mu.Lock()
+		expires := c.entries["missing.test."].Value.(*dnsEntry).expires
+		c.mu.Unlock()
+		if expires.After(start.Add(negativeTTL + time.Second)) {
+			t.Errorf("NXDOMAIN cached for %v, want at most %v", expires.Sub(start), negativeTTL)
+		}
+	})
+
+	t.Run("servfail", func(t *testing.T) {
+		c := NewDNSCache(f.resolver(), 8, time.Hour)
+		if !asked(c, "broken.test") || !asked(c, "broken.test") {
+			t.Error("SERVFAIL was cached")
+		}
+	})
+
+	t.Run("lru", func(t *testing.T) {
+		c := NewDNSCache(f.resolver(), 2, time.Hour)
+		asked(c, "found-a.test")
+		asked(c, "found-b.test")
+		asked(c, "found-a.test") // a is now the most recently used.
+		asked(c, "found-c.test")
+		if asked(c, "found-a.test") {
+			t.Error("recently used entry was evicted")
+		}
+		if !asked(c, "found-b.test") {
+			t.Error("least recently used entry was kept past the size")
+		}
+		if n := c.lru.Len(); n != 2 {
+			t.Errorf("cache holds %d entries, want 2", n)
+		}
+	})
+
+	t.Run("disabled", func(t *testing.T) {
+		for _, c := range []*DNSCache{
+			NewDNSCache(f.resolver(), 0, time.Hour),
+			NewDNSCache(f.resolver(), 8, 0),
+		} {
+			if !asked(c, "found-off.test") || !asked(c, "found-off.test") {
+				t.Errorf("cache of size %d and TTL %v kept an entry", c.size, c.ttl)
+			}
+		}
+	})
+}
@@ -0,0 +1,58 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"net/netip"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/ogpourya/iploop/pkg/proxy"
+)
+
+// maxExitIPBody bounds what is read from an IP echo service.
+const maxExitIPBody = 256
+
+// ExitIPLookup finds the public address each proxy's traffic leaves from
+// by fetching an IP echo service such as https://api.ipify.org through it.
+// The echo service must answer with the bare address.
+type ExitIPLookup struct {
+	d      ProxyDialer
+	u      *url.URL
+	target string
+	ttl    time.Duration
+}
+
+// NewExitIPLookup returns a lookup that fetches echoURL through d. Results
+// are kept on the proxy and reused for ttl.
+func NewExitIPLookup(d ProxyDialer, echoURL string, ttl time.Duration) (*ExitIPLookup, error) {
+	u, target, err := parseProbeURL(echoURL)
+	if err != nil {
+		return nil, err
+	}
+	return &ExitIPLookup{d: d, u: u, target: target, ttl: ttl}, nil
+}
+
+// Lookup returns p's exit IP, from the last lookup if it is younger than
+// the TTL, and records it with p.SetExitIP.
+func (l *ExitIPLookup) Lookup(ctx context.Context, p *proxy.Proxy) (string, error) {
+	if ip, at := p.ExitIP(); ip != "" && time.Since(at) < l.ttl {
+		return ip, nil
+	}
+
+	resp, err := fetchThrough(ctx, l.d, p, l.u, l.target, maxExitIPBody)
+	if err != nil {
+		return "", err
+	}
+	if resp.StatusCode != 200 {
+		return "", fmt.Errorf("IP echo service returned %s", resp.Status)
+	}
+	addr, err := netip.ParseAddr(strings.TrimSpace(string(resp.Body)))
+	if err != nil {
+		return "", fmt.Errorf("IP echo service did not return a bare IP address")
+	}
+	ip := addr.Unmap().String()
+	p.SetExitIP(ip)
+	return ip, nil
+}
@@ -0,0 +1,199 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"strings"
+)
+
+// ErrTargetBlocked is returned for destinations a TargetFilter rejects.
+var ErrTargetBlocked = errors.New("target not allowed")
+
+// TargetFilter restricts the destinations clients may reach. Rules are
+// CIDRs, IP addresses or domain names; a domain also covers its
+// subdomains, and a leading "*." is accepted for readability.
+type TargetFilter struct {
+	deny         rules
+	allow        rules
+	blockPrivate bool
+
+	// Resolve makes Check look hostnames up and test their addresses too.
+	// Set it with ResolveLocal; with remote resolution only the name is
+	// known here.
+	Resolve bool
+	// Resolver does those lookups; nil uses the system resolver. Give it
+	// the Dialer's so the filter sees the addresses that will be dialed.
+	Resolver *net.Resolver
+	// DNSCache, if set, answers those lookups in place of Resolver.
+	DNSCache *DNSCache
+}
+
+type rules struct {
+	prefixes []netip.Prefix
+	domains  []string
+}
+
+// NewTargetFilter builds a filter that rejects targets matching deny and,
+// if allow is not empty, everything not matching allow. blockPrivate also
+// denies loopback, private, link-local and unspecified addresses.
+func NewTargetFilter(deny, allow []string, blockPrivate bool) (*TargetFilter, error) {
+	f := &TargetFilter{blockPrivate: blockPrivate}
+	var err error
+	if f.deny, err = parseRules(deny); err != nil {
+		return nil, err
+	}
+	if f.allow, err = parseRules(allow); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func parseRules(entries []string) (rules, error) {
+	var r rules
+	for _, e := range entries {
+		e = strings.TrimSpace(e)
+		if e == "" {
+			continue
+		}
+		if p, err := netip.ParsePrefix(e); err == nil {
+			r.prefixes = append(r.prefixes, p.Masked())
+			continue
+		}
+		if a, err := netip.ParseAddr(e); err == nil {
+			r.prefixes = append(r.prefixes, netip.PrefixFrom(a.Unmap(), a.Unmap().BitLen()))
+			continue
+		}
+		d := normalizeHost(strings.TrimPrefix(e, "*."))
+		if d == "" || strings.ContainsAny(d, "/ ") {
+			return rules{}, fmt.Errorf("invalid filter rule %q", e)
+		}
+		r.domains = append(r.domains, d)
+	}
+	return r, nil
+}
+
+func (r rules) empty() bool {
+	return len(r.prefixes) == 0 && len(r.domains) == 0
+}
+
+func (r rules) matchHost(host string) bool {
+	for _, d := range r.domains {
+		if host == d || strings.HasSuffix(host, "."+d) {
+			return true
+		}
+	}
+	return false
+}
+
+func (r rules) matchAddr(a netip.Addr) bool {
+	for _, p := range r.prefixes {
+		if p.Contains(a) {
+			return true
+		}
+	}
+	return false
+}
+
+func normalizeHost(host string) string {
+	return strings.TrimSuffix(strings.ToLower(host), ".")
+}
+
+func isPrivate(a netip.Addr) bool {
+	return a.IsLoopback() || a.IsPrivate() || a.IsLinkLocalUnicast() ||
+		a.IsLinkLocalMulticast() || a.IsUnspecified()
+}
+
+// Check returns an error wrapping ErrTargetBlocked if target, a host:port,
+// may not be reached. With Resolve set, a hostname is blocked if any of
+// its addresses is, lookup failures are returned as is, and the addresses
+// checked are returned. The dial must go to one of those (see
+// ContextWithResolved): a second lookup may get a different answer, which
+// is how DNS rebinding would slip a private address past the filter.
+func (f *TargetFilter) Check(ctx context.Context, target string) ([]netip.Addr, error) {
+	host, _, err := net.SplitHostPort(target)
+	if err != nil {
+		return nil, err
+	}
+	host = normalizeHost(host)
+
+	var addrs []netip.Addr
+	if a, err := netip.ParseAddr(host); err == nil {
+		addrs = []netip.Addr{a.Unmap()}
+		host = ""
+	} else if f.deniedHost(host) {
+		return nil, fmt.Errorf("%w: %s", ErrTargetBlocked, host)
+	} else if f.Resolve {
+		ips, err := f.lookup(ctx, host)
+		if err != nil {
+			return nil, err
+		}
+		for _, a := range ips {
+			addrs = append(addrs, a.Unmap())
+		}
+	}
+	if err := f.check(host, addrs); err != nil {
+		return nil, err
+	}
+	if host == "" {
+		return nil, nil
+	}
+	return addrs, nil
+}
+
+func (f *TargetFilter) lookup(ctx context.Context, host string) ([]netip.Addr, error) {
+	if f.DNSCache != nil {
+		return f.DNSCache.LookupNetIP(ctx, host)
+	}
+	r := f.Resolver
+	if r == nil {
+		r = net.DefaultResolver
+	}
+	return r.LookupNetIP(ctx, "ip", host)
+}
+
+func (f *TargetFilter) deniedHost(host string) bool {
+	return f.deny.matchHost(host) || f.blockPrivate && host == "localhost"
+}
+
+// check tests a hostname (empty for IP literals) and its known addresses.
+func (f *TargetFilter) check(host string, addrs []netip.Addr) error {
+	if host != "" && f.deniedHost(host) {
+		return fmt.Errorf("%w: %s", ErrTargetBlocked, host)
+	}
+	allowed := f.allow.empty() || host != "" && f.allow.matchHost(host)
+	for _, a := range addrs {
+		if f.deny.matchAddr(a) || f.blockPrivate && isPrivate(a) {
+			return fmt.Errorf("%w: %s", ErrTargetBlocked, a)
+		}
+		if f.allow.matchAddr(a) {
+			allowed = true
+		}
+	}
+	if !allowed {
+		return fmt.Errorf("%w: %s not in allowlist", ErrTargetBlocked, describeTarget(host, addrs))
+	}
+	return nil
+}
+
+func describeTarget(host string, addrs []netip.Addr) string {
+	if host == "" && len(addrs) > 0 {
+		return addrs[0].String()
+	}
+	return host
+}
+
+// checkDatagram is Check for a UDP destination, without DNS lookups.
+func (f *TargetFilter) checkDatagram(dst string) error {
+	host, _, err := net.SplitHostPort(dst)
+	if err != nil {
+		return err
+	}
+	host = normalizeHost(host)
+	if a, err := netip.ParseAddr(host); err == nil {
+		return f.check("", []netip.Addr{a.Unmap()})
+	}
+	return f.check(host, nil)
+}
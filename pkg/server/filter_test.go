@@ -0,0 +1,188 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/netip"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ogpourya/iploop/pkg/proxy"
+)
+
+func TestTargetFilter(t *testing.T) {
+	tests := []struct {
+		deny, allow  []string
+		blockPrivate bool
+		target       string
+		blocked      bool
+	}{
+		{nil, nil, true, "127.0.0.1:80", true},
+		{nil, nil, true, "10.1.2.3:80", true},
+		{nil, nil, true, "172.16.0.1:80", true},
+		{nil, nil, true, "192.168.1.1:80", true},
+		{nil, nil, true, "169.254.169.254:80", true},
+		{nil, nil, true, "0.0.0.0:80", true},
+		{nil, nil, true, "[::1]:80", true},
+		{nil, nil, true, "[fe80::1]:80", true},
+		{nil, nil, true, "[fd00::1]:80", true},
+		{nil, nil, true, "[::ffff:10.0.0.1]:80", true},
+		{nil, nil, true, "localhost:80", true},
+		{nil, nil, true, "LocalHost.:80", true},
+		{nil, nil, true, "93.184.216.34:80", false},
+		{nil, nil, true, "example.com:443", false},
+		{nil, nil, false, "127.0.0.1:80", false},
+		{[]string{"203.0.113.0/24"}, nil, false, "203.0.113.9:80", true},
+		{[]string{"203.0.113.7"}, nil, false, "203.0.113.8:80", false},
+		{[]string{"example.com"}, nil, false, "example.com:80", true},
+		{[]string{"example.com"}, nil, false, "www.Example.COM:80", true},
+		{[]string{"*.example.com"}, nil, false, "api.example.com:80", true},
+		{[]string{"example.com"}, nil, false, "notexample.com:80", false},
+		{nil, []string{"example.com", "198.51.100.0/24"}, false, "cdn.example.com:443", false},
+		{nil, []string{"example.com", "198.51.100.0/24"}, false, "198.51.100.20:443", false},
+		{nil, []string{"example.com", "198.51.100.0/24"}, false, "example.org:443", true},
+		{nil, []string{"example.com", "198.51.100.0/24"}, false, "203.0.113.1:443", true},
+		{[]string{"bad.example.com"}, []string{"example.com"}, false, "bad.example.com:443", true},
+		{nil, []string{"10.0.0.0/8"}, true, "10.0.0.1:80", true},
+	}
+	for _, tt := range tests {
+		f, err := NewTargetFilter(tt.deny, tt.allow, tt.blockPrivate)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = f.Check(context.Background(), tt.target)
+		if blocked := errors.Is(err, ErrTargetBlocked); blocked != tt.blocked {
+			t.Errorf("deny %v allow %v private %v: Check(%s) = %v, want blocked %v",
+				tt.deny, tt.allow, tt.blockPrivate, tt.target, err, tt.blocked)
+		}
+	}
+}
+
+func TestTargetFilterBadRule(t *testing.T) {
+	for _, rule := range []string{"10.0.0.0/33", "*.", "exa mple.com", "a/b"} {
+		if _, err := NewTargetFilter([]string{rule}, nil, false); err == nil {
+			t.Errorf("NewTargetFilter accepted rule %q", rule)
+		}
+	}
+}
+
+func TestTargetFilterResolve(t *testing.T) {
+	cache := NewDNSCache(nil, 8, time.Hour)
+	expires := time.Now().Add(time.Hour)
+	cache.store(&dnsEntry{host: "internal.test", addrs: []netip.Addr{netip.MustParseAddr("10.0.0.5")}, expires: expires})
+	cache.store(&dnsEntry{host: "public.test", addrs: []netip.Addr{netip.MustParseAddr("93.184.216.34")}, expires: expires})
+
+	f, err := NewTargetFilter(nil, nil, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.DNSCache = cache
+	// Without Resolve only the name is known, so it passes.
+	if _, err := f.Check(context.Background(), "internal.test:80"); err != nil {
+		t.Errorf("unresolved check of a private name: %v", err)
+	}
+	f.Resolve = true
+	if _, err := f.Check(context.Background(), "internal.test:80"); !errors.Is(err, ErrTargetBlocked) {
+		t.Errorf("name resolving to 10.0.0.5: %v, want blocked", err)
+	}
+	addrs, err := f.Check(context.Background(), "public.test:80")
+	if err != nil || len(addrs) != 1 || addrs[0] != netip.MustParseAddr("93.184.216.34") {
+		t.Errorf("name resolving to a public address: %v, %v; want it allowed with its address", addrs, err)
+	}
+	if addrs, err := f.Check(context.Background(), "93.184.216.34:80"); err != nil || addrs != nil {
+		t.Errorf("IP literal: %v, %v; want it allowed with no addresses", addrs, err)
+	}
+}
+
+func TestServerRefusesPrivateTarget(t *testing.T) {
+	d := &scriptedDialer{dial: func(context.Context, *proxy.Proxy) (net.Conn, error) {
+		return nil, errors.New("filtered targets must not be dialed")
+	}}
+	r := proxy.NewRotator(proxy.RotationRandom, false, 0)
+	r.AddProxy(mustProxy(t, "http://p0:8080"))
+	f, err := NewTargetFilter(nil, nil, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := startServer(t, New(r, d, WithTargetFilter(f)))
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(2 * time.Second))
+	conn.Write([]byte{socks5Version, 1, authNone})
+	conn.Write([]byte{socks5Version, cmdConnect, 0, addrIPv4, 169, 254, 169, 254, 0, 80})
+	reply := make([]byte, 12)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(reply[:4], []byte{socks5Version, authNone, socks5Version, replyNotAllowed}) {
+		t.Errorf("server replied %x, want connection not allowed", reply)
+	}
+	if n := len(d.records()); n != 0 {
+		t.Errorf("server dialed %d times for a blocked target", n)
+	}
+}
+
+// A name that resolves to a public address for the filter and to loopback
+// afterwards must still be dialed at the address the filter checked.
+func TestServerDialsCheckedAddresses(t *testing.T) {
+	dns := &fakeDNS{queries: make(map[string]int)}
+	resolver := dns.resolver()
+	local := NewDialer(true, time.Second, nil)
+	local.SetResolveMode(ResolveLocal)
+	local.SetResolver(resolver)
+
+	var dialed []netip.Addr
+	var mu sync.Mutex
+	d := &scriptedDialer{dial: func(ctx context.Context, p *proxy.Proxy) (net.Conn, error) {
+		addrs, err := local.lookupTarget(ctx, "rebind.test")
+		if err != nil {
+			return nil, err
+		}
+		mu.Lock()
+		dialed = addrs
+		mu.Unlock()
+		return pipeConn(t), nil
+	}}
+	r := proxy.NewRotator(proxy.RotationRandom, false, 0)
+	r.AddProxy(mustProxy(t, "http://p0:8080"))
+	f, err := NewTargetFilter(nil, nil, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Resolve = true
+	f.Resolver = resolver
+	addr := startServer(t, New(r, d, WithTargetFilter(f)))
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(2 * time.Second))
+	conn.Write(append([]byte{socks5Version, 1, authNone}, domainRequest(cmdConnect, "rebind.test", 80)...))
+	reply := make([]byte, 4)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		t.Fatal(err)
+	}
+	if reply[3] != replySuccess {
+		t.Fatalf("server replied %x, want success", reply)
+	}
+	mu.Lock()
+	got := dialed
+	mu.Unlock()
+	if len(got) != 1 || got[0] != netip.MustParseAddr("93.184.216.34") {
+		t.Errorf("dialer used %v, want the 93.184.216.34 the filter allowed", got)
+	}
+	// Asked again, the name now points at loopback.
+	if addrs, err := local.lookupTarget(context.Background(), "rebind.test"); err != nil || len(addrs) != 1 || !addrs[0].IsLoopback() {
+		t.Errorf("second lookup = %v, %v; want the rebound 127.0.0.1", addrs, err)
+	}
+}
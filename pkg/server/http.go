@@ -0,0 +1,107 @@
+package server
+
+import (
+	"bufio"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// isHTTPMethodStart reports whether b can begin an HTTP request line.
+// Methods are upper-case tokens, which never collides with SOCKS5's 0x05.
+func isHTTPMethodStart(b byte) bool {
+	return b >= 'A' && b <= 'Z'
+}
+
+// handleHTTP serves an HTTP proxy client: CONNECT is tunnelled like a
+// SOCKS5 CONNECT, and absolute-form requests for plain http:// URLs are
+// forwarded, one per connection. br buffers reads from conn through hr.
+func (s *Server) handleHTTP(conn net.Conn, br *bufio.Reader, hr *handshakeReader, creds credentials) {
+	req, err := http.ReadRequest(br)
+	if err != nil {
+		writeHTTPError(conn, http.StatusBadRequest, nil)
+		return
+	}
+
+	var session string
+	if creds.username != "" {
+		var ok bool
+		if session, ok = s.checkProxyAuth(req, creds); !ok {
+			s.logger.Debug("HTTP proxy auth failed", "client", conn.RemoteAddr().String())
+			writeHTTPError(conn, http.StatusProxyAuthRequired, http.Header{
+				"Proxy-Authenticate": {`Basic realm="iploop"`},
+			})
+			return
+		}
+	}
+
+	var target string
+	if req.Method == http.MethodConnect {
+		target = withDefaultPort(req.Host, "443")
+	} else {
+		if req.URL.Scheme != "http" || req.URL.Host == "" {
+			writeHTTPError(conn, http.StatusBadRequest, nil)
+			return
+		}
+		target = withDefaultPort(req.URL.Host, "80")
+	}
+
+	hr.finish()
+	s.stats.TotalRequests.Add(1)
+
+	s.tunnel(wrapBuffered(conn, br), target, session, func(targetConn net.Conn, err error) error {
+		if errors.Is(err, ErrTargetBlocked) {
+			return writeHTTPError(conn, http.StatusForbidden, nil)
+		}
+		if err != nil {
+			return writeHTTPError(conn, http.StatusBadGateway, nil)
+		}
+		if req.Method == http.MethodConnect {
+			_, err := conn.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\n"))
+			return err
+		}
+		// The upstream connection is only good for this host, so ask the
+		// origin to close after responding rather than reuse it.
+		req.Header.Del("Proxy-Authorization")
+		req.Header.Del("Proxy-Connection")
+		req.Close = true
+		return req.Write(targetConn)
+	})
+}
+
+// checkProxyAuth validates Basic credentials in Proxy-Authorization and
+// returns the client's session token, if any.
+func (s *Server) checkProxyAuth(req *http.Request, creds credentials) (string, bool) {
+	auth, ok := strings.CutPrefix(req.Header.Get("Proxy-Authorization"), "Basic ")
+	if !ok {
+		return "", false
+	}
+	decoded, err := base64.StdEncoding.DecodeString(auth)
+	if err != nil {
+		return "", false
+	}
+	user, pass, _ := strings.Cut(string(decoded), ":")
+	return s.checkCredentials(user, pass, creds)
+}
+
+func withDefaultPort(host, port string) string {
+	if _, _, err := net.SplitHostPort(host); err == nil {
+		return host
+	}
+	return net.JoinHostPort(strings.Trim(host, "[]"), port)
+}
+
+func writeHTTPError(conn net.Conn, code int, header http.Header) error {
+	resp := fmt.Sprintf("HTTP/1.1 %d %s\r\n", code, http.StatusText(code))
+	for k, vs := range header {
+		for _, v := range vs {
+			resp += k + ": " + v + "\r\n"
+		}
+	}
+	resp += "Connection: close\r\nContent-Length: 0\r\n\r\n"
+	_, err := conn.Write([]byte(resp))
+	return err
+}
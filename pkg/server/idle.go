@@ -0,0 +1,102 @@
+package server
+
+import (
+	"errors"
+	"io"
+	"net"
+	"os"
+	"sync/atomic"
+	"time"
+)
+
+// idleTracker records the last time either direction of a relay moved data.
+type idleTracker struct {
+	timeout time.Duration
+	last    atomic.Int64
+}
+
+func newIdleTracker(timeout time.Duration) *idleTracker {
+	t := &idleTracker{timeout: timeout}
+	t.touch()
+	return t
+}
+
+func (t *idleTracker) touch() {
+	t.last.Store(time.Now().UnixNano())
+}
+
+func (t *idleTracker) idle() time.Duration {
+	return time.Since(time.Unix(0, t.last.Load()))
+}
+
+// idleConn applies a rolling read deadline shared by both sides of a relay,
+// so a one-way transfer keeps the quiet direction alive.
+type idleConn struct {
+	net.Conn
+	t *idleTracker
+}
+
+func (c *idleConn) Read(b []byte) (int, error) {
+	for {
+		c.Conn.SetReadDeadline(time.Now().Add(c.t.timeout - c.t.idle()))
+		n, err := c.Conn.Read(b)
+		if n > 0 {
+			c.t.touch()
+		}
+		if n == 0 && errors.Is(err, os.ErrDeadlineExceeded) && c.t.idle() < c.t.timeout {
+			continue
+		}
+		return n, err
+	}
+}
+
+func (c *idleConn) CloseWrite() error {
+	if cw, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return nil
+}
+
+// handshakeReadTimeout bounds each read during a client handshake, within
+// the overall handshake deadline, so a client that sends a byte and stalls
+// is dropped early instead of holding its slot for the whole window.
+const handshakeReadTimeout = 3 * time.Second
+
+// handshakeReader reads from a client connection, renewing the short
+// per-read deadline before every read until finish is called.
+type handshakeReader struct {
+	conn  net.Conn
+	until time.Time // overall handshake deadline; zero once finished
+}
+
+func newHandshakeReader(conn net.Conn, timeout time.Duration) *handshakeReader {
+	r := &handshakeReader{conn: conn, until: time.Now().Add(timeout)}
+	conn.SetDeadline(r.until)
+	return r
+}
+
+func (r *handshakeReader) Read(b []byte) (int, error) {
+	if !r.until.IsZero() {
+		d := time.Now().Add(handshakeReadTimeout)
+		if d.After(r.until) {
+			d = r.until
+		}
+		r.conn.SetReadDeadline(d)
+	}
+	return r.conn.Read(b)
+}
+
+// WriteTo lets a relay reading through the handshake's bufio.Reader reach
+// the connection's own WriteTo, and with it splice(2).
+func (r *handshakeReader) WriteTo(w io.Writer) (int64, error) {
+	if wt, ok := r.conn.(io.WriterTo); ok && r.until.IsZero() {
+		return wt.WriteTo(w)
+	}
+	return io.Copy(w, struct{ io.Reader }{r})
+}
+
+// finish clears the handshake deadlines before relaying.
+func (r *handshakeReader) finish() {
+	r.until = time.Time{}
+	r.conn.SetDeadline(time.Time{})
+}
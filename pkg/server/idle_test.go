@@ -0,0 +1,150 @@
+package server
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// tcpPair returns the two ends of a loopback TCP connection.
+func tcpPair(t testing.TB) (net.Conn, net.Conn) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		c, _ := ln.Accept()
+		accepted <- c
+	}()
+	a, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := <-accepted
+	if b == nil {
+		t.Fatal("accept failed")
+	}
+	t.Cleanup(func() {
+		a.Close()
+		b.Close()
+	})
+	return a, b
+}
+
+// startRelay relays between a client and a target connection through s
+// and returns the far ends: the client's and the target's.
+func startRelay(t testing.TB, s *Server) (client, target net.Conn, done <-chan struct{}) {
+	t.Helper()
+	client, relayClient := tcpPair(t)
+	relayTarget, target := tcpPair(t)
+	ch := make(chan struct{})
+	go func() {
+		s.relay(relayClient, relayTarget, nil)
+		close(ch)
+	}()
+	return client, target, ch
+}
+
+func TestRelayIdleTimeoutKeepsActiveTransfer(t *testing.T) {
+	s := New(nil, nil, WithIdleTimeout(200*time.Millisecond))
+	client, target, done := startRelay(t, s)
+
+	// Upload for well over the timeout while the download stays silent.
+	var sent bytes.Buffer
+	chunk := bytes.Repeat([]byte("x"), 512)
+	received := make(chan []byte)
+	go func() {
+		b, _ := io.ReadAll(target)
+		received <- b
+	}()
+	for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); {
+		if _, err := client.Write(chunk); err != nil {
+			t.Fatalf("write after %d bytes: %v", sent.Len(), err)
+		}
+		sent.Write(chunk)
+		time.Sleep(50 * time.Millisecond)
+	}
+	select {
+	case <-done:
+		t.Fatal("relay closed an active transfer")
+	default:
+	}
+
+	client.(*net.TCPConn).CloseWrite()
+	if got := <-received; !bytes.Equal(got, sent.Bytes()) {
+		t.Errorf("target received %d bytes, want %d", len(got), sent.Len())
+	}
+	target.Close()
+	<-done
+}
+
+func TestRelayIdleTimeoutClosesSilentConn(t *testing.T) {
+	s := New(nil, nil, WithIdleTimeout(100*time.Millisecond))
+	client, target, done := startRelay(t, s)
+
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("relay kept a silent connection open")
+	}
+	for _, c := range []net.Conn{client, target} {
+		c.SetReadDeadline(time.Now().Add(time.Second))
+		if n, err := c.Read(make([]byte, 1)); n != 0 || err == nil {
+			t.Errorf("read from closed relay = %d, %v; want EOF", n, err)
+		}
+	}
+}
+
+func TestRelayWithoutIdleTimeoutWaits(t *testing.T) {
+	s := New(nil, nil)
+	client, target, done := startRelay(t, s)
+
+	select {
+	case <-done:
+		t.Fatal("relay without an idle timeout closed a silent connection")
+	case <-time.After(300 * time.Millisecond):
+	}
+	client.Close()
+	target.Close()
+	<-done
+}
+
+// BenchmarkRelay measures one direction of a relay between loopback TCP
+// connections: without an idle timeout the copy can splice, with one it
+// goes through userspace buffers.
+func BenchmarkRelay(b *testing.B) {
+	for _, bm := range []struct {
+		name string
+		idle time.Duration
+	}{
+		{"splice", 0},
+		{"idle-timeout", time.Minute},
+	} {
+		b.Run(bm.name, func(b *testing.B) {
+			s := New(nil, nil, WithIdleTimeout(bm.idle))
+			client, target, done := startRelay(b, s)
+			chunk := make([]byte, 64<<10)
+			b.SetBytes(int64(len(chunk)))
+			b.ResetTimer()
+			go func() {
+				for range b.N {
+					if _, err := client.Write(chunk); err != nil {
+						return
+					}
+				}
+			}()
+			if _, err := io.CopyN(io.Discard, target, int64(b.N)*int64(len(chunk))); err != nil {
+				b.Fatal(err)
+			}
+			b.StopTimer()
+			client.Close()
+			target.Close()
+			<-done
+		})
+	}
+}
@@ -0,0 +1,152 @@
+package server
+
+import (
+	"log/slog"
+	"time"
+)
+
+// Option configures a Server created with New.
+type Option func(*Server)
+
+// WithDialer is the option form of SetDialer. It overrides the dialer
+// passed to New.
+func WithDialer(d ProxyDialer) Option {
+	return func(s *Server) {
+		s.SetDialer(d)
+	}
+}
+
+// WithLogger sets the logger for connection and dial events.
+func WithLogger(logger *slog.Logger) Option {
+	return func(s *Server) {
+		if logger != nil {
+			s.logger = logger
+		}
+	}
+}
+
+// WithRetryDelay sets the delay between attempts through different proxies.
+func WithRetryDelay(d time.Duration) Option {
+	return func(s *Server) {
+		s.retryDelay = d
+	}
+}
+
+// WithRetryPolicy is the option form of SetRetryPolicy.
+func WithRetryPolicy(maxRetries int, sequential bool) Option {
+	return func(s *Server) {
+		s.SetRetryPolicy(maxRetries, sequential)
+	}
+}
+
+// WithCredentials is the option form of SetCredentials.
+func WithCredentials(username, password string) Option {
+	return func(s *Server) {
+		s.SetCredentials(username, password)
+	}
+}
+
+// WithConnectTimeout is the option form of SetConnectTimeout.
+func WithConnectTimeout(d time.Duration) Option {
+	return func(s *Server) {
+		s.SetConnectTimeout(d)
+	}
+}
+
+// WithHandshakeDeadline is the option form of SetHandshakeDeadline.
+func WithHandshakeDeadline(d time.Duration) Option {
+	return func(s *Server) {
+		s.SetHandshakeDeadline(d)
+	}
+}
+
+// WithIdleTimeout is the option form of SetIdleTimeout.
+func WithIdleTimeout(d time.Duration) Option {
+	return func(s *Server) {
+		s.SetIdleTimeout(d)
+	}
+}
+
+// WithMaxSession is the option form of SetMaxSession.
+func WithMaxSession(d time.Duration) Option {
+	return func(s *Server) {
+		s.SetMaxSession(d)
+	}
+}
+
+// WithHideBindAddr is the option form of SetHideBindAddr.
+func WithHideBindAddr(on bool) Option {
+	return func(s *Server) {
+		s.SetHideBindAddr(on)
+	}
+}
+
+// WithTransparent is the option form of SetTransparent.
+func WithTransparent(on bool) Option {
+	return func(s *Server) {
+		s.SetTransparent(on)
+	}
+}
+
+// WithProxyProtocol is the option form of SetProxyProtocol.
+func WithProxyProtocol(on bool) Option {
+	return func(s *Server) {
+		s.SetProxyProtocol(on)
+	}
+}
+
+// WithKeepAlive is the option form of SetKeepAlive.
+func WithKeepAlive(period time.Duration) Option {
+	return func(s *Server) {
+		s.SetKeepAlive(period)
+	}
+}
+
+// WithTargetFilter is the option form of SetTargetFilter.
+func WithTargetFilter(f *TargetFilter) Option {
+	return func(s *Server) {
+		s.SetTargetFilter(f)
+	}
+}
+
+// WithStickyTargets is the option form of SetStickyTargets.
+func WithStickyTargets(on bool) Option {
+	return func(s *Server) {
+		s.SetStickyTargets(on)
+	}
+}
+
+// WithSessions is the option form of SetSessions.
+func WithSessions(on bool) Option {
+	return func(s *Server) {
+		s.SetSessions(on)
+	}
+}
+
+// WithForceRotateOnFail is the option form of SetForceRotateOnFail.
+func WithForceRotateOnFail(on bool) Option {
+	return func(s *Server) {
+		s.SetForceRotateOnFail(on)
+	}
+}
+
+// WithAcceptRate is the option form of SetAcceptRate.
+func WithAcceptRate(perSecond int) Option {
+	return func(s *Server) {
+		s.SetAcceptRate(perSecond)
+	}
+}
+
+// WithMaxConnsPerIP is the option form of SetMaxConnsPerIP.
+func WithMaxConnsPerIP(n int) Option {
+	return func(s *Server) {
+		s.SetMaxConnsPerIP(n)
+	}
+}
+
+// WithMaxConns is the option form of SetMaxConns.
+func WithMaxConns(n int, reject bool) Option {
+	return func(s *Server) {
+		s.SetMaxConns(n, reject)
+	}
+}
@@ -0,0 +1,68 @@
+//go:build linux
+
+package server
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"strconv"
+	"syscall"
+)
+
+// soOriginalDst is SO_ORIGINAL_DST from linux/netfilter_ipv4.h; the IPv6
+// option (IP6T_SO_ORIGINAL_DST) has the same value.
+const soOriginalDst = 80
+
+// originalDst returns the destination a client connected to before an
+// iptables REDIRECT rule sent it to us.
+func originalDst(conn net.Conn) (string, error) {
+	tc, ok := conn.(*net.TCPConn)
+	if !ok {
+		return "", fmt.Errorf("transparent mode needs TCP connections")
+	}
+	raw, err := tc.SyscallConn()
+	if err != nil {
+		return "", err
+	}
+	v6 := false
+	if addr, ok := tc.LocalAddr().(*net.TCPAddr); ok && addr.IP.To4() == nil {
+		v6 = true
+	}
+
+	// The getsockopt wrappers below are borrowed for their buffer sizes:
+	// the kernel fills them with a sockaddr_in or sockaddr_in6.
+	var ip net.IP
+	var port uint16
+	var sysErr error
+	err = raw.Control(func(fd uintptr) {
+		if v6 {
+			info, err := syscall.GetsockoptIPv6MTUInfo(int(fd), syscall.SOL_IPV6, soOriginalDst)
+			if err != nil {
+				sysErr = err
+				return
+			}
+			ip = net.IP(info.Addr.Addr[:])
+			// sin6_port is in network byte order.
+			var b [2]byte
+			binary.NativeEndian.PutUint16(b[:], info.Addr.Port)
+			port = binary.BigEndian.Uint16(b[:])
+			return
+		}
+		mreq, err := syscall.GetsockoptIPv6Mreq(int(fd), syscall.SOL_IP, soOriginalDst)
+		if err != nil {
+			sysErr = err
+			return
+		}
+		// struct sockaddr_in: family, port, address.
+		port = binary.BigEndian.Uint16(mreq.Multiaddr[2:4])
+		ip = net.IPv4(mreq.Multiaddr[4], mreq.Multiaddr[5], mreq.Multiaddr[6], mreq.Multiaddr[7])
+	})
+	if err != nil {
+		return "", err
+	}
+	if sysErr != nil {
+		return "", fmt.Errorf("SO_ORIGINAL_DST: %w", sysErr)
+	}
+	return net.JoinHostPort(ip.String(), strconv.Itoa(int(port))), nil
+}
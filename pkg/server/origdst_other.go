@@ -0,0 +1,12 @@
+//go:build !linux
+
+package server
+
+import (
+	"errors"
+	"net"
+)
+
+func originalDst(conn net.Conn) (string, error) {
+	return "", errors.New("transparent mode is only supported on Linux")
+}
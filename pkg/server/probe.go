@@ -0,0 +1,128 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"slices"
+
+	"github.com/ogpourya/iploop/pkg/proxy"
+)
+
+// NewProbe returns a health probe that tunnels through the proxy to
+// probeURL using d and fetches it with a GET. The proxy passes if the
+// response status is one of expect, or any 2xx status if expect is empty,
+// so proxies that connect but never forward traffic are caught.
+func NewProbe(d ProxyDialer, probeURL string, expect ...int) (proxy.ProbeFunc, error) {
+	u, target, err := parseProbeURL(probeURL)
+	if err != nil {
+		return nil, err
+	}
+
+	return func(ctx context.Context, p *proxy.Proxy) error {
+		resp, err := fetchThrough(ctx, d, p, u, target, 0)
+		if err != nil {
+			return err
+		}
+		if len(expect) == 0 && resp.StatusCode/100 == 2 || slices.Contains(expect, resp.StatusCode) {
+			return nil
+		}
+		return fmt.Errorf("probe returned %s", resp.Status)
+	}, nil
+}
+
+// NewTCPProbe returns a health probe that only connects to the proxy's
+// first hop, like proxy.TCPProbe, but looks its hostname up with d's
+// resolver.
+func NewTCPProbe(d *Dialer) proxy.ProbeFunc {
+	return func(ctx context.Context, p *proxy.Proxy) error {
+		hop := p.FirstHop()
+		conn, err := d.netDialer(hop).DialContext(ctx, "tcp", hop.Address())
+		if err != nil {
+			return err
+		}
+		return conn.Close()
+	}
+}
+
+// parseProbeURL checks an http or https URL and returns it with the
+// host:port to tunnel to.
+func parseProbeURL(rawURL string) (*url.URL, string, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, "", fmt.Errorf("invalid probe URL: %w", err)
+	}
+	if u.Hostname() == "" {
+		return nil, "", fmt.Errorf("probe URL missing hostname")
+	}
+
+	port := u.Port()
+	if port == "" {
+		switch u.Scheme {
+		case "http":
+			port = "80"
+		case "https":
+			port = "443"
+		default:
+			return nil, "", fmt.Errorf("unsupported probe scheme: %s", u.Scheme)
+		}
+	}
+	return u, net.JoinHostPort(u.Hostname(), port), nil
+}
+
+// probeResponse is the part of a response fetched through a proxy that
+// callers look at.
+type probeResponse struct {
+	StatusCode int
+	Status     string
+	Body       []byte
+}
+
+// fetchThrough GETs u through p, tunnelling to target with d, and returns
+// the response with at most limit bytes of its body.
+func fetchThrough(ctx context.Context, d ProxyDialer, p *proxy.Proxy, u *url.URL, target string, limit int64) (*probeResponse, error) {
+	conn, err := d.Dial(ctx, p, target)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	if u.Scheme == "https" {
+		tlsConn := tls.Client(conn, &tls.Config{ServerName: u.Hostname()})
+		if err := tlsConn.HandshakeContext(ctx); err != nil {
+			return nil, fmt.Errorf("probe TLS handshake: %w", err)
+		}
+		conn = tlsConn
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("User-Agent", "iploop")
+	req.Close = true
+	if err := req.Write(conn); err != nil {
+		return nil, fmt.Errorf("probe request: %w", err)
+	}
+	resp, err := http.ReadResponse(bufio.NewReader(conn), req)
+	if err != nil {
+		return nil, fmt.Errorf("probe response: %w", err)
+	}
+	defer resp.Body.Close()
+
+	out := &probeResponse{StatusCode: resp.StatusCode, Status: resp.Status}
+	if limit > 0 {
+		if out.Body, err = io.ReadAll(io.LimitReader(resp.Body, limit)); err != nil {
+			return nil, fmt.Errorf("probe response: %w", err)
+		}
+	}
+	return out, nil
+}
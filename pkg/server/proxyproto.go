@@ -0,0 +1,137 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// proxyV2Sig starts every PROXY protocol v2 header.
+var proxyV2Sig = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// maxProxyV1Len is the longest v1 header the spec allows, CRLF included.
+const maxProxyV1Len = 107
+
+// acceptProxyHeader consumes the PROXY protocol header a load balancer
+// sends ahead of the client's bytes and returns conn reporting the real
+// client address. Headers that carry no address (v1 UNKNOWN, v2 LOCAL or
+// unsupported families) leave conn as is.
+func acceptProxyHeader(conn net.Conn, br *bufio.Reader) (net.Conn, error) {
+	first, err := br.Peek(1)
+	if err != nil {
+		return conn, err
+	}
+	var remote net.Addr
+	switch first[0] {
+	case 'P':
+		remote, err = readProxyV1(br)
+	case '\r':
+		remote, err = readProxyV2(br)
+	default:
+		err = fmt.Errorf("missing PROXY protocol header")
+	}
+	if err != nil || remote == nil {
+		return conn, err
+	}
+	return &proxiedConn{Conn: conn, remote: remote}, nil
+}
+
+// readProxyV1 parses a header like "PROXY TCP4 1.2.3.4 5.6.7.8 1234 80\r\n".
+func readProxyV1(br *bufio.Reader) (net.Addr, error) {
+	line, err := br.ReadSlice('\n')
+	if err != nil && err != bufio.ErrBufferFull {
+		return nil, err
+	}
+	if len(line) > maxProxyV1Len || !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, fmt.Errorf("malformed PROXY v1 header")
+	}
+	fields := strings.Fields(string(line))
+	if len(fields) < 2 || fields[0] != "PROXY" {
+		return nil, fmt.Errorf("malformed PROXY v1 header")
+	}
+	if fields[1] == "UNKNOWN" {
+		return nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, fmt.Errorf("malformed PROXY v1 header")
+	}
+	ip := net.ParseIP(fields[2])
+	port, err := strconv.ParseUint(fields[4], 10, 16)
+	if ip == nil || err != nil {
+		return nil, fmt.Errorf("malformed PROXY v1 source address")
+	}
+	return &net.TCPAddr{IP: ip, Port: int(port)}, nil
+}
+
+// readProxyV2 parses the binary v2 header.
+func readProxyV2(br *bufio.Reader) (net.Addr, error) {
+	var hdr [16]byte
+	if _, err := io.ReadFull(br, hdr[:]); err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(hdr[:12], proxyV2Sig) {
+		return nil, fmt.Errorf("malformed PROXY v2 signature")
+	}
+	if hdr[12]>>4 != 2 {
+		return nil, fmt.Errorf("unsupported PROXY protocol version: %d", hdr[12]>>4)
+	}
+	body := make([]byte, binary.BigEndian.Uint16(hdr[14:16]))
+	if _, err := io.ReadFull(br, body); err != nil {
+		return nil, err
+	}
+
+	// LOCAL connections are health checks from the balancer itself.
+	if hdr[12]&0x0f == 0 {
+		return nil, nil
+	}
+	switch hdr[13] >> 4 {
+	case 1: // AF_INET: src, dst, sport, dport
+		if len(body) < 12 {
+			return nil, fmt.Errorf("short PROXY v2 address")
+		}
+		return &net.TCPAddr{IP: net.IP(body[0:4]), Port: int(binary.BigEndian.Uint16(body[8:10]))}, nil
+	case 2: // AF_INET6
+		if len(body) < 36 {
+			return nil, fmt.Errorf("short PROXY v2 address")
+		}
+		return &net.TCPAddr{IP: net.IP(body[0:16]), Port: int(binary.BigEndian.Uint16(body[32:34]))}, nil
+	}
+	return nil, nil
+}
+
+// proxiedConn reports the client address from a PROXY protocol header.
+// It forwards the copy fast paths so relaying can still splice.
+type proxiedConn struct {
+	net.Conn
+	remote net.Addr
+}
+
+func (c *proxiedConn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+func (c *proxiedConn) ReadFrom(r io.Reader) (int64, error) {
+	if rf, ok := c.Conn.(io.ReaderFrom); ok {
+		return rf.ReadFrom(r)
+	}
+	return io.Copy(struct{ io.Writer }{c.Conn}, r)
+}
+
+func (c *proxiedConn) WriteTo(w io.Writer) (int64, error) {
+	if wt, ok := c.Conn.(io.WriterTo); ok {
+		return wt.WriteTo(w)
+	}
+	return io.Copy(w, struct{ io.Reader }{c.Conn})
+}
+
+func (c *proxiedConn) CloseWrite() error {
+	if cw, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return nil
+}
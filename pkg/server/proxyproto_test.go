@@ -0,0 +1,87 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"strings"
+	"testing"
+)
+
+// proxyV2 builds a v2 header with the given version/command and
+// family/protocol bytes, declaring len(body) bytes of addresses.
+func proxyV2(verCmd, family byte, body []byte) []byte {
+	b := append([]byte{}, proxyV2Sig...)
+	b = append(b, verCmd, family)
+	b = binary.BigEndian.AppendUint16(b, uint16(len(body)))
+	return append(b, body...)
+}
+
+func TestAcceptProxyHeader(t *testing.T) {
+	v4 := []byte{203, 0, 113, 7, 10, 0, 0, 1, 0x30, 0x39, 0, 80}
+	v6 := make([]byte, 36)
+	copy(v6, net.ParseIP("2001:db8::7"))
+	binary.BigEndian.PutUint16(v6[32:], 4433)
+	tests := []struct {
+		name   string
+		in     string
+		remote string // Empty when conn keeps its own address
+		err    bool
+	}{
+		{"v1 tcp4", "PROXY TCP4 203.0.113.7 10.0.0.1 12345 80\r\n", "203.0.113.7:12345", false},
+		{"v1 tcp6", "PROXY TCP6 2001:db8::7 2001:db8::1 4433 443\r\n", "[2001:db8::7]:4433", false},
+		{"v1 unknown", "PROXY UNKNOWN\r\n", "", false},
+		{"v1 unknown with addresses", "PROXY UNKNOWN ff::1 ff::2 1 2\r\n", "", false},
+		{"v1 without CR", "PROXY TCP4 203.0.113.7 10.0.0.1 12345 80\n", "", true},
+		{"v1 missing port", "PROXY TCP4 203.0.113.7 10.0.0.1 12345\r\n", "", true},
+		{"v1 bad address", "PROXY TCP4 203.0.113.x 10.0.0.1 12345 80\r\n", "", true},
+		{"v1 port out of range", "PROXY TCP4 203.0.113.7 10.0.0.1 70000 80\r\n", "", true},
+		{"v1 udp", "PROXY UDP4 203.0.113.7 10.0.0.1 12345 80\r\n", "", true},
+		{"v1 too long", "PROXY TCP4 " + strings.Repeat("1", 120) + "\r\n", "", true},
+		{"v1 truncated", "PROXY TCP4 203.0.113.7", "", true},
+		{"v2 inet", string(proxyV2(0x21, 0x11, v4)), "203.0.113.7:12345", false},
+		{"v2 inet6", string(proxyV2(0x21, 0x21, v6)), "[2001:db8::7]:4433", false},
+		{"v2 inet with TLVs", string(proxyV2(0x21, 0x11, append(v4, 0x04, 0, 1, 'x'))), "203.0.113.7:12345", false},
+		{"v2 local", string(proxyV2(0x20, 0x00, nil)), "", false},
+		{"v2 unix family", string(proxyV2(0x21, 0x31, make([]byte, 216))), "", false},
+		{"v2 short inet body", string(proxyV2(0x21, 0x11, v4[:8])), "", true},
+		{"v2 short inet6 body", string(proxyV2(0x21, 0x21, v6[:20])), "", true},
+		{"v2 truncated body", string(proxyV2(0x21, 0x11, v4)[:16+6]), "", true},
+		{"v2 truncated header", string(proxyV2Sig[:10]), "", true},
+		{"v2 version 1", string(proxyV2(0x11, 0x11, v4)), "", true},
+		{"v2 bad signature", "\r\n\r\n\x00\r\nQUIX\n\x21\x11\x00\x0c" + string(v4), "", true},
+		{"no header", "\x05\x01\x00", "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn, _ := net.Pipe()
+			defer conn.Close()
+			// Truncated headers end the stream, so only good ones are
+			// followed by client bytes.
+			rest := "client bytes"
+			if tt.err {
+				rest = ""
+			}
+			br := bufio.NewReader(strings.NewReader(tt.in + rest))
+			got, err := acceptProxyHeader(conn, br)
+			if (err != nil) != tt.err {
+				t.Fatalf("error = %v, want error %v", err, tt.err)
+			}
+			if err != nil {
+				return
+			}
+			if tt.remote == "" {
+				if got != conn {
+					t.Errorf("conn replaced, reporting %s", got.RemoteAddr())
+				}
+			} else if got.RemoteAddr().String() != tt.remote {
+				t.Errorf("remote = %s, want %s", got.RemoteAddr(), tt.remote)
+			}
+			if b, _ := io.ReadAll(br); !bytes.Equal(b, []byte(rest)) {
+				t.Errorf("left %q after the header, want %q", b, rest)
+			}
+		})
+	}
+}
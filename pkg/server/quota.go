@@ -0,0 +1,59 @@
+package server
+
+import (
+	"net"
+	"net/netip"
+	"sync"
+)
+
+// ipQuota counts open connections per client IP against a limit. IPs
+// without connections are dropped, so the map only holds current clients.
+type ipQuota struct {
+	max int
+
+	mu    sync.Mutex
+	conns map[netip.Addr]int
+}
+
+func newIPQuota(max int) *ipQuota {
+	return &ipQuota{max: max, conns: make(map[netip.Addr]int)}
+}
+
+// acquire counts a connection from addr, reporting false without counting
+// it if the client is at its limit. Clients on Unix sockets are local and
+// not limited. A successful acquire must be paired with release.
+func (q *ipQuota) acquire(addr net.Addr) bool {
+	ip, ok := quotaKey(addr)
+	if !ok {
+		return true
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.conns[ip] >= q.max {
+		return false
+	}
+	q.conns[ip]++
+	return true
+}
+
+func (q *ipQuota) release(addr net.Addr) {
+	ip, ok := quotaKey(addr)
+	if !ok {
+		return
+	}
+	q.mu.Lock()
+	if q.conns[ip] <= 1 {
+		delete(q.conns, ip)
+	} else {
+		q.conns[ip]--
+	}
+	q.mu.Unlock()
+}
+
+func quotaKey(addr net.Addr) (netip.Addr, bool) {
+	tcp, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return netip.Addr{}, false
+	}
+	return tcp.AddrPort().Addr().Unmap(), true
+}
@@ -0,0 +1,116 @@
+package server
+
+import (
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/ogpourya/iploop/pkg/proxy"
+)
+
+func TestIPQuota(t *testing.T) {
+	a := &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 1000}
+	a2 := &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 2000}
+	mapped := &net.TCPAddr{IP: net.ParseIP("::ffff:192.0.2.1"), Port: 3000}
+	b := &net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 1000}
+	unix := &net.UnixAddr{Name: "/run/iploop.sock", Net: "unix"}
+
+	q := newIPQuota(2)
+	steps := []struct {
+		acquire bool // Otherwise release
+		addr    net.Addr
+		ok      bool
+	}{
+		{true, a, true},
+		{true, a2, true},
+		{true, mapped, false}, // Same client as a, over IPv6
+		{true, b, true},
+		{true, unix, true},
+		{true, unix, true},
+		{true, unix, true},
+		{false, a, true},
+		{true, mapped, true},
+		{true, a2, false},
+	}
+	for i, st := range steps {
+		if !st.acquire {
+			q.release(st.addr)
+			continue
+		}
+		if ok := q.acquire(st.addr); ok != st.ok {
+			t.Errorf("step %d: acquire(%s) = %v, want %v", i+1, st.addr, ok, st.ok)
+		}
+	}
+
+	for _, addr := range []net.Addr{a, mapped, b, unix} {
+		q.release(addr)
+	}
+	if n := len(q.conns); n != 0 {
+		t.Errorf("%d clients left in the map after every connection closed: %v", n, q.conns)
+	}
+}
+
+// socksConnect sends a SOCKS5 greeting and CONNECT request on conn and
+// returns the reply code.
+func socksConnect(t *testing.T, conn net.Conn) byte {
+	t.Helper()
+	conn.SetDeadline(time.Now().Add(2 * time.Second))
+	req := append([]byte{socks5Version, 1, authNone}, domainRequest(cmdConnect, "example.com", 80)...)
+	if _, err := conn.Write(req); err != nil {
+		t.Fatal(err)
+	}
+	reply := make([]byte, 4)
+	if _, err := io.ReadFull(conn, reply[:2]); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		t.Fatal(err)
+	}
+	return reply[1]
+}
+
+func TestServerConnsPerIP(t *testing.T) {
+	d := &scriptedDialer{dial: func(context.Context, *proxy.Proxy) (net.Conn, error) {
+		return pipeConn(t), nil
+	}}
+	s := New(retryRotator(t, 1), d, WithMaxConnsPerIP(2))
+	addr := startServer(t, s)
+
+	dial := func() net.Conn {
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { conn.Close() })
+		return conn
+	}
+
+	// Two silent clients hold both of this IP's slots.
+	first, _ := dial(), dial()
+	waitFor(t, func() bool { return s.Stats().ActiveConns.Load() == 2 })
+	if code := socksConnect(t, dial()); code != replyGeneralFail {
+		t.Errorf("third client got reply %#x, want general failure", code)
+	}
+	if n := s.Stats().RejectedConns.Load(); n != 1 {
+		t.Errorf("RejectedConns = %d, want 1", n)
+	}
+
+	first.Close()
+	waitFor(t, func() bool { return s.Stats().ActiveConns.Load() == 1 })
+	if code := socksConnect(t, dial()); code != replySuccess {
+		t.Errorf("client after one closed got reply %#x, want success", code)
+	}
+}
+
+// waitFor polls cond for up to two seconds.
+func waitFor(t *testing.T, cond func() bool) {
+	t.Helper()
+	for deadline := time.Now().Add(2 * time.Second); !cond(); {
+		if time.Now().After(deadline) {
+			t.Fatal("condition not met in time")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
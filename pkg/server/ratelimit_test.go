@@ -0,0 +1,69 @@
+package server
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestTokenBucketBurstThenRate(t *testing.T) {
+	const rate = 50
+	b := newTokenBucket(rate)
+	ctx := context.Background()
+
+	// A second's worth goes through at once.
+	start := time.Now()
+	for range rate {
+		b.wait(ctx)
+	}
+	if elapsed := time.Since(start); elapsed > 50*time.Millisecond {
+		t.Errorf("burst of %d took %v, want no waiting", rate, elapsed)
+	}
+
+	// After that, events are spaced out to the rate.
+	start = time.Now()
+	for range 10 {
+		b.wait(ctx)
+	}
+	want := 10 * time.Second / rate
+	if elapsed := time.Since(start); elapsed < want*8/10 || elapsed > 3*want {
+		t.Errorf("10 events after the burst took %v, want about %v", elapsed, want)
+	}
+}
+
+func TestTokenBucketRefillCapped(t *testing.T) {
+	b := newTokenBucket(20)
+	// An idle bucket fills up to a second's worth, not more.
+	b.mu.Lock()
+	b.tokens = 0
+	b.last = time.Now().Add(-time.Minute)
+	b.mu.Unlock()
+
+	start := time.Now()
+	for range 20 {
+		b.wait(context.Background())
+	}
+	if elapsed := time.Since(start); elapsed > 40*time.Millisecond {
+		t.Errorf("20 events from a full bucket took %v", elapsed)
+	}
+	start = time.Now()
+	b.wait(context.Background())
+	if elapsed := time.Since(start); elapsed < 30*time.Millisecond {
+		t.Errorf("event past the cap took %v, want about 50ms", elapsed)
+	}
+}
+
+func TestTokenBucketWaitCanceled(t *testing.T) {
+	b := newTokenBucket(1)
+	b.wait(context.Background()) // Takes the only token.
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if b.wait(ctx) {
+		t.Fatal("wait took a token that was not there")
+	}
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Errorf("canceled wait returned after %v, want about 50ms", elapsed)
+	}
+}
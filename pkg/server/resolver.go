@@ -0,0 +1,60 @@
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"strings"
+)
+
+// NewResolver returns a resolver that sends every query to the DNS server
+// at addr instead of the system's. addr is host:port, with port 53 by
+// default; prefixed with tls:// it is a DNS-over-TLS server, port 853 by
+// default, whose certificate is verified against its host. Go's own
+// resolver is used so that nothing falls back to the system one; only a
+// hostname in addr itself is looked up by the system.
+func NewResolver(addr string) (*net.Resolver, error) {
+	useTLS := false
+	if rest, ok := strings.CutPrefix(addr, "tls://"); ok {
+		addr, useTLS = rest, true
+	}
+	port := "53"
+	if useTLS {
+		port = "853"
+	}
+	host, p, err := net.SplitHostPort(addr)
+	if err != nil {
+		host, p = strings.Trim(addr, "[]"), port
+	}
+	if host == "" {
+		return nil, fmt.Errorf("invalid resolver address %q", addr)
+	}
+	if _, err := net.LookupPort("tcp", p); err != nil {
+		return nil, fmt.Errorf("invalid resolver port %q", p)
+	}
+	server := net.JoinHostPort(host, p)
+
+	var dialer net.Dialer
+	dial := func(ctx context.Context, network, _ string) (net.Conn, error) {
+		return dialer.DialContext(ctx, network, server)
+	}
+	if useTLS {
+		tlsConfig := &tls.Config{ServerName: host}
+		// A net.Conn that is not a PacketConn makes the resolver use
+		// TCP framing, which is what DNS-over-TLS carries.
+		dial = func(ctx context.Context, _, _ string) (net.Conn, error) {
+			conn, err := dialer.DialContext(ctx, "tcp", server)
+			if err != nil {
+				return nil, err
+			}
+			tc := tls.Client(conn, tlsConfig)
+			if err := tc.HandshakeContext(ctx); err != nil {
+				conn.Close()
+				return nil, err
+			}
+			return tc, nil
+		}
+	}
+	return &net.Resolver{PreferGo: true, Dial: dial}, nil
+}
@@ -1,14 +1,26 @@
+// Package server implements iploop's SOCKS5 and HTTP proxy front end,
+// which relays each client connection through a proxy picked by a
+// proxy.Rotator.
 package server
 
 import (
+	"bufio"
+	"cmp"
 	"context"
+	"crypto/subtle"
+	"crypto/tls"
 	"errors"
 	"fmt"
 	"io"
+	"log/slog"
 	"net"
+	"net/http"
 	"os"
+	"slices"
+	"strings"
 	"sync"
 	"sync/atomic"
+	"syscall"
 	"time"
 
 	"github.com/ogpourya/iploop/pkg/proxy"
@@ -17,14 +29,22 @@ import (
 const (
 	socks5Version    = 0x05
 	authNone         = 0x00
+	authGSSAPI       = 0x01
+	authUserPass     = 0x02
 	authNoAccept     = 0xFF
 	cmdConnect       = 0x01
+	cmdBind          = 0x02
+	cmdUDPAssociate  = 0x03
 	addrIPv4         = 0x01
 	addrDomain       = 0x03
 	addrIPv6         = 0x04
 	replySuccess     = 0x00
 	replyGeneralFail = 0x01
+	replyNotAllowed  = 0x02
+	replyNetUnreach  = 0x03
 	replyHostUnreach = 0x04
+	replyConnRefused = 0x05
+	replyTTLExpired  = 0x06
 	replyCmdNotSupp  = 0x07
 	replyAddrNotSupp = 0x08
 )
@@ -34,14 +54,70 @@ type Stats struct {
 	ActiveConns     atomic.Int64
 	SuccessRequests atomic.Int64
 	FailedRequests  atomic.Int64
+	MaxConns        atomic.Int64 // 0 means unlimited
+	RejectedConns   atomic.Int64
+	BytesUp         atomic.Int64 // Relayed from clients to targets
+	BytesDown       atomic.Int64 // Relayed from targets to clients
+	DialAttempts    atomic.Int64 // Dials through a proxy, counting every retry
+	Fallbacks       atomic.Int64 // Requests served by a proxy other than their first choice
+	RacedRequests   atomic.Int64 // Requests that had more than one dial in flight at once
+	RelayFailures   atomic.Int64 // Relays cut off by an upstream error after connecting
+}
+
+// Reset zeroes the counters. ActiveConns and MaxConns describe current
+// state rather than history and are kept. Each counter is reset atomically,
+// so concurrent updates land either before or after the reset, never lost
+// in between.
+func (st *Stats) Reset() {
+	st.TotalRequests.Store(0)
+	st.SuccessRequests.Store(0)
+	st.FailedRequests.Store(0)
+	st.RejectedConns.Store(0)
+	st.BytesUp.Store(0)
+	st.BytesDown.Store(0)
+	st.DialAttempts.Store(0)
+	st.Fallbacks.Store(0)
+	st.RacedRequests.Store(0)
+	st.RelayFailures.Store(0)
+}
+
+// dialTally records what the dials for one request did.
+type dialTally struct {
+	attempts int
+	raced    bool
 }
 
 type ProxyDialer interface {
 	Dial(ctx context.Context, p *proxy.Proxy, target string) (net.Conn, error)
 }
 
+// UDPDialer is implemented by dialers that can set up a SOCKS5 UDP
+// association through an upstream proxy.
+type UDPDialer interface {
+	DialUDP(ctx context.Context, p *proxy.Proxy) (ctrl net.Conn, relay net.Conn, err error)
+}
+
+// BindDialer is implemented by dialers that can have an upstream SOCKS5
+// proxy accept an inbound connection for a client (the BIND command).
+type BindDialer interface {
+	DialBind(ctx context.Context, p *proxy.Proxy, target string) (conn net.Conn, bound string, err error)
+	AcceptBind(conn net.Conn) (peer string, err error)
+}
+
+// listener is a listening socket and, if set, the credentials its clients
+// must present instead of the server-wide ones.
+type listener struct {
+	net.Listener
+	creds *credentials
+}
+
+type credentials struct {
+	username string
+	password string
+}
+
 type Server struct {
-	listener   net.Listener
+	listeners  []*listener
 	rotator    *proxy.Rotator
 	dialer     ProxyDialer
 	stats      *Stats
@@ -51,16 +127,51 @@ type Server struct {
 	ctx        context.Context
 	cancel     context.CancelFunc
 	wg         sync.WaitGroup
-	verbose    bool
+	logger     *slog.Logger
+	creds      credentials
+	idle       time.Duration
+	maxSession time.Duration
+	connectTTL time.Duration
+	hsDeadline time.Duration
+	keepAlive  time.Duration
+	filter     *TargetFilter
+	connSem    chan struct{}
+	rejectFull bool
+	rejectSem  chan struct{} // Bounds the goroutines answering rejected clients
+	acceptRate *tokenBucket
+	perIP      *ipQuota
+	paused     atomic.Bool
+
+	transparent   bool
+	hideBindAddr  bool
+	proxyProtocol bool
+	stickyTargets bool
+	sessions      bool
+	rotateOnFail  bool
+
+	maxRetries      int
+	sequentialRetry bool
+}
+
+// NewServer creates a server with the built-in Dialer. retryDelay is in
+// milliseconds and dialTimeout in seconds. Use New to supply a custom
+// ProxyDialer.
+func NewServer(rotator *proxy.Rotator, trustProxy bool, retryDelay int, dialTimeout int, logger *slog.Logger) *Server {
+	return New(rotator, NewDialer(trustProxy, time.Duration(dialTimeout)*time.Second, logger),
+		WithLogger(logger),
+		WithRetryDelay(time.Duration(retryDelay)*time.Millisecond))
 }
 
-func NewServer(rotator *proxy.Rotator, trustProxy bool, retryDelay int, dialTimeout int, verbose bool) *Server {
+// New creates a server that relays client connections through proxies
+// picked from rotator and dialed with dialer. A nil dialer uses NewDialer
+// with certificate verification disabled and a 5 second timeout.
+func New(rotator *proxy.Rotator, dialer ProxyDialer, opts ...Option) *Server {
 	ctx, cancel := context.WithCancel(context.Background())
-	return &Server{
+	s := &Server{
 		rotator:    rotator,
-		dialer:     NewDialer(trustProxy, time.Duration(dialTimeout)*time.Second, verbose),
+		dialer:     dialer,
 		stats:      &Stats{},
-		retryDelay: time.Duration(retryDelay) * time.Millisecond,
+		retryDelay: 100 * time.Millisecond,
 		bufPool: sync.Pool{
 			New: func() interface{} {
 				buf := make([]byte, 32*1024)
@@ -73,218 +184,830 @@ func NewServer(rotator *proxy.Rotator, trustProxy bool, retryDelay int, dialTime
 				return &buf
 			},
 		},
-		ctx:     ctx,
-		cancel:  cancel,
-		verbose: verbose,
+		ctx:        ctx,
+		cancel:     cancel,
+		rejectSem:  make(chan struct{}, maxRejecting),
+		logger:     slog.New(slog.DiscardHandler),
+		maxRetries: 3,
+		connectTTL: 10 * time.Second,
+		hsDeadline: 10 * time.Second,
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	if s.dialer == nil {
+		s.dialer = NewDialer(true, 5*time.Second, s.logger)
+	}
+	return s
+}
+
+// SetDialer replaces the dialer used for upstream connections, e.g. to add
+// custom DNS or to record dials in tests. A dialer that also implements
+// UDPDialer enables UDP ASSOCIATE, and one that implements BindDialer
+// enables BIND. It must be called before Serve.
+func (s *Server) SetDialer(d ProxyDialer) {
+	if d != nil {
+		s.dialer = d
+	}
+}
+
+// SetCredentials requires clients to authenticate with RFC 1929
+// username/password. It must be called before Serve.
+func (s *Server) SetCredentials(username, password string) {
+	s.creds = credentials{username, password}
+}
+
+// SetResolveMode selects where target hostnames are resolved when the
+// built-in Dialer is in use.
+func (s *Server) SetResolveMode(m ResolveMode) {
+	if d, ok := s.dialer.(*Dialer); ok {
+		d.SetResolveMode(m)
+	}
+}
+
+// SetTargetFilter restricts the destinations clients may reach. Blocked
+// requests are refused with "connection not allowed" (403 for HTTP
+// clients). A nil filter allows everything. It must be called before Serve.
+func (s *Server) SetTargetFilter(f *TargetFilter) {
+	s.filter = f
+}
+
+// SetStickyTargets makes every connection to a given target host use the
+// same proxy for as long as it stays alive (see proxy.Rotator.NextForTarget),
+// for sites that tie sessions or rate limits to the source IP. Targets
+// with a tag suffix keep using tag rotation. It must be called before Serve.
+func (s *Server) SetStickyTargets(on bool) {
+	s.stickyTargets = on
+}
+
+// SetSessions lets authenticated clients pin their requests to a proxy by
+// adding a session token to the username, as in alice-session-abc123: all
+// requests carrying the token use one proxy (see proxy.Rotator.NextForSession)
+// and a new token gets a new one. Tagged targets keep using tag rotation.
+// It must be called before Serve.
+func (s *Server) SetSessions(on bool) {
+	s.sessions = on
+}
+
+// SetForceRotateOnFail makes a failed request move the rotator off every
+// proxy it tried, so the next request leaves through another one even
+// when -requests-per-proxy would stay and the failed proxy is not skipped
+// as dead. It must be called before Serve.
+func (s *Server) SetForceRotateOnFail(on bool) {
+	s.rotateOnFail = on
+}
+
+// SetTLSConfig sets the base TLS configuration for HTTPS proxies when the
+// built-in Dialer is in use.
+func (s *Server) SetTLSConfig(cfg *tls.Config) {
+	if d, ok := s.dialer.(*Dialer); ok {
+		d.SetTLSConfig(cfg)
+	}
+}
+
+// SetMaxConns limits concurrently handled connections to n. When the limit
+// is reached the server either stops accepting until a slot frees up, or,
+// with reject set, answers new clients with a general failure; at most
+// maxRejecting are answered at once and the rest are closed. Zero means
+// unlimited. It must be called before Serve.
+func (s *Server) SetMaxConns(n int, reject bool) {
+	s.connSem = nil
+	if n > 0 {
+		s.connSem = make(chan struct{}, n)
+	}
+	s.rejectFull = reject
+	s.stats.MaxConns.Store(int64(n))
+}
+
+// SetAcceptRate limits how many connections are accepted per second,
+// across all listeners, with bursts of up to one second's worth. Beyond
+// it the server stops accepting, leaving new connections to wait in the
+// kernel's backlog. Zero means unlimited. It must be called before Serve.
+func (s *Server) SetAcceptRate(perSecond int) {
+	s.acceptRate = nil
+	if perSecond > 0 {
+		s.acceptRate = newTokenBucket(perSecond)
+	}
+}
+
+// SetMaxConnsPerIP limits the connections open at once from one client
+// IP to n, so a single client cannot take up the whole pool. Clients over
+// it are answered with a general failure. With the PROXY protocol the
+// address from the header counts. Zero means unlimited. It must be called
+// before Serve.
+func (s *Server) SetMaxConnsPerIP(n int) {
+	s.perIP = nil
+	if n > 0 {
+		s.perIP = newIPQuota(n)
+	}
+}
+
+// SetPaused makes the server answer new clients with a general failure,
+// as when over the limit in reject mode, until it is called with false.
+// Connections already open are unaffected.
+func (s *Server) SetPaused(paused bool) {
+	s.paused.Store(paused)
+}
+
+// SetRetryPolicy sets how many proxies a request may try. By default the
+// candidates are raced, each starting retryDelay after the previous one;
+// with sequential set they are tried one at a time with retryDelay between
+// attempts. It must be called before Serve.
+func (s *Server) SetRetryPolicy(maxRetries int, sequential bool) {
+	if maxRetries < 1 {
+		maxRetries = 1
+	}
+	s.maxRetries = maxRetries
+	s.sequentialRetry = sequential
+}
+
+// SetConnectTimeout caps the time a request may spend getting a tunnel to
+// its target, across every proxy it tries. When it expires, all dials still
+// in flight are cancelled. It must be called before Serve.
+func (s *Server) SetConnectTimeout(d time.Duration) {
+	if d > 0 {
+		s.connectTTL = d
+	}
+}
+
+// SetHandshakeDeadline limits how long a client may take to finish the
+// SOCKS or HTTP handshake and send its request. Each read within it also
+// has a shorter deadline of its own, so stalled clients are dropped early.
+// It must be called before Serve.
+func (s *Server) SetHandshakeDeadline(d time.Duration) {
+	if d > 0 {
+		s.hsDeadline = d
+	}
+}
+
+// SetIdleTimeout closes relayed connections after d without traffic in
+// either direction. Zero disables the timeout. It must be called before Serve.
+func (s *Server) SetIdleTimeout(d time.Duration) {
+	s.idle = d
+}
+
+// SetMaxSession closes relayed connections d after they were set up,
+// however busy they are, so long-lived clients such as streams and long
+// polls have to reconnect and go through rotation again. Zero means
+// unlimited. It must be called before Serve.
+func (s *Server) SetMaxSession(d time.Duration) {
+	s.maxSession = d
+}
+
+// SetHideBindAddr makes successful SOCKS5 CONNECT replies carry 0.0.0.0:0
+// instead of the local address of our connection to the proxy, so clients
+// learn nothing about the host. Most clients ignore the address; some
+// strict ones need a real one. BIND and UDP ASSOCIATE replies are not
+// affected, as clients must use their addresses. It must be called before
+// Serve.
+func (s *Server) SetHideBindAddr(on bool) {
+	s.hideBindAddr = on
+}
+
+// SetTransparent makes the server act as a transparent proxy: instead of a
+// SOCKS or HTTP handshake, each connection is relayed to its original
+// destination as recorded by an iptables REDIRECT rule. Linux only. It
+// must be called before Serve.
+func (s *Server) SetTransparent(on bool) {
+	s.transparent = on
+}
+
+// SetProxyProtocol makes the server expect a PROXY protocol v1 or v2
+// header at the start of every connection, as sent by load balancers, and
+// use the client address it carries. Connections without one are dropped.
+// It must be called before Serve.
+func (s *Server) SetProxyProtocol(on bool) {
+	s.proxyProtocol = on
+}
+
+// SetKeepAlive sets the TCP keepalive period for accepted client
+// connections and, when the built-in Dialer is in use, for connections to
+// proxies. Zero uses Go's default of 15 seconds and a negative value
+// disables keepalives. It must be called before Listen.
+func (s *Server) SetKeepAlive(period time.Duration) {
+	s.keepAlive = period
+	if d, ok := s.dialer.(*Dialer); ok {
+		d.SetKeepAlive(period)
 	}
 }
 
+func latencyMs(d time.Duration) slog.Attr {
+	return slog.Float64("latency_ms", float64(d.Microseconds())/1000)
+}
+
+// Stats returns the server's live counters. Fields are atomics and safe to
+// read while the server runs.
 func (s *Server) Stats() *Stats {
 	return s.stats
 }
 
+// Addr returns the address of the first listener.
 func (s *Server) Addr() string {
-	if s.listener == nil {
+	if len(s.listeners) == 0 {
 		return ""
 	}
-	return s.listener.Addr().String()
+	return s.listeners[0].Addr().String()
 }
 
-func (s *Server) Listen(addr string) error {
-	lc := net.ListenConfig{Control: setSocketOptions}
-	var err error
-	s.listener, err = lc.Listen(s.ctx, "tcp", addr)
+// Addrs returns the addresses of all listeners.
+func (s *Server) Addrs() []string {
+	addrs := make([]string, len(s.listeners))
+	for i, l := range s.listeners {
+		addrs[i] = l.Addr().String()
+	}
+	return addrs
+}
+
+// Ready reports whether the server is listening and has not been closed.
+func (s *Server) Ready() bool {
+	return len(s.listeners) > 0 && s.ctx.Err() == nil
+}
+
+// Listen opens a listener on each address. An address is a TCP host:port,
+// or a Unix socket path written as "unix:///run/iploop.sock" or as an
+// absolute or ./ path. Prefixing it with "user:pass@" requires those
+// credentials from its clients instead of the ones from SetCredentials.
+// If any address fails, none are left open.
+func (s *Server) Listen(addrs ...string) error {
+	var opened []*listener
+	for _, addr := range addrs {
+		l, err := s.listen(addr)
+		if err != nil {
+			for _, l := range opened {
+				l.Close()
+			}
+			return fmt.Errorf("listen failed: %w", err)
+		}
+		opened = append(opened, l)
+	}
+	s.listeners = append(s.listeners, opened...)
+	return nil
+}
+
+// splitListenAddr separates a Listen address into its credentials, if
+// any, network and address.
+func splitListenAddr(addr string) (*credentials, string, string) {
+	var creds *credentials
+	if i := strings.LastIndexByte(addr, '@'); i >= 0 {
+		user, pass, _ := strings.Cut(addr[:i], ":")
+		creds = &credentials{user, pass}
+		addr = addr[i+1:]
+	}
+	if path, ok := unixSocketPath(addr); ok {
+		return creds, "unix", path
+	}
+	return creds, "tcp", addr
+}
+
+// CheckListenAddr reports whether addr is well-formed for Listen, without
+// opening it.
+func CheckListenAddr(addr string) error {
+	_, network, a := splitListenAddr(addr)
+	if network == "unix" {
+		return nil
+	}
+	_, port, err := net.SplitHostPort(a)
 	if err != nil {
-		return fmt.Errorf("listen failed: %w", err)
+		return err
+	}
+	if _, err := net.LookupPort("tcp", port); err != nil {
+		return err
 	}
 	return nil
 }
 
+func (s *Server) listen(addr string) (*listener, error) {
+	l := &listener{}
+	var network string
+	l.creds, network, addr = splitListenAddr(addr)
+
+	lc := net.ListenConfig{Control: setSocketOptions, KeepAlive: s.keepAlive}
+	if network == "unix" {
+		if err := removeStaleSocket(addr); err != nil {
+			return nil, err
+		}
+	}
+	var err error
+	l.Listener, err = lc.Listen(s.ctx, network, addr)
+	if err != nil {
+		return nil, err
+	}
+	if network == "unix" {
+		// Local clients of the same user or group only.
+		if err := os.Chmod(addr, 0o660); err != nil {
+			l.Close()
+			return nil, err
+		}
+	}
+	return l, nil
+}
+
+// ListenAndServe listens on addrs and serves connections until Close.
+func (s *Server) ListenAndServe(addrs ...string) error {
+	if err := s.Listen(addrs...); err != nil {
+		return err
+	}
+	return s.Serve()
+}
+
+// Serve accepts connections on every listener opened by Listen until
+// Close. All listeners share the rotator, stats and connection limit.
 func (s *Server) Serve() error {
+	if len(s.listeners) == 0 {
+		return fmt.Errorf("no listeners")
+	}
+	var wg sync.WaitGroup
+	for _, l := range s.listeners[1:] {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s.serve(l)
+		}()
+	}
+	s.serve(s.listeners[0])
+	wg.Wait()
+	return nil
+}
+
+func (s *Server) serve(l *listener) {
+	creds := s.creds
+	if l.creds != nil {
+		creds = *l.creds
+	}
 	for {
-		conn, err := s.listener.Accept()
+		// Queue mode: hold off accepting until a slot is free.
+		if s.connSem != nil && !s.rejectFull {
+			select {
+			case s.connSem <- struct{}{}:
+			case <-s.ctx.Done():
+				return
+			}
+		}
+
+		if s.acceptRate != nil && !s.acceptRate.wait(s.ctx) {
+			if s.connSem != nil && !s.rejectFull {
+				<-s.connSem
+			}
+			return
+		}
+
+		conn, err := l.Accept()
 		if err != nil {
+			if s.connSem != nil && !s.rejectFull {
+				<-s.connSem
+			}
 			if errors.Is(err, net.ErrClosed) {
-				return nil
+				return
+			}
+			continue
+		}
+
+		if s.paused.Load() {
+			if s.connSem != nil && !s.rejectFull {
+				<-s.connSem
 			}
+			s.rejectConn(conn, creds)
 			continue
 		}
+
+		if s.connSem != nil && s.rejectFull {
+			select {
+			case s.connSem <- struct{}{}:
+			default:
+				s.rejectConn(conn, creds)
+				continue
+			}
+		}
+
 		s.stats.ActiveConns.Add(1)
 		s.wg.Add(1)
-		go s.handleConnection(conn)
+		go s.handleConnection(conn, creds)
+	}
+}
+
+// rejectDeadline bounds the handshake of a client that is only being told
+// it was rejected, shorter than a real one so rejected clients free their
+// slot among the maxRejecting quickly.
+const rejectDeadline = 2 * time.Second
+
+// maxRejecting caps the clients being answered with a failure at once. A
+// flood beyond it while full or paused is closed without an answer, so it
+// costs no goroutines.
+const maxRejecting = 128
+
+// rejectConn turns conn away without a slot, answering it in the
+// background if fewer than maxRejecting clients are already being turned
+// away and closing it straight away otherwise.
+func (s *Server) rejectConn(conn net.Conn, creds credentials) {
+	s.stats.RejectedConns.Add(1)
+	select {
+	case s.rejectSem <- struct{}{}:
+	default:
+		conn.Close()
+		return
+	}
+	s.wg.Add(1)
+	go func() {
+		s.reject(conn, creds)
+		<-s.rejectSem
+	}()
+}
+
+// reject completes the SOCKS handshake only to answer with a general
+// failure, so clients see a proper error instead of a reset.
+func (s *Server) reject(conn net.Conn, creds credentials) {
+	defer func() {
+		conn.Close()
+		s.wg.Done()
+	}()
+
+	if s.transparent {
+		// No handshake to answer; closing is all the client will see.
+		return
+	}
+
+	conn.SetDeadline(time.Now().Add(min(rejectDeadline, s.hsDeadline)))
+	br := bufio.NewReader(conn)
+	if s.proxyProtocol {
+		var err error
+		if conn, err = acceptProxyHeader(conn, br); err != nil {
+			return
+		}
 	}
+	s.refuse(conn, br, creds)
+}
+
+// refuse answers the client's request on conn, read through br, with a
+// general failure (503 for HTTP clients).
+func (s *Server) refuse(conn net.Conn, br *bufio.Reader, creds credentials) {
+	first, err := br.Peek(1)
+	if err != nil {
+		return
+	}
+	hs := &bufferedConn{Conn: conn, r: br}
+	if first[0] != socks5Version {
+		if isHTTPMethodStart(first[0]) {
+			if _, err := http.ReadRequest(br); err == nil {
+				writeHTTPError(conn, http.StatusServiceUnavailable, nil)
+			}
+		}
+		return
+	}
+	if _, err := s.negotiate(hs, creds); err != nil {
+		return
+	}
+	if _, _, err := s.readRequest(hs); err != nil {
+		return
+	}
+	s.sendReply(conn, replyGeneralFail, nil)
 }
 
 func (s *Server) Close() error {
 	s.cancel()
-	if s.listener != nil {
-		s.listener.Close()
+	for _, l := range s.listeners {
+		l.Close()
 	}
 	s.wg.Wait()
 	return nil
 }
 
-func (s *Server) handleConnection(conn net.Conn) {
+func (s *Server) handleConnection(conn net.Conn, creds credentials) {
 	defer func() {
 		conn.Close()
 		s.stats.ActiveConns.Add(-1)
+		if s.connSem != nil {
+			<-s.connSem
+		}
 		s.wg.Done()
 	}()
 
-	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	if s.transparent {
+		if s.perIP != nil {
+			if !s.perIP.acquire(conn.RemoteAddr()) {
+				s.stats.RejectedConns.Add(1)
+				return
+			}
+			defer s.perIP.release(conn.RemoteAddr())
+		}
+		s.handleTransparent(conn)
+		return
+	}
+
+	hr := newHandshakeReader(conn, s.hsDeadline)
+	br := bufio.NewReader(hr)
+	if s.proxyProtocol {
+		pc, err := acceptProxyHeader(conn, br)
+		if err != nil {
+			s.logger.Debug("bad PROXY protocol header", "client", conn.RemoteAddr().String(), "error", err)
+			return
+		}
+		conn = pc
+	}
 
-	if err := s.negotiate(conn); err != nil {
+	if s.perIP != nil {
+		if !s.perIP.acquire(conn.RemoteAddr()) {
+			s.logger.Debug("client over its connection limit", "client", conn.RemoteAddr().String())
+			s.stats.RejectedConns.Add(1)
+			s.refuse(conn, br, creds)
+			return
+		}
+		defer s.perIP.release(conn.RemoteAddr())
+	}
+
+	// One port serves SOCKS5 and HTTP proxy clients, told apart by the
+	// first byte.
+	first, err := br.Peek(1)
+	if err != nil {
+		return
+	}
+	hs := &bufferedConn{Conn: conn, r: br}
+	if first[0] != socks5Version {
+		if isHTTPMethodStart(first[0]) {
+			s.handleHTTP(conn, br, hr, creds)
+		}
 		return
 	}
 
-	target, err := s.readRequest(conn)
+	session, err := s.negotiate(hs, creds)
 	if err != nil {
-		s.sendReply(conn, replyGeneralFail, nil)
+		s.logger.Debug("SOCKS5 negotiate failed", "client", conn.RemoteAddr().String(), "error", err)
+		return
+	}
+
+	cmd, target, err := s.readRequest(hs)
+	if err != nil {
+		s.logger.Debug("bad SOCKS request", "client", conn.RemoteAddr().String(), "error", err)
 		return
 	}
 
-	conn.SetDeadline(time.Time{})
+	hr.finish()
 	s.stats.TotalRequests.Add(1)
 
-	s.handleNormal(conn, target)
+	switch cmd {
+	case cmdUDPAssociate:
+		s.handleUDPAssociate(hs)
+	case cmdBind:
+		s.handleBind(wrapBuffered(conn, br), target)
+	default:
+		s.tunnel(wrapBuffered(conn, br), target, session, func(targetConn net.Conn, err error) error {
+			if err != nil {
+				return s.sendReply(conn, replyCode(err), nil)
+			}
+			if s.hideBindAddr {
+				return s.sendReply(conn, replySuccess, nil)
+			}
+			return s.sendReply(conn, replySuccess, targetConn.LocalAddr())
+		})
+	}
+}
+
+// handleTransparent relays a connection redirected to us by the firewall
+// to the destination the client originally asked for.
+func (s *Server) handleTransparent(conn net.Conn) {
+	target, err := originalDst(conn)
+	if err != nil {
+		s.logger.Warn("no original destination", "client", conn.RemoteAddr().String(), "error", err)
+		return
+	}
+	s.stats.TotalRequests.Add(1)
+	s.tunnel(conn, target, "", func(net.Conn, error) error { return nil })
 }
 
-func (s *Server) handleNormal(conn net.Conn, target string) {
+// tunnel connects to target through the rotator, using the proxy of the
+// client's session if it named one, and relays conn to it. reply tells the
+// client how the connect went; if it fails on success, the tunnel is
+// dropped.
+func (s *Server) tunnel(conn net.Conn, target, session string, reply func(targetConn net.Conn, err error) error) {
+	target, tag := splitTag(target)
+	ctx := s.ctx
+	if s.filter != nil {
+		addrs, err := s.filter.Check(s.ctx, target)
+		if err != nil {
+			s.logger.Info("target refused", "client", conn.RemoteAddr().String(), "target", target, "error", err)
+			reply(nil, err)
+			return
+		}
+		if addrs != nil {
+			host, _, _ := net.SplitHostPort(target)
+			ctx = ContextWithResolved(ctx, host, addrs)
+		}
+	}
+
 	start := time.Now()
-	targetConn, usedProxy, err := s.connectToTarget(target)
+	targetConn, usedProxy, err := s.connectToTarget(ctx, conn.RemoteAddr(), target, tag, session)
 	latency := time.Since(start)
 
-	if s.verbose {
-		fmt.Fprintf(os.Stderr, "Connect to target %s took %v (success: %v)\n", target, latency, err == nil)
-	}
+	s.logger.Debug("connect to target", "client", conn.RemoteAddr().String(), "target", target, latencyMs(latency), "success", err == nil)
 
 	if err != nil {
 		s.stats.FailedRequests.Add(1)
-		if usedProxy != nil {
-			usedProxy.RecordFailure()
-		}
-		s.sendReply(conn, replyHostUnreach, nil)
+		reply(nil, err)
 		return
 	}
+	defer targetConn.Close()
 
 	s.stats.SuccessRequests.Add(1)
 	if usedProxy != nil {
 		usedProxy.RecordRequest(latency)
+		defer usedProxy.Release() // Reserved by connectToTarget
+		defer usedProxy.Track(conn, targetConn)()
 	}
 
-	var bindAddr *net.TCPAddr
-	if addr, ok := targetConn.LocalAddr().(*net.TCPAddr); ok {
-		bindAddr = addr
-	}
-	if err := s.sendReply(conn, replySuccess, bindAddr); err != nil {
+	if err := reply(targetConn, nil); err != nil {
 		return
 	}
 
-	s.relay(conn, targetConn)
+	s.relay(conn, targetConn, usedProxy)
 }
 
-func (s *Server) negotiate(conn net.Conn) error {
+// negotiate picks the SOCKS5 auth method: username/password if creds are
+// set, no auth otherwise. The client's whole list is searched, so its
+// order does not matter; a client offering GSSAPI first still gets no
+// auth if it also offers it. GSSAPI itself is not supported, and a client
+// offering nothing usable is told so with authNoAccept. It returns the
+// session token the client authenticated with, if any.
+func (s *Server) negotiate(conn net.Conn, creds credentials) (string, error) {
 	start := time.Now()
 	bufp := s.handshake.Get().(*[]byte)
 	defer s.handshake.Put(bufp)
 	buf := *bufp
 
 	if _, err := io.ReadFull(conn, buf[:2]); err != nil {
-		return err
+		return "", err
 	}
 	if buf[0] != socks5Version {
-		return fmt.Errorf("bad socks version")
+		return "", fmt.Errorf("bad socks version")
 	}
 	nmethods := int(buf[1])
 	if nmethods > 255 {
-		return fmt.Errorf("invalid nmethods")
+		return "", fmt.Errorf("invalid nmethods")
 	}
 	if _, err := io.ReadFull(conn, buf[:nmethods]); err != nil {
-		return err
+		return "", err
+	}
+	want := byte(authNone)
+	if creds.username != "" {
+		want = authUserPass
 	}
 	for i := 0; i < nmethods; i++ {
-		if buf[i] == authNone {
-			if _, err := conn.Write([]byte{socks5Version, authNone}); err != nil {
-				return err
+		if buf[i] == want {
+			if _, err := conn.Write([]byte{socks5Version, want}); err != nil {
+				return "", err
 			}
-			if s.verbose {
-				fmt.Fprintf(os.Stderr, "SOCKS5 negotiate took %v\n", time.Since(start))
+			var session string
+			if want == authUserPass {
+				var err error
+				if session, err = s.authenticate(conn, buf, creds); err != nil {
+					return "", err
+				}
 			}
-			return nil
+			s.logger.Debug("SOCKS5 negotiate done", "client", conn.RemoteAddr().String(), latencyMs(time.Since(start)))
+			return session, nil
 		}
 	}
 	conn.Write([]byte{socks5Version, authNoAccept})
-	return fmt.Errorf("no acceptable auth")
+	return "", fmt.Errorf("no acceptable auth method (client offered %s)", describeAuthMethods(buf[:nmethods]))
 }
 
-func (s *Server) readRequest(conn net.Conn) (string, error) {
+func describeAuthMethods(methods []byte) string {
+	names := make([]string, len(methods))
+	for i, m := range methods {
+		switch m {
+		case authNone:
+			names[i] = "none"
+		case authGSSAPI:
+			names[i] = "GSSAPI"
+		case authUserPass:
+			names[i] = "username/password"
+		default:
+			names[i] = fmt.Sprintf("0x%02x", m)
+		}
+	}
+	if len(names) == 0 {
+		return "nothing"
+	}
+	return strings.Join(names, ", ")
+}
+
+// authenticate runs the RFC 1929 username/password sub-negotiation and
+// returns the client's session token, if any.
+func (s *Server) authenticate(conn net.Conn, buf []byte, creds credentials) (string, error) {
+	if _, err := io.ReadFull(conn, buf[:2]); err != nil {
+		return "", err
+	}
+	if buf[0] != 0x01 {
+		return "", fmt.Errorf("bad auth version")
+	}
+	ulen := int(buf[1])
+	if _, err := io.ReadFull(conn, buf[:ulen+1]); err != nil {
+		return "", err
+	}
+	user := string(buf[:ulen])
+	plen := int(buf[ulen])
+	if _, err := io.ReadFull(conn, buf[:plen]); err != nil {
+		return "", err
+	}
+	pass := string(buf[:plen])
+
+	session, ok := s.checkCredentials(user, pass, creds)
+	if !ok {
+		conn.Write([]byte{0x01, 0x01})
+		return "", fmt.Errorf("auth failed for user %q", user)
+	}
+	_, err := conn.Write([]byte{0x01, 0x00})
+	return session, err
+}
+
+// sessionMarker separates the username from a session token in
+// user-session-token.
+const sessionMarker = "-session-"
+
+// checkCredentials reports whether user and pass match creds. With
+// sessions on, user may also be the configured username followed by a
+// session token, which is returned.
+func (s *Server) checkCredentials(user, pass string, creds credentials) (string, bool) {
+	passOK := subtle.ConstantTimeCompare([]byte(pass), []byte(creds.password))
+	if subtle.ConstantTimeCompare([]byte(user), []byte(creds.username))&passOK == 1 {
+		return "", true
+	}
+	if !s.sessions {
+		return "", false
+	}
+	// The last marker splits, so a configured username may contain one.
+	i := strings.LastIndex(user, sessionMarker)
+	if i < 0 || i+len(sessionMarker) == len(user) {
+		return "", false
+	}
+	userOK := subtle.ConstantTimeCompare([]byte(user[:i]), []byte(creds.username))
+	return user[i+len(sessionMarker):], userOK&passOK == 1
+}
+
+// readRequest reads a client's SOCKS5 request. Requests it can't serve are
+// answered with an error reply before it returns.
+func (s *Server) readRequest(conn net.Conn) (byte, string, error) {
 	bufp := s.handshake.Get().(*[]byte)
 	defer s.handshake.Put(bufp)
 	buf := *bufp
 
 	if _, err := io.ReadFull(conn, buf[:4]); err != nil {
-		return "", err
+		return 0, "", err
 	}
 	if buf[0] != socks5Version {
-		return "", fmt.Errorf("bad version")
+		s.sendReply(conn, replyGeneralFail, nil)
+		return 0, "", fmt.Errorf("bad version")
 	}
-	if buf[1] != cmdConnect {
+	cmd := buf[1]
+	if cmd != cmdConnect && cmd != cmdBind && cmd != cmdUDPAssociate {
 		s.sendReply(conn, replyCmdNotSupp, nil)
-		return "", fmt.Errorf("unsupported cmd")
+		return 0, "", fmt.Errorf("unsupported cmd")
 	}
 
-	var host string
 	switch buf[3] {
-	case addrIPv4:
-		if _, err := io.ReadFull(conn, buf[:4]); err != nil {
-			return "", err
-		}
-		host = net.IP(buf[:4]).String()
-	case addrDomain:
-		if _, err := io.ReadFull(conn, buf[:1]); err != nil {
-			return "", err
-		}
-		dlen := int(buf[0])
-		if _, err := io.ReadFull(conn, buf[:dlen]); err != nil {
-			return "", err
-		}
-		host = string(buf[:dlen])
-	case addrIPv6:
-		if _, err := io.ReadFull(conn, buf[:16]); err != nil {
-			return "", err
-		}
-		host = net.IP(buf[:16]).String()
+	case addrIPv4, addrDomain, addrIPv6:
 	default:
 		s.sendReply(conn, replyAddrNotSupp, nil)
-		return "", fmt.Errorf("bad addr type")
+		return 0, "", fmt.Errorf("bad addr type")
 	}
 
-	if _, err := io.ReadFull(conn, buf[:2]); err != nil {
-		return "", err
+	target, err := readSocksAddr(conn, buf[3])
+	if err != nil {
+		return 0, "", err
 	}
-	port := int(buf[0])<<8 | int(buf[1])
-	return fmt.Sprintf("%s:%d", host, port), nil
+	if err := checkTarget(cmd, target); err != nil {
+		s.sendReply(conn, replyAddrNotSupp, nil)
+		return 0, "", fmt.Errorf("bad target %q: %w", target, err)
+	}
+	return cmd, target, nil
 }
 
-func (s *Server) sendReply(conn net.Conn, reply byte, addr *net.TCPAddr) error {
+func (s *Server) sendReply(conn net.Conn, reply byte, addr net.Addr) error {
+	var ip net.IP
+	var port int
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		ip, port = a.IP, a.Port
+	case *net.UDPAddr:
+		ip, port = a.IP, a.Port
+	}
+
 	var resp [22]byte
 	resp[0] = socks5Version
 	resp[1] = reply
 	resp[2] = 0x00
 
 	n := 4
-	if addr != nil {
-		if ip4 := addr.IP.To4(); ip4 != nil {
+	if ip != nil {
+		if ip4 := ip.To4(); ip4 != nil {
 			resp[3] = addrIPv4
 			copy(resp[4:8], ip4)
 			n = 8
-		} else if ip6 := addr.IP.To16(); ip6 != nil {
+		} else {
 			resp[3] = addrIPv6
-			copy(resp[4:20], ip6)
+			copy(resp[4:20], ip.To16())
 			n = 20
 		}
-		resp[n] = byte(addr.Port >> 8)
-		resp[n+1] = byte(addr.Port)
+		resp[n] = byte(port >> 8)
+		resp[n+1] = byte(port)
 		n += 2
 	} else {
 		resp[3] = addrIPv4
@@ -296,29 +1019,179 @@ func (s *Server) sendReply(conn net.Conn, reply byte, addr *net.TCPAddr) error {
 	return err
 }
 
-func (s *Server) connectToTarget(target string) (net.Conn, *proxy.Proxy, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+// replyCode picks the SOCKS5 reply that best describes why connecting to
+// a target failed, falling back to general failure.
+func replyCode(err error) byte {
+	var socksErr *SOCKS5Error
+	var httpErr *httpStatusError
+	var dnsErr *net.DNSError
+	var netErr net.Error
+	switch {
+	case errors.As(err, &socksErr):
+		if socksErr.Code > replySuccess && socksErr.Code <= replyAddrNotSupp {
+			return socksErr.Code
+		}
+	case errors.As(err, &httpErr):
+		switch httpErr.code {
+		case http.StatusForbidden:
+			return replyNotAllowed
+		case http.StatusBadGateway, http.StatusServiceUnavailable:
+			return replyHostUnreach
+		case http.StatusGatewayTimeout:
+			return replyTTLExpired
+		}
+	case errors.Is(err, ErrTargetBlocked):
+		return replyNotAllowed
+	case errors.Is(err, ErrUnsupportedTarget):
+		return replyAddrNotSupp
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return replyConnRefused
+	case errors.Is(err, syscall.ENETUNREACH):
+		return replyNetUnreach
+	case errors.Is(err, syscall.EHOSTUNREACH), errors.As(err, &dnsErr):
+		return replyHostUnreach
+	case errors.Is(err, context.DeadlineExceeded), errors.As(err, &netErr) && netErr.Timeout():
+		return replyTTLExpired
+	}
+	return replyGeneralFail
+}
+
+// connectToTarget dials target on behalf of client through proxies from
+// the rotator, preferring those tagged tag when it is not empty and
+// otherwise the proxy bound to session if one is given. A connection slot
+// is reserved on each proxy as it is picked; the returned proxy keeps its
+// slot, which the caller must Release when the connection ends. Dials run
+// under ctx, which carries the filter's addresses for target, if any.
+func (s *Server) connectToTarget(ctx context.Context, client net.Addr, target, tag, session string) (net.Conn, *proxy.Proxy, error) {
+	ctx, cancel := context.WithTimeout(ContextWithClientAddr(ctx, client), s.connectTTL)
 	defer cancel()
 
-	maxRetries := 3
-	proxies := make([]*proxy.Proxy, 0, maxRetries)
-	tried := make(map[*proxy.Proxy]bool)
+	// Sessions keep to their proxy and sticky targets go to their host's
+	// proxy, then their next choices. Tags take precedence over both.
+	next := func(tried []*proxy.Proxy) (*proxy.Proxy, error) {
+		return s.rotator.NextTagged(tag, tried...)
+	}
+	switch {
+	case tag != "":
+		// Tag rotation, as above.
+	case session != "":
+		next = func(tried []*proxy.Proxy) (*proxy.Proxy, error) {
+			return s.rotator.NextForSession(session, tried...)
+		}
+	case s.stickyTargets:
+		host, _, _ := net.SplitHostPort(target)
+		host = strings.ToLower(host)
+		next = func(tried []*proxy.Proxy) (*proxy.Proxy, error) {
+			return s.rotator.NextForTarget(host, tried...)
+		}
+	}
 
-	for i := 0; i < maxRetries; i++ {
-		p, err := s.rotator.Next()
+	c := &candidates{next: next, reserve: s.rotator.Reserve, left: s.maxRetries}
+	var lastErr error
+	var tally dialTally
+	defer func() {
+		s.stats.DialAttempts.Add(int64(tally.attempts))
+		if tally.raced {
+			s.stats.RacedRequests.Add(1)
+		}
+	}()
+	for {
+		picked := len(c.tried)
+		attempt := s.race
+		if s.sequentialRetry {
+			attempt = s.sequential
+		}
+		conn, p, unsupported, err := attempt(ctx, c, target, &tally)
+		if err == nil {
+			if p != c.tried[0] {
+				s.stats.Fallbacks.Add(1)
+			}
+			return conn, p, nil
+		}
+		if len(c.tried) == picked {
+			// Nothing left to try; keep the last dial error if there was one.
+			if lastErr == nil {
+				lastErr = err
+			}
+			s.failed(c.tried)
+			return nil, nil, lastErr
+		}
+		lastErr = err
+		// Proxies that can't reach this kind of target aren't at fault;
+		// replace them with fresh candidates instead of giving up.
+		if unsupported == 0 {
+			s.failed(c.tried)
+			return nil, nil, lastErr
+		}
+		c.left = unsupported
+	}
+}
+
+// candidates hands out the proxies to try for one request. Each is picked
+// from the rotator only when it is about to be dialed, so fallbacks that
+// turn out not to be needed don't use up rotation.
+type candidates struct {
+	next    func(tried []*proxy.Proxy) (*proxy.Proxy, error)
+	reserve func(p *proxy.Proxy) bool // Takes a connection slot on p; see Rotator.Reserve
+	tried   []*proxy.Proxy
+	full    []*proxy.Proxy // Picked but at their connection limit
+	left    int            // Picks allowed before the caller refills
+	err     error          // Why the rotator had nothing more, once it didn't
+}
+
+// pop picks the next proxy and reserves a connection slot on it, or
+// returns nil when there is none. The caller must Release the proxy once
+// its dial fails or its connection ends.
+func (c *candidates) pop() *proxy.Proxy {
+	if c.left <= 0 || c.err != nil {
+		return nil
+	}
+	for {
+		exclude := append(slices.Clip(c.tried), c.full...)
+		p, err := c.next(exclude)
+		if err == nil && slices.Contains(exclude, p) {
+			err = proxy.ErrNoMoreProxies
+		}
 		if err != nil {
-			break
+			c.err = err
+			return nil
 		}
-		if tried[p] {
+		if c.reserve != nil && !c.reserve(p) {
+			c.full = append(c.full, p)
 			continue
 		}
-		tried[p] = true
-		proxies = append(proxies, p)
+		c.left--
+		c.tried = append(c.tried, p)
+		return p
 	}
+}
 
-	if len(proxies) == 0 {
-		return nil, nil, fmt.Errorf("no proxies available")
+// failure explains why no proxy was dialed.
+func (c *candidates) failure() error {
+	if c.err != nil {
+		return c.err
 	}
+	return fmt.Errorf("no proxies available")
+}
+
+// failed moves the rotator off the proxies a failed request tried, if
+// SetForceRotateOnFail is on.
+func (s *Server) failed(tried []*proxy.Proxy) {
+	if !s.rotateOnFail {
+		return
+	}
+	for _, p := range tried {
+		s.rotator.Advance(p)
+	}
+}
+
+// race dials target through the candidates concurrently, happy-eyeballs
+// style: each candidate starts retryDelay after the previous one, or as
+// soon as it fails. It returns the first connection to succeed. unsupported
+// counts proxies that failed with ErrUnsupportedTarget.
+func (s *Server) race(ctx context.Context, c *candidates, target string, tally *dialTally) (net.Conn, *proxy.Proxy, int, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
 
 	type result struct {
 		conn  net.Conn
@@ -326,59 +1199,259 @@ func (s *Server) connectToTarget(target string) (net.Conn, *proxy.Proxy, error)
 		err   error
 	}
 
-	resultCh := make(chan result, len(proxies))
+	resultCh := make(chan result, c.left)
 
-	for _, p := range proxies {
-		go func(p *proxy.Proxy) {
+	more := true
+	launch := func(pending int) bool {
+		p := c.pop()
+		if p == nil {
+			more = false
+			return false
+		}
+		tally.attempts++
+		if pending > 0 {
+			tally.raced = true
+		}
+		go func() {
 			conn, err := s.dialer.Dial(ctx, p, target)
 			resultCh <- result{conn, p, err}
-		}(p)
+		}()
+		return true
 	}
 
 	var lastErr error
-	for i := 0; i < len(proxies); i++ {
-		res := <-resultCh
-		if res.err == nil {
-			cancel()
-			if s.verbose {
-				fmt.Fprintf(os.Stderr, "Using proxy %s for %s\n", res.proxy, target)
+	unsupported := 0
+	for pending := 0; pending > 0 || more; {
+		if more && (pending == 0 || s.retryDelay <= 0) {
+			if launch(pending) {
+				pending++
 			}
-			return res.conn, res.proxy, nil
+			continue
 		}
-		if s.verbose {
-			fmt.Fprintf(os.Stderr, "Failed to connect via proxy %s to %s: %v\n", res.proxy, target, res.err)
+
+		var timer *time.Timer
+		var stagger <-chan time.Time
+		if more {
+			timer = time.NewTimer(s.retryDelay)
+			stagger = timer.C
+		}
+
+		select {
+		case <-stagger:
+			if launch(pending) {
+				pending++
+			}
+		case res := <-resultCh:
+			if timer != nil {
+				timer.Stop()
+			}
+			pending--
+			if res.err == nil {
+				cancel()
+				// Losers may still connect before they see the cancel;
+				// resultCh is buffered for all of them, so drain it in the
+				// background and close whatever got through.
+				go func(n int) {
+					for ; n > 0; n-- {
+						r := <-resultCh
+						if r.conn != nil {
+							r.conn.Close()
+						}
+						r.proxy.Release()
+					}
+				}(pending)
+				s.logger.Debug("using proxy", "proxy", res.proxy.String(), "target", target, "attempts", tally.attempts)
+				return res.conn, res.proxy, unsupported, nil
+			}
+			lastErr = res.err
+			res.proxy.Release()
+			if s.dialFailed(ctx, res.proxy, target, res.err) {
+				unsupported++
+			}
 		}
-		lastErr = res.err
-		s.rotator.MarkDead(res.proxy)
 	}
 
-	return nil, nil, lastErr
+	if lastErr == nil {
+		lastErr = c.failure()
+	}
+	return nil, nil, unsupported, lastErr
 }
 
-func (s *Server) relay(client, target net.Conn) {
+// sequential dials target through one proxy at a time, waiting retryDelay
+// between attempts.
+func (s *Server) sequential(ctx context.Context, c *candidates, target string, tally *dialTally) (net.Conn, *proxy.Proxy, int, error) {
+	var lastErr error
+	unsupported := 0
+	for i := 0; ; i++ {
+		p := c.pop()
+		if p == nil {
+			break
+		}
+		if i > 0 && s.retryDelay > 0 {
+			select {
+			case <-time.After(s.retryDelay):
+			case <-ctx.Done():
+				p.Release()
+				return nil, nil, unsupported, ctx.Err()
+			}
+		}
+
+		tally.attempts++
+		conn, err := s.dialer.Dial(ctx, p, target)
+		if err == nil {
+			s.logger.Debug("using proxy", "proxy", p.String(), "target", target, "attempts", tally.attempts)
+			return conn, p, unsupported, nil
+		}
+		lastErr = err
+		p.Release()
+		if s.dialFailed(ctx, p, target, err) {
+			unsupported++
+		}
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	if lastErr == nil {
+		lastErr = c.failure()
+	}
+	return nil, nil, unsupported, lastErr
+}
+
+// dialFailed handles a failed dial through p and reports whether the
+// failure was ErrUnsupportedTarget, which doesn't count against the proxy.
+// Neither does a dial we cancelled ourselves.
+func (s *Server) dialFailed(ctx context.Context, p *proxy.Proxy, target string, err error) bool {
+	if ctx.Err() != nil && (errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded)) {
+		s.logger.Debug("dial via proxy cancelled", "proxy", p.String(), "target", target, "error", err)
+		return false
+	}
+	if errors.Is(err, ErrUnsupportedTarget) {
+		s.logger.Debug("proxy cannot reach target", "proxy", p.String(), "target", target, "error", err)
+		return true
+	}
+	s.logger.Warn("dial via proxy failed", "proxy", p.String(), "target", target, "error", err)
+	s.rotator.MarkDead(p)
+	return false
+}
+
+// relayFailuresToDead is how many relays in a row may break through a
+// proxy after connecting before it is marked dead.
+const relayFailuresToDead = 3
+
+// relayDone records how a relay through p ended, given the errors of its
+// upload and download copies. An error on target, such as a reset from
+// the proxy mid-transfer, counts as a failure of p, and a run of them
+// takes p out of rotation as a failed dial would. Errors on the client's
+// side, like a client hanging up abruptly, and our own closes for timeouts
+// do not count against p, and neither does a relay that ends normally,
+// which starts the run over.
+//
+// Which side failed is told from the connection and operation named in
+// the error. Spliced copies (see relay) don't say which side failed, so
+// their errors are not counted.
+func (s *Server) relayDone(p *proxy.Proxy, client, target net.Conn, upErr, downErr error) {
+	var err error
+	switch {
+	case failedOn(upErr, target, "write"):
+		err = upErr
+	case failedOn(downErr, target, "read"):
+		err = downErr
+	}
+	if err == nil {
+		if cerr := cmp.Or(upErr, downErr); cerr != nil && !ownClose(cerr) {
+			s.logger.Debug("client connection broke", "client", client.RemoteAddr().String(), "error", cerr)
+		}
+		p.RecordRelaySuccess()
+		return
+	}
+	s.stats.RelayFailures.Add(1)
+	if p.RecordRelayFailure() < relayFailuresToDead {
+		s.logger.Debug("relay via proxy broke", "proxy", p.String(), "error", err)
+		return
+	}
+	s.logger.Warn("relays via proxy keep breaking", "proxy", p.String(), "error", err)
+	s.rotator.MarkDead(p)
+}
+
+// failedOn reports whether err is a failure of operation op on conn, as
+// opposed to one we caused by closing it or by a deadline.
+func failedOn(err error, conn net.Conn, op string) bool {
+	var opErr *net.OpError
+	if err == nil || ownClose(err) || !errors.As(err, &opErr) || opErr.Op != op {
+		return false
+	}
+	return opErr.Addr != nil && opErr.Addr.String() == conn.RemoteAddr().String()
+}
+
+// ownClose reports whether a relay copy ended because we closed a
+// connection or its deadline passed.
+func ownClose(err error) bool {
+	return errors.Is(err, net.ErrClosed) || errors.Is(err, os.ErrDeadlineExceeded)
+}
+
+// relay copies between client and target until both directions finish.
+// Between two raw TCP connections io.CopyBuffer defers to ReadFrom/WriteTo,
+// which use splice(2) on Linux and skip the pooled buffers; the idle
+// timeout has to watch every read, so it forces a userspace copy.
+//
+// Byte counts are added to the stats and to p, if not nil, as each
+// direction finishes, which keeps the copy loops untouched. How the relay
+// ended is recorded once both have (see relayDone).
+func (s *Server) relay(client, target net.Conn, p *proxy.Proxy) {
+	if s.maxSession > 0 {
+		t := time.AfterFunc(s.maxSession, func() {
+			client.Close()
+			target.Close()
+		})
+		defer t.Stop()
+	}
+	if s.idle > 0 {
+		t := newIdleTracker(s.idle)
+		client = &idleConn{Conn: client, t: t}
+		target = &idleConn{Conn: target, t: t}
+	}
+
 	buf1 := s.bufPool.Get().(*[]byte)
 	buf2 := s.bufPool.Get().(*[]byte)
 	defer s.bufPool.Put(buf1)
 	defer s.bufPool.Put(buf2)
 
 	var wg sync.WaitGroup
+	var upErr, downErr error
 	wg.Add(2)
 
 	go func() {
-		io.CopyBuffer(target, client, *buf1)
-		if tc, ok := target.(interface{ CloseWrite() error }); ok {
+		n, err := io.CopyBuffer(target, client, *buf1)
+		upErr = err
+		s.stats.BytesUp.Add(n)
+		if p != nil {
+			p.RecordBytes(n, 0)
+		}
+		if errors.Is(err, os.ErrDeadlineExceeded) {
+			target.Close()
+		} else if tc, ok := target.(interface{ CloseWrite() error }); ok {
 			tc.CloseWrite()
 		}
 		wg.Done()
 	}()
 
 	go func() {
-		io.CopyBuffer(client, target, *buf2)
-		if tc, ok := client.(interface{ CloseWrite() error }); ok {
+		n, err := io.CopyBuffer(client, target, *buf2)
+		downErr = err
+		s.stats.BytesDown.Add(n)
+		if p != nil {
+			p.RecordBytes(0, n)
+		}
+		if errors.Is(err, os.ErrDeadlineExceeded) {
+			client.Close()
+		} else if tc, ok := client.(interface{ CloseWrite() error }); ok {
 			tc.CloseWrite()
 		}
 		wg.Done()
 	}()
 
 	wg.Wait()
+	if p != nil {
+		s.relayDone(p, client, target, upErr, downErr)
+	}
 }
@@ -0,0 +1,599 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"runtime"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ogpourya/iploop/pkg/proxy"
+)
+
+// runNegotiate feeds in to negotiate over a pipe and returns what the
+// server wrote back.
+func runNegotiate(s *Server, creds credentials, in []byte) (out []byte, session string, err error) {
+	client, conn := net.Pipe()
+	defer client.Close()
+	go client.Write(in)
+	done := make(chan []byte)
+	go func() {
+		b, _ := io.ReadAll(client)
+		done <- b
+	}()
+	session, err = s.negotiate(conn, creds)
+	conn.Close()
+	return <-done, session, err
+}
+
+// userPass builds a client greeting offering username/password followed
+// by the RFC 1929 sub-negotiation.
+func userPass(user, pass string) []byte {
+	b := []byte{socks5Version, 1, authUserPass, 0x01, byte(len(user))}
+	b = append(b, user...)
+	b = append(b, byte(len(pass)))
+	return append(b, pass...)
+}
+
+func TestNegotiate(t *testing.T) {
+	alice := credentials{"alice", "secret"}
+	tests := []struct {
+		name     string
+		creds    credentials
+		sessions bool
+		in       []byte
+		out      []byte
+		session  string
+		ok       bool
+	}{
+		{"no auth", credentials{}, false, []byte{socks5Version, 1, authNone}, []byte{socks5Version, authNone}, "", true},
+		{"no auth offered after GSSAPI", credentials{}, false, []byte{socks5Version, 2, authGSSAPI, authNone}, []byte{socks5Version, authNone}, "", true},
+		{"good credentials", alice, false, userPass("alice", "secret"), []byte{socks5Version, authUserPass, 0x01, 0x00}, "", true},
+		{"bad password", alice, false, userPass("alice", "wrong"), []byte{socks5Version, authUserPass, 0x01, 0x01}, "", false},
+		{"bad username", alice, false, userPass("bob", "secret"), []byte{socks5Version, authUserPass, 0x01, 0x01}, "", false},
+		{"session token", alice, true, userPass("alice-session-abc", "secret"), []byte{socks5Version, authUserPass, 0x01, 0x00}, "abc", true},
+		{"session token without sessions", alice, false, userPass("alice-session-abc", "secret"), []byte{socks5Version, authUserPass, 0x01, 0x01}, "", false},
+		{"credentials required", alice, false, []byte{socks5Version, 1, authNone}, []byte{socks5Version, authNoAccept}, "", false},
+		{"only GSSAPI", credentials{}, false, []byte{socks5Version, 1, authGSSAPI}, []byte{socks5Version, authNoAccept}, "", false},
+		{"no methods", credentials{}, false, []byte{socks5Version, 0}, []byte{socks5Version, authNoAccept}, "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := New(nil, nil, WithSessions(tt.sessions))
+			out, session, err := runNegotiate(s, tt.creds, tt.in)
+			if (err == nil) != tt.ok {
+				t.Fatalf("negotiate error = %v, want ok %v", err, tt.ok)
+			}
+			if !bytes.Equal(out, tt.out) {
+				t.Errorf("server wrote %x, want %x", out, tt.out)
+			}
+			if session != tt.session {
+				t.Errorf("session = %q, want %q", session, tt.session)
+			}
+		})
+	}
+}
+
+func TestNegotiateMultipleMethods(t *testing.T) {
+	alice := credentials{"alice", "secret"}
+	tests := []struct {
+		methods []byte
+		creds   credentials
+		want    byte // Method the server picks
+		errText string
+	}{
+		{[]byte{authGSSAPI, authNone}, credentials{}, authNone, ""},
+		{[]byte{authNone, authGSSAPI}, credentials{}, authNone, ""},
+		{[]byte{0x80, authGSSAPI, authUserPass, authNone}, credentials{}, authNone, ""},
+		{[]byte{authGSSAPI, authNone, authUserPass}, alice, authUserPass, ""},
+		{[]byte{authUserPass, authGSSAPI}, alice, authUserPass, ""},
+		{[]byte{authGSSAPI, authGSSAPI}, credentials{}, authNoAccept, "client offered GSSAPI, GSSAPI"},
+		{[]byte{authGSSAPI, authNone, 0xFE}, alice, authNoAccept, "client offered GSSAPI, none, 0xfe"},
+		{[]byte{authGSSAPI, authUserPass}, credentials{}, authNoAccept, "client offered GSSAPI, username/password"},
+	}
+	for _, tt := range tests {
+		in := append([]byte{socks5Version, byte(len(tt.methods))}, tt.methods...)
+		if tt.want == authUserPass {
+			in = append(in, userPass(tt.creds.username, tt.creds.password)[3:]...)
+		}
+		out, _, err := runNegotiate(New(nil, nil), tt.creds, in)
+		if len(out) < 2 || out[1] != tt.want {
+			t.Errorf("methods %x: server wrote %x, want method %#x", tt.methods, out, tt.want)
+		}
+		if tt.errText == "" {
+			if err != nil {
+				t.Errorf("methods %x: %v", tt.methods, err)
+			}
+		} else if err == nil || !strings.Contains(err.Error(), tt.errText) {
+			t.Errorf("methods %x: error %v, want it to mention %q", tt.methods, err, tt.errText)
+		}
+	}
+}
+
+func TestNegotiateBadVersion(t *testing.T) {
+	s := New(nil, nil)
+	out, _, err := runNegotiate(s, credentials{}, []byte{0x04, 1, authNone})
+	if err == nil {
+		t.Fatal("negotiate accepted a SOCKS4 greeting")
+	}
+	if len(out) != 0 {
+		t.Errorf("server wrote %x to a SOCKS4 greeting", out)
+	}
+}
+
+func TestCheckCredentials(t *testing.T) {
+	creds := credentials{"alice", "secret"}
+	tests := []struct {
+		user, pass string
+		sessions   bool
+		session    string
+		ok         bool
+	}{
+		{"alice", "secret", false, "", true},
+		{"alice", "secret", true, "", true},
+		{"alice", "wrong", false, "", false},
+		{"Alice", "secret", false, "", false},
+		{"alice-session-abc", "secret", true, "abc", true},
+		{"alice-session-abc", "wrong", true, "", false},
+		{"alice-session-abc", "secret", false, "", false},
+		{"alice-session-", "secret", true, "", false},
+		{"bob-session-abc", "secret", true, "", false},
+	}
+	for _, tt := range tests {
+		s := New(nil, nil, WithSessions(tt.sessions))
+		session, ok := s.checkCredentials(tt.user, tt.pass, creds)
+		if ok != tt.ok || (ok && session != tt.session) {
+			t.Errorf("checkCredentials(%q, %q) with sessions %v = %q, %v; want %q, %v",
+				tt.user, tt.pass, tt.sessions, session, ok, tt.session, tt.ok)
+		}
+	}
+}
+
+func TestCheckCredentialsMarkerInUsername(t *testing.T) {
+	s := New(nil, nil, WithSessions(true))
+	creds := credentials{"team-session-a", "secret"}
+	if session, ok := s.checkCredentials("team-session-a", "secret", creds); !ok || session != "" {
+		t.Errorf("exact username = %q, %v; want no session, ok", session, ok)
+	}
+	if session, ok := s.checkCredentials("team-session-a-session-xyz", "secret", creds); !ok || session != "xyz" {
+		t.Errorf("username with token = %q, %v; want \"xyz\", ok", session, ok)
+	}
+}
+
+// dialRecord is one Dial seen by a scriptedDialer.
+type dialRecord struct {
+	proxy *proxy.Proxy
+	at    time.Time
+}
+
+// scriptedDialer answers dials with dial and records them.
+type scriptedDialer struct {
+	dial func(ctx context.Context, p *proxy.Proxy) (net.Conn, error)
+
+	mu    sync.Mutex
+	dials []dialRecord
+}
+
+func (d *scriptedDialer) Dial(ctx context.Context, p *proxy.Proxy, target string) (net.Conn, error) {
+	d.mu.Lock()
+	d.dials = append(d.dials, dialRecord{p, time.Now()})
+	d.mu.Unlock()
+	return d.dial(ctx, p)
+}
+
+func (d *scriptedDialer) records() []dialRecord {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return slices.Clone(d.dials)
+}
+
+// pipeConn returns one end of a pipe whose other end is closed with the
+// test.
+func pipeConn(t testing.TB) net.Conn {
+	a, b := net.Pipe()
+	t.Cleanup(func() { b.Close() })
+	return a
+}
+
+// retryRotator returns a round-robin rotator over n proxies named p0, p1...
+func retryRotator(t testing.TB, n int) *proxy.Rotator {
+	t.Helper()
+	r := proxy.NewRotator(proxy.RotationRoundRobin, false, 0)
+	for i := range n {
+		r.AddProxy(mustProxy(t, fmt.Sprintf("http://p%d:8080", i)))
+	}
+	return r
+}
+
+func TestConnectRetryDelaySequential(t *testing.T) {
+	const delay = 50 * time.Millisecond
+	d := &scriptedDialer{dial: func(context.Context, *proxy.Proxy) (net.Conn, error) {
+		return nil, errors.New("refused")
+	}}
+	s := New(retryRotator(t, 5), d, WithRetryDelay(delay), WithRetryPolicy(3, true))
+
+	if _, _, err := s.connectToTarget(s.ctx, nil, "example.com:80", "", ""); err == nil {
+		t.Fatal("connect succeeded with every dial failing")
+	}
+	dials := d.records()
+	if len(dials) != 3 {
+		t.Fatalf("dialed %d proxies, want -max-retries 3", len(dials))
+	}
+	for i := 1; i < len(dials); i++ {
+		if gap := dials[i].at.Sub(dials[i-1].at); gap < delay {
+			t.Errorf("attempt %d started %v after the previous one, want at least %v", i+1, gap, delay)
+		}
+	}
+}
+
+func TestConnectRetryChangesProxy(t *testing.T) {
+	for _, rotate := range []bool{false, true} {
+		d := &scriptedDialer{dial: func(context.Context, *proxy.Proxy) (net.Conn, error) {
+			return nil, errors.New("refused")
+		}}
+		// With auto, Next stays on one proxy for as long as it is alive.
+		r := proxy.NewRotator(proxy.RotationSequential, false, -1)
+		for i := range 4 {
+			r.AddProxy(mustProxy(t, fmt.Sprintf("http://p%d:8080", i)))
+		}
+		s := New(r, d, WithRetryDelay(0), WithRetryPolicy(2, true), WithForceRotateOnFail(rotate))
+
+		var firsts []string
+		for range 2 {
+			before := len(d.records())
+			if _, _, err := s.connectToTarget(s.ctx, nil, "example.com:80", "", ""); err == nil {
+				t.Fatal("connect succeeded with every dial failing")
+			}
+			dials := d.records()[before:]
+			if len(dials) != 2 || dials[0].proxy == dials[1].proxy {
+				t.Fatalf("rotate %v: request dialed %v, want two different proxies", rotate, dials)
+			}
+			firsts = append(firsts, dials[0].proxy.Host)
+		}
+		if changed := firsts[0] != firsts[1]; changed != rotate {
+			t.Errorf("rotate %v: consecutive failed requests started at %v", rotate, firsts)
+		}
+	}
+}
+
+func TestConnectHoldsMaxPerProxy(t *testing.T) {
+	const limit, proxies, clients = 2, 3, 20
+	d := &scriptedDialer{dial: func(context.Context, *proxy.Proxy) (net.Conn, error) {
+		time.Sleep(50 * time.Millisecond) // Keep every handshake in flight at once.
+		return pipeConn(t), nil
+	}}
+	r := retryRotator(t, proxies)
+	r.SetMaxPerProxy(limit)
+	// Sequential, so no losing race dial holds a slot for a moment.
+	s := New(r, d, WithRetryDelay(0), WithRetryPolicy(3, true))
+
+	var mu sync.Mutex
+	var used []*proxy.Proxy
+	var wg sync.WaitGroup
+	for range clients {
+		wg.Go(func() {
+			conn, p, err := s.connectToTarget(s.ctx, nil, "example.com:80", "", "")
+			if err != nil {
+				return
+			}
+			conn.Close()
+			mu.Lock()
+			used = append(used, p)
+			mu.Unlock()
+		})
+	}
+	wg.Wait()
+
+	dials := make(map[*proxy.Proxy]int)
+	for _, rec := range d.records() {
+		dials[rec.proxy]++
+	}
+	for _, p := range r.GetProxies() {
+		if dials[p] > limit || p.ActiveConns() > limit {
+			t.Errorf("%s: %d dials, %d active; want at most %d", p, dials[p], p.ActiveConns(), limit)
+		}
+	}
+	if len(used) != limit*proxies {
+		t.Errorf("%d clients connected, want %d", len(used), limit*proxies)
+	}
+	for _, p := range used {
+		p.Release()
+	}
+	for _, p := range r.GetProxies() {
+		if n := p.ActiveConns(); n != 0 {
+			t.Errorf("%s has %d connections after every one was released", p, n)
+		}
+	}
+}
+
+func TestConnectRetryDelayStaggersRace(t *testing.T) {
+	const delay = 100 * time.Millisecond
+	d := &scriptedDialer{dial: func(ctx context.Context, p *proxy.Proxy) (net.Conn, error) {
+		if p.Host == "p0" {
+			<-ctx.Done() // Hangs until the race is won.
+			return nil, ctx.Err()
+		}
+		return pipeConn(t), nil
+	}}
+	s := New(retryRotator(t, 3), d, WithRetryDelay(delay), WithRetryPolicy(3, false))
+
+	conn, p, err := s.connectToTarget(s.ctx, nil, "example.com:80", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	if p.Host != "p1" {
+		t.Errorf("connected through %s, want the second candidate", p)
+	}
+	dials := d.records()
+	if len(dials) != 2 {
+		t.Fatalf("dialed %d proxies, want 2", len(dials))
+	}
+	if gap := dials[1].at.Sub(dials[0].at); gap < delay {
+		t.Errorf("second dial started %v after the first, want at least %v", gap, delay)
+	}
+	if got := s.stats.RacedRequests.Load(); got != 1 {
+		t.Errorf("RacedRequests = %d, want 1", got)
+	}
+}
+
+func TestConnectRaceMovesOnWhenDialFails(t *testing.T) {
+	// A failed dial starts the next candidate at once, without waiting out
+	// the delay.
+	d := &scriptedDialer{dial: func(_ context.Context, p *proxy.Proxy) (net.Conn, error) {
+		if p.Host == "p0" {
+			return nil, errors.New("refused")
+		}
+		return pipeConn(t), nil
+	}}
+	s := New(retryRotator(t, 2), d, WithRetryDelay(time.Hour), WithRetryPolicy(3, false))
+
+	start := time.Now()
+	conn, _, err := s.connectToTarget(s.ctx, nil, "example.com:80", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("connect took %v after the first dial failed", elapsed)
+	}
+}
+
+func TestConnectRaceClosesLosers(t *testing.T) {
+	// Every dial starts at once; the losers connect after the winner,
+	// ignoring the cancel, and their connections must still be closed.
+	var mu sync.Mutex
+	peers := make(map[string]net.Conn)
+	d := &scriptedDialer{dial: func(_ context.Context, p *proxy.Proxy) (net.Conn, error) {
+		if p.Host != "p0" {
+			time.Sleep(100 * time.Millisecond)
+		}
+		a, b := net.Pipe()
+		t.Cleanup(func() { b.Close() })
+		mu.Lock()
+		peers[p.Host] = b
+		mu.Unlock()
+		return a, nil
+	}}
+	s := New(retryRotator(t, 3), d, WithRetryDelay(0), WithRetryPolicy(3, false))
+
+	conn, p, err := s.connectToTarget(s.ctx, nil, "example.com:80", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if p.Host != "p0" {
+		t.Fatalf("connected through %s, want p0", p)
+	}
+
+	closed := func(c net.Conn) bool {
+		c.SetReadDeadline(time.Now().Add(time.Second))
+		_, err := c.Read(make([]byte, 1))
+		return errors.Is(err, io.EOF)
+	}
+	time.Sleep(200 * time.Millisecond)
+	mu.Lock()
+	defer mu.Unlock()
+	if len(peers) != 3 {
+		t.Fatalf("%d dials connected, want 3", len(peers))
+	}
+	for host, peer := range peers {
+		if host == "p0" {
+			continue
+		}
+		if !closed(peer) {
+			t.Errorf("losing connection through %s was left open", host)
+		}
+	}
+	// Only the winner keeps its connection slot.
+	for _, q := range s.rotator.GetProxies() {
+		want := int64(0)
+		if q == p {
+			want = 1
+		}
+		if n := q.ActiveConns(); n != want {
+			t.Errorf("%s has %d connections, want %d", q, n, want)
+		}
+	}
+	peers["p0"].SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	if _, err := peers["p0"].Read(make([]byte, 1)); errors.Is(err, io.EOF) {
+		t.Error("winning connection was closed")
+	}
+}
+
+// startServer serves s on a loopback port for the rest of the test and
+// returns its address.
+func startServer(t testing.TB, s *Server) string {
+	t.Helper()
+	if err := s.Listen("127.0.0.1:0"); err != nil {
+		t.Fatal(err)
+	}
+	go s.Serve()
+	t.Cleanup(func() { s.Close() })
+	return s.Addr()
+}
+
+// closedWithin reports whether the server closes conn within d, without
+// sending anything more.
+func closedWithin(t testing.TB, conn net.Conn, d time.Duration) bool {
+	t.Helper()
+	conn.SetReadDeadline(time.Now().Add(d))
+	n, err := conn.Read(make([]byte, 1))
+	if n > 0 {
+		t.Errorf("server sent data to a stalled client")
+	}
+	return err != nil && !errors.Is(err, os.ErrDeadlineExceeded)
+}
+
+func TestHandshakeDeadlineSlowClient(t *testing.T) {
+	tests := []struct {
+		name     string
+		deadline time.Duration
+		closed   time.Duration // Dropped after about this long
+	}{
+		{"overall deadline", 300 * time.Millisecond, 300 * time.Millisecond},
+		{"per-read deadline", time.Minute, handshakeReadTimeout},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			addr := startServer(t, New(proxy.NewRotator(proxy.RotationRandom, false, 0), nil, WithHandshakeDeadline(tt.deadline)))
+			conn, err := net.Dial("tcp", addr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			start := time.Now()
+			conn.Write([]byte{socks5Version}) // Then stall.
+			if !closedWithin(t, conn, tt.closed+time.Second) {
+				t.Fatalf("stalled client still connected after %v", time.Since(start))
+			}
+			if elapsed := time.Since(start); elapsed < tt.closed-50*time.Millisecond {
+				t.Errorf("stalled client dropped after %v, want about %v", elapsed, tt.closed)
+			}
+		})
+	}
+}
+
+func TestHandshakeDeadlineTricklingClient(t *testing.T) {
+	// A client that keeps sending, however slowly, may use the whole
+	// window.
+	s := New(proxy.NewRotator(proxy.RotationRandom, false, 0), nil, WithHandshakeDeadline(5*time.Second))
+	conn, err := net.Dial("tcp", startServer(t, s))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	for _, b := range []byte{socks5Version, 2, authGSSAPI, authNone} {
+		if _, err := conn.Write([]byte{b}); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(200 * time.Millisecond)
+	}
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	reply := make([]byte, 2)
+	if _, err := io.ReadFull(conn, reply); err != nil || !bytes.Equal(reply, []byte{socks5Version, authNone}) {
+		t.Errorf("trickling client got %x, %v; want method reply", reply, err)
+	}
+}
+
+// domainRequest builds a SOCKS5 request for host:port by name.
+func domainRequest(cmd byte, host string, port int) []byte {
+	b := []byte{socks5Version, cmd, 0x00, addrDomain, byte(len(host))}
+	b = append(b, host...)
+	return append(b, byte(port>>8), byte(port))
+}
+
+func TestReadRequest(t *testing.T) {
+	const noReply = 0xFF
+	tests := []struct {
+		name   string
+		in     []byte
+		target string // Empty when the request is refused
+		reply  byte   // Reply sent on refusal, or noReply
+	}{
+		{"IPv4", []byte{socks5Version, cmdConnect, 0, addrIPv4, 192, 0, 2, 1, 0, 80}, "192.0.2.1:80", noReply},
+		{"IPv6", append([]byte{socks5Version, cmdConnect, 0, addrIPv6}, append(net.ParseIP("2001:db8::1"), 1, 187)...), "[2001:db8::1]:443", noReply},
+		{"domain", domainRequest(cmdConnect, "example.com", 443), "example.com:443", noReply},
+		{"longest domain", domainRequest(cmdConnect, strings.Repeat("a", 255), 80), strings.Repeat("a", 255) + ":80", noReply},
+		{"UDP port 0", domainRequest(cmdUDPAssociate, "0.0.0.0", 0), "0.0.0.0:0", noReply},
+		{"BIND", []byte{socks5Version, cmdBind, 0, addrIPv4, 0, 0, 0, 0, 0, 0}, "0.0.0.0:0", noReply},
+		{"empty domain", domainRequest(cmdConnect, "", 80), "", replyAddrNotSupp},
+		{"CONNECT port 0", domainRequest(cmdConnect, "example.com", 0), "", replyAddrNotSupp},
+		{"IPv4 port 0", []byte{socks5Version, cmdConnect, 0, addrIPv4, 192, 0, 2, 1, 0, 0}, "", replyAddrNotSupp},
+		{"NUL in domain", domainRequest(cmdConnect, "example.com\x00.evil", 80), "", replyAddrNotSupp},
+		{"space in domain", domainRequest(cmdConnect, "exa mple.com", 80), "", replyAddrNotSupp},
+		{"control byte in domain", domainRequest(cmdConnect, "example\r\n.com", 80), "", replyAddrNotSupp},
+		{"high byte in domain", domainRequest(cmdConnect, "ex\xffample.com", 80), "", replyAddrNotSupp},
+		{"bad address type", []byte{socks5Version, cmdConnect, 0, 0x02, 1, 2, 3, 4, 0, 80}, "", replyAddrNotSupp},
+		{"bad command", []byte{socks5Version, 0x09, 0, addrIPv4, 1, 2, 3, 4, 0, 80}, "", replyCmdNotSupp},
+		{"bad version", []byte{0x04, cmdConnect, 0, addrIPv4, 1, 2, 3, 4, 0, 80}, "", replyGeneralFail},
+		{"truncated domain", []byte{socks5Version, cmdConnect, 0, addrDomain, 20, 'a', 'b'}, "", noReply},
+		{"truncated port", []byte{socks5Version, cmdConnect, 0, addrIPv4, 1, 2, 3, 4, 0}, "", noReply},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := New(nil, nil)
+			client, conn := net.Pipe()
+			go func() {
+				client.Write(tt.in)
+				// Hang up so truncated requests end in EOF.
+				if tt.reply == noReply && tt.target == "" {
+					client.Close()
+				}
+			}()
+			done := make(chan []byte)
+			go func() {
+				b, _ := io.ReadAll(client)
+				done <- b
+			}()
+			_, target, err := s.readRequest(conn)
+			conn.Close()
+			out := <-done
+			client.Close()
+
+			if target != tt.target || (err == nil) != (tt.target != "") {
+				t.Errorf("readRequest = %q, %v; want %q", target, err, tt.target)
+			}
+			switch {
+			case tt.reply == noReply && len(out) > 0:
+				t.Errorf("server replied %x, want no reply", out)
+			case tt.reply != noReply && (len(out) < 2 || out[1] != tt.reply):
+				t.Errorf("server replied %x, want code %#02x", out, tt.reply)
+			}
+		})
+	}
+}
+
+// BenchmarkRejectIdleClients turns away clients that connect to a full
+// server and then send nothing, the cheapest flood there is. Only
+// maxRejecting of them may hold a goroutine at once; the rest are closed.
+func BenchmarkRejectIdleClients(b *testing.B) {
+	s := New(nil, nil)
+	before := runtime.NumGoroutine()
+	var clients []net.Conn
+	peak := 0
+	b.ReportAllocs()
+	for b.Loop() {
+		client, conn := net.Pipe()
+		clients = append(clients, client)
+		s.rejectConn(conn, credentials{})
+		peak = max(peak, runtime.NumGoroutine()-before)
+	}
+	b.StopTimer()
+	b.ReportMetric(float64(peak), "goroutines")
+	if peak > maxRejecting {
+		b.Errorf("%d goroutines answering rejected clients, want at most %d", peak, maxRejecting)
+	}
+	for _, c := range clients {
+		c.Close()
+	}
+	s.Close()
+}
@@ -2,9 +2,15 @@
 
 package server
 
-import "syscall"
+import (
+	"strings"
+	"syscall"
+)
 
 func setSocketOptions(network, address string, c syscall.RawConn) error {
+	if !strings.HasPrefix(network, "tcp") {
+		return nil
+	}
 	var sysErr error
 	err := c.Control(func(fd uintptr) {
 		sysErr = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_REUSEADDR, 1)
@@ -0,0 +1,43 @@
+//go:build !windows
+
+package server
+
+import (
+	"net"
+	"syscall"
+	"testing"
+)
+
+func TestSetSocketOptions(t *testing.T) {
+	lc := net.ListenConfig{Control: setSocketOptions}
+	ln, err := lc.Listen(t.Context(), "tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	rc, err := ln.(*net.TCPListener).SyscallConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var noDelay, reuse int
+	var sysErr error
+	err = rc.Control(func(fd uintptr) {
+		if noDelay, sysErr = syscall.GetsockoptInt(int(fd), syscall.IPPROTO_TCP, syscall.TCP_NODELAY); sysErr != nil {
+			return
+		}
+		reuse, sysErr = syscall.GetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_REUSEADDR)
+	})
+	if err == nil {
+		err = sysErr
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	if noDelay == 0 {
+		t.Error("TCP_NODELAY is off")
+	}
+	if reuse == 0 {
+		t.Error("SO_REUSEADDR is off")
+	}
+}
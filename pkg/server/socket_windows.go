@@ -2,8 +2,25 @@
 
 package server
 
-import "syscall"
+import (
+	"strings"
+	"syscall"
+)
 
+// setSocketOptions matches socket_unix.go where the semantics agree. It
+// skips SO_REUSEADDR: Windows already allows rebinding a port in
+// TIME_WAIT, and there the option would let another socket bind the same
+// port while we are listening on it.
 func setSocketOptions(network, address string, c syscall.RawConn) error {
-	return nil
+	if !strings.HasPrefix(network, "tcp") {
+		return nil
+	}
+	var sysErr error
+	err := c.Control(func(fd uintptr) {
+		sysErr = syscall.SetsockoptInt(syscall.Handle(fd), syscall.IPPROTO_TCP, syscall.TCP_NODELAY, 1)
+	})
+	if err != nil {
+		return err
+	}
+	return sysErr
 }
@@ -0,0 +1,49 @@
+//go:build windows
+
+package server
+
+import (
+	"net"
+	"syscall"
+	"testing"
+	"unsafe"
+)
+
+func TestSetSocketOptions(t *testing.T) {
+	lc := net.ListenConfig{Control: setSocketOptions}
+	ln, err := lc.Listen(t.Context(), "tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	rc, err := ln.(*net.TCPListener).SyscallConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var noDelay, reuse int32
+	var sysErr error
+	err = rc.Control(func(fd uintptr) {
+		get := func(level, opt int32, v *int32) {
+			if sysErr != nil {
+				return
+			}
+			n := int32(unsafe.Sizeof(*v))
+			sysErr = syscall.Getsockopt(syscall.Handle(fd), level, opt, (*byte)(unsafe.Pointer(v)), &n)
+		}
+		get(syscall.IPPROTO_TCP, syscall.TCP_NODELAY, &noDelay)
+		get(syscall.SOL_SOCKET, syscall.SO_REUSEADDR, &reuse)
+	})
+	if err == nil {
+		err = sysErr
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	if noDelay == 0 {
+		t.Error("TCP_NODELAY is off")
+	}
+	if reuse != 0 {
+		t.Error("SO_REUSEADDR is on, letting other sockets bind our port")
+	}
+}
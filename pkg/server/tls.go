@@ -0,0 +1,101 @@
+package server
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// TLSOptions configures TLS to HTTPS proxies.
+type TLSOptions struct {
+	TrustProxy bool     // Skip certificate verification unless CAFile is set
+	CertFile   string   // Client certificate for mutual TLS
+	KeyFile    string   // Private key for CertFile
+	CAFile     string   // PEM bundle used instead of the system roots
+	MinVersion string   // "1.0" to "1.3"; empty keeps the Go default
+	Ciphers    []string // Allowed cipher suite names (TLS 1.0-1.2); empty keeps the Go default
+}
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+func parseCipherSuites(names []string) ([]uint16, error) {
+	known := make(map[string]uint16)
+	for _, cs := range tls.CipherSuites() {
+		known[cs.Name] = cs.ID
+	}
+	for _, cs := range tls.InsecureCipherSuites() {
+		known[cs.Name] = cs.ID
+	}
+
+	ids := make([]uint16, 0, len(names))
+	for _, name := range names {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		id, ok := known[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown cipher suite: %s", name)
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+// Config loads the configured files and returns the base tls.Config for
+// HTTPS proxies. ServerName is filled in per proxy when dialing.
+func (o TLSOptions) Config() (*tls.Config, error) {
+	cfg := &tls.Config{
+		InsecureSkipVerify: o.TrustProxy,
+	}
+
+	if o.CertFile != "" || o.KeyFile != "" {
+		if o.CertFile == "" || o.KeyFile == "" {
+			return nil, fmt.Errorf("client certificate and key must both be set")
+		}
+		cert, err := tls.LoadX509KeyPair(o.CertFile, o.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("load client certificate: %w", err)
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+
+	if o.MinVersion != "" {
+		v, ok := tlsVersions[o.MinVersion]
+		if !ok {
+			return nil, fmt.Errorf("unknown TLS version %q (want 1.0, 1.1, 1.2 or 1.3)", o.MinVersion)
+		}
+		cfg.MinVersion = v
+	}
+
+	if len(o.Ciphers) > 0 {
+		ids, err := parseCipherSuites(o.Ciphers)
+		if err != nil {
+			return nil, err
+		}
+		cfg.CipherSuites = ids
+	}
+
+	if o.CAFile != "" {
+		pem, err := os.ReadFile(o.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("read CA bundle: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", o.CAFile)
+		}
+		cfg.RootCAs = pool
+		// An explicit CA bundle means the user wants verification.
+		cfg.InsecureSkipVerify = false
+	}
+
+	return cfg, nil
+}
@@ -0,0 +1,244 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/ogpourya/iploop/pkg/proxy"
+)
+
+const maxUDPPacket = 64 * 1024
+
+func (s *Server) handleUDPAssociate(conn net.Conn) {
+	p, err := s.rotator.Next()
+	if err != nil || !s.rotator.Reserve(p) {
+		s.stats.FailedRequests.Add(1)
+		s.sendReply(conn, replyGeneralFail, nil)
+		return
+	}
+	defer p.Release()
+
+	ud, ok := s.dialer.(UDPDialer)
+	if !ok || p.Type != proxy.ProxyTypeSOCKS5 || len(p.Via) > 0 {
+		s.logger.Debug("UDP associate not supported by proxy", "proxy", p.String())
+		s.sendReply(conn, replyCmdNotSupp, nil)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(s.ctx, s.connectTTL)
+	start := time.Now()
+	ctrl, upstream, err := ud.DialUDP(ctx, p)
+	cancel()
+	latency := time.Since(start)
+
+	s.logger.Debug("UDP associate", "proxy", p.String(), latencyMs(latency), "success", err == nil)
+
+	if err != nil {
+		s.stats.FailedRequests.Add(1)
+		p.RecordFailure()
+		// A proxy that refuses UDP is still fine for CONNECT.
+		var socksErr *SOCKS5Error
+		if !errors.As(err, &socksErr) {
+			s.rotator.MarkDead(p)
+		}
+		s.sendReply(conn, replyCode(err), nil)
+		return
+	}
+	defer ctrl.Close()
+	defer upstream.Close()
+
+	// Bind the relay socket on the interface the client reached us on.
+	// Clients on a Unix socket are local, so keep the relay on loopback.
+	localIP := net.IPv4(127, 0, 0, 1)
+	if addr, ok := conn.LocalAddr().(*net.TCPAddr); ok {
+		localIP = addr.IP
+	}
+	local, err := net.ListenUDP("udp", &net.UDPAddr{IP: localIP})
+	if err != nil {
+		s.stats.FailedRequests.Add(1)
+		s.sendReply(conn, replyGeneralFail, nil)
+		return
+	}
+	defer local.Close()
+
+	s.stats.SuccessRequests.Add(1)
+	p.RecordRequest(latency)
+	defer p.Track(conn, upstream)()
+
+	if err := s.sendReply(conn, replySuccess, local.LocalAddr()); err != nil {
+		return
+	}
+
+	s.relayUDP(conn, ctrl, local, upstream, p)
+}
+
+// relayUDP shuttles datagrams between the client and the upstream relay
+// until either TCP control connection closes.
+func (s *Server) relayUDP(client, ctrl net.Conn, local *net.UDPConn, upstream net.Conn, p *proxy.Proxy) {
+	clientIP := net.IPv4(127, 0, 0, 1)
+	if addr, ok := client.RemoteAddr().(*net.TCPAddr); ok {
+		clientIP = addr.IP
+	}
+
+	var (
+		mu         sync.Mutex
+		clientAddr *net.UDPAddr
+	)
+
+	var once sync.Once
+	done := make(chan struct{})
+	stop := func() {
+		once.Do(func() {
+			close(done)
+			local.Close()
+			upstream.Close()
+			client.Close()
+			ctrl.Close()
+		})
+	}
+
+	if s.maxSession > 0 {
+		t := time.AfterFunc(s.maxSession, stop)
+		defer t.Stop()
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(4)
+
+	// The association lives as long as both control connections are open.
+	go func() {
+		io.Copy(io.Discard, client)
+		stop()
+		wg.Done()
+	}()
+	go func() {
+		io.Copy(io.Discard, ctrl)
+		stop()
+		wg.Done()
+	}()
+
+	go func() {
+		defer wg.Done()
+		buf := make([]byte, maxUDPPacket)
+		out := make([]byte, 0, maxUDPPacket+262)
+		for {
+			n, from, err := local.ReadFromUDP(buf)
+			if err != nil {
+				stop()
+				return
+			}
+			if clientIP != nil && !from.IP.Equal(clientIP) {
+				continue
+			}
+			dst, payload, err := parseUDPHeader(buf[:n])
+			if err == nil && s.filter != nil {
+				err = s.filter.checkDatagram(dst)
+			}
+			if err != nil {
+				s.logger.Debug("dropping UDP datagram", "client", from.String(), "error", err)
+				continue
+			}
+			mu.Lock()
+			clientAddr = from
+			mu.Unlock()
+
+			out, err = appendUDPHeader(out[:0], dst)
+			if err != nil {
+				continue
+			}
+			out = append(out, payload...)
+			if _, err := upstream.Write(out); err != nil {
+				stop()
+				return
+			}
+			s.stats.BytesUp.Add(int64(len(payload)))
+			p.RecordBytes(int64(len(payload)), 0)
+		}
+	}()
+
+	go func() {
+		defer wg.Done()
+		buf := make([]byte, maxUDPPacket)
+		out := make([]byte, 0, maxUDPPacket+262)
+		for {
+			n, err := upstream.Read(buf)
+			if err != nil {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				// ICMP errors surface as read failures on connected sockets;
+				// they don't end the association.
+				continue
+			}
+			src, payload, err := parseUDPHeader(buf[:n])
+			if err != nil {
+				s.logger.Debug("dropping UDP datagram", "proxy", p.String(), "error", err)
+				continue
+			}
+			mu.Lock()
+			to := clientAddr
+			mu.Unlock()
+			if to == nil {
+				continue
+			}
+
+			out, err = appendUDPHeader(out[:0], src)
+			if err != nil {
+				continue
+			}
+			out = append(out, payload...)
+			if _, err := local.WriteToUDP(out, to); err == nil {
+				s.stats.BytesDown.Add(int64(len(payload)))
+				p.RecordBytes(0, int64(len(payload)))
+			}
+		}
+	}()
+
+	wg.Wait()
+}
+
+// parseUDPHeader splits a SOCKS5 UDP datagram into its destination
+// address and payload. Fragments (FRAG other than 0) are rejected rather
+// than reassembled; RFC 1928 makes reassembly optional, and relaying one
+// on its own would send a partial payload.
+func parseUDPHeader(b []byte) (string, []byte, error) {
+	if len(b) < 4 {
+		return "", nil, fmt.Errorf("short UDP header")
+	}
+	if b[0] != 0x00 || b[1] != 0x00 {
+		return "", nil, fmt.Errorf("bad RSV")
+	}
+	if b[2] != 0x00 {
+		return "", nil, fmt.Errorf("fragmentation not supported")
+	}
+	addr, n, err := parseSocksAddr(b[3:])
+	if err != nil {
+		return "", nil, err
+	}
+	return addr, b[3+n:], nil
+}
+
+// appendUDPHeader appends a SOCKS5 UDP request header for addr to b.
+func appendUDPHeader(b []byte, addr string) ([]byte, error) {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return b, err
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil || port < 0 || port > 65535 {
+		return b, fmt.Errorf("invalid port")
+	}
+	if len(host) > 255 {
+		return b, fmt.Errorf("hostname too long")
+	}
+	b = append(b, 0x00, 0x00, 0x00)
+	return appendSocksAddr(b, host, port), nil
+}